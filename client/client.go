@@ -0,0 +1,404 @@
+// Copyright (C) 2015 Daniel Harrison
+
+// Package client talks to a cluster of brokers, sending each publish and
+// subscribe to the leader of its partition. It learns the leaders from the
+// metadata of whichever broker answers, and refreshes them when a request
+// reaches a broker that is no longer the leader or can't be reached.
+package client
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/paperstreet/gopubsub/server"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// retries is how many times a request is retried after finding the
+	// leader moved or down. With retryDelay, this outlasts an election.
+	retries    = 20
+	retryDelay = 500 * time.Millisecond
+)
+
+// Client routes requests to the brokers of one cluster.
+type Client struct {
+	bootstrap []string
+
+	// unkeyed picks the partition for the next publish of messages without a
+	// key, when they're routed here instead of by a broker.
+	unkeyed uint32
+
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+	// brokers maps broker ids to addresses, and is empty if the cluster is a
+	// single broker not configured with any, in which case every request goes
+	// to fallback, the last broker to answer with metadata.
+	brokers  map[int32]string
+	fallback string
+	topics   map[string]*pb.TopicMetadata
+}
+
+// NewClient fetches the cluster's metadata from the first of addresses to
+// answer.
+func NewClient(ctx context.Context, addresses []string) (*Client, error) {
+	if len(addresses) == 0 {
+		return nil, errors.New("No brokers to bootstrap from")
+	}
+	c := Client{
+		bootstrap: addresses,
+		conns:     make(map[string]*grpc.ClientConn),
+		brokers:   make(map[int32]string),
+		topics:    make(map[string]*pb.TopicMetadata),
+	}
+	if err := c.Refresh(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Close closes the connections to every broker.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	for address, conn := range c.conns {
+		if closeErr := conn.Close(); err == nil {
+			err = closeErr
+		}
+		delete(c.conns, address)
+	}
+	return err
+}
+
+// conn returns the connection to the broker at address. c.mu must be held.
+func (c *Client) conn(address string) (*grpc.ClientConn, error) {
+	conn, ok := c.conns[address]
+	if !ok {
+		var err error
+		if conn, err = grpc.Dial(address); err != nil {
+			return nil, err
+		}
+		c.conns[address] = conn
+	}
+	return conn, nil
+}
+
+// redial closes conn if err says the broker at address couldn't be reached
+// over it, so the next request dials the broker afresh instead of waiting out
+// the connection's reconnect backoff, which can outlast a broker restarting.
+// Subscriptions using the connection fail as Unavailable and resubscribe.
+func (c *Client) redial(address string, conn *grpc.ClientConn, err error) {
+	if grpc.Code(err) != codes.Unavailable {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conns[address] == conn {
+		conn.Close()
+		delete(c.conns, address)
+	}
+}
+
+// Refresh replaces the metadata of the given topics, or of every topic if
+// none are given, with that of the first broker to answer. Known brokers are
+// tried before the ones bootstrapped from.
+func (c *Client) Refresh(ctx context.Context, topics ...string) error {
+	c.mu.Lock()
+	var ids []int
+	for id := range c.brokers {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	var addresses []string
+	for _, id := range ids {
+		addresses = append(addresses, c.brokers[int32(id)])
+	}
+	addresses = append(addresses, c.bootstrap...)
+	c.mu.Unlock()
+
+	var err error
+	for _, address := range addresses {
+		var reply *pb.GetMetadataReply
+		c.mu.Lock()
+		conn, dialErr := c.conn(address)
+		c.mu.Unlock()
+		if err = dialErr; err == nil {
+			reply, err = pb.NewPubSubClient(conn).GetMetadata(ctx, &pb.GetMetadataRequest{Topics: topics})
+			c.redial(address, conn, err)
+		}
+		if err != nil {
+			continue
+		}
+
+		c.mu.Lock()
+		c.brokers = make(map[int32]string)
+		for _, metadata := range reply.GetBrokers() {
+			c.brokers[metadata.Id] = metadata.Address
+		}
+		c.fallback = address
+		if len(topics) == 0 {
+			c.topics = make(map[string]*pb.TopicMetadata)
+		}
+		for _, name := range topics {
+			delete(c.topics, name)
+		}
+		for _, metadata := range reply.GetTopics() {
+			c.topics[metadata.Topic] = metadata
+		}
+		c.mu.Unlock()
+		return nil
+	}
+	return errors.New(fmt.Sprintf("No broker answered with metadata: %v", err))
+}
+
+// metadata returns the metadata of a topic, refreshing it if the topic isn't
+// known, or nil if it doesn't exist.
+func (c *Client) metadata(ctx context.Context, topic string) (*pb.TopicMetadata, error) {
+	c.mu.Lock()
+	metadata, ok := c.topics[topic]
+	c.mu.Unlock()
+	if ok {
+		return metadata, nil
+	}
+	if err := c.Refresh(ctx, topic); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.topics[topic], nil
+}
+
+// Leader returns a client for the leader of a partition. Requests for topics
+// that don't exist, such as ones that will be created on their first publish,
+// go to any broker.
+func (c *Client) Leader(ctx context.Context, topic string, partition int32) (pb.PubSubClient, error) {
+	_, conn, err := c.leader(ctx, topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	return pb.NewPubSubClient(conn), nil
+}
+
+// leader returns the address of the leader of a partition and the connection
+// to it.
+func (c *Client) leader(ctx context.Context, topic string, partition int32) (string, *grpc.ClientConn, error) {
+	metadata, err := c.metadata(ctx, topic)
+	if err != nil {
+		return "", nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	address := c.fallback
+	if metadata != nil && partition >= 0 && int(partition) < len(metadata.Partitions) {
+		if leader, ok := c.brokers[metadata.Partitions[partition].Leader]; ok {
+			address = leader
+		}
+	}
+	conn, err := c.conn(address)
+	return address, conn, err
+}
+
+// call calls f with the leader of a partition, redialing the leader if it
+// couldn't be reached.
+func (c *Client) call(ctx context.Context, topic string, partition int32, f func(pb.PubSubClient) error) error {
+	address, conn, err := c.leader(ctx, topic, partition)
+	if err != nil {
+		return err
+	}
+	err = f(pb.NewPubSubClient(conn))
+	c.redial(address, conn, err)
+	return err
+}
+
+// retriable returns whether err means the request should be retried once the
+// metadata is refreshed. An Unavailable request may have been carried out
+// anyway, so it's only safe to retry if doing it twice is.
+func retriable(err error) bool {
+	return pb.IsNotLeader(err) || grpc.Code(err) == codes.Unavailable
+}
+
+// retry calls f until it succeeds or fails with an error that retriable says
+// isn't worth retrying, refreshing the metadata of topic in between.
+func (c *Client) retry(ctx context.Context, topic string, retriable func(error) bool, f func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err != nil && !retriable(err) && grpc.Code(err) == codes.Unavailable {
+			// Not worth retrying, but the next request should find out if
+			// the leader moved.
+			c.Refresh(ctx, topic)
+		}
+		if err == nil || !retriable(err) || attempt == retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryDelay):
+		}
+		// An error here is from every broker being unreachable, which the
+		// next attempt will find out about.
+		c.Refresh(ctx, topic)
+	}
+}
+
+// Publish sends the messages of a publish to the leader of its partition. If
+// the messages are routed by key and the topic's partitions have different
+// leaders, they're routed here and sent to each leader separately. Publishes
+// that may have been written are only retried if they have a producer id, so
+// the broker can tell a retry from a new publish.
+func (c *Client) Publish(ctx context.Context, request *pb.PublishMultiRequest) (*pb.PublishMultiReply, error) {
+	routed := c.route(ctx, request)
+	if routed == nil {
+		safe := pb.IsNotLeader
+		if request.ProducerId != 0 {
+			safe = retriable
+		}
+		var reply *pb.PublishMultiReply
+		err := c.retry(ctx, request.Topic, safe, func() error {
+			return c.call(ctx, request.Topic, request.Partition, func(leader pb.PubSubClient) (err error) {
+				reply, err = leader.PublishMulti(ctx, request)
+				return err
+			})
+		})
+		return reply, err
+	}
+	if request.ProducerId != 0 && len(routed) > 1 {
+		return nil, errors.New(fmt.Sprintf("Can't publish to partitions of %s with different leaders using a producer id", request.Topic))
+	}
+
+	var partitions []int
+	for partition := range routed {
+		partitions = append(partitions, int(partition))
+	}
+	sort.Ints(partitions)
+	reply := pb.PublishMultiReply{}
+	for _, partition := range partitions {
+		partitionRequest := *request
+		partitionRequest.Partition = int32(partition)
+		partitionRequest.Messages = routed[int32(partition)]
+		partitionReply, err := c.Publish(ctx, &partitionRequest)
+		if err != nil {
+			return nil, err
+		}
+		reply.Partitions = append(reply.Partitions, partitionReply.GetPartitions()...)
+	}
+	if len(reply.Partitions) == 1 {
+		reply.BaseOffset, reply.LastOffset = reply.Partitions[0].BaseOffset, reply.Partitions[0].LastOffset
+	}
+	return &reply, nil
+}
+
+// route splits the messages of a publish routed by key between partitions
+// the same way a broker would, or returns nil if the publish can be sent to
+// one broker as is.
+func (c *Client) route(ctx context.Context, request *pb.PublishMultiRequest) map[int32][]*pb.Message {
+	if request.Partition != pb.PartitionByKey {
+		return nil
+	}
+	metadata, err := c.metadata(ctx, request.Topic)
+	if err != nil || metadata == nil {
+		return nil
+	}
+	leaders := make(map[int32]bool)
+	for _, partition := range metadata.GetPartitions() {
+		leaders[partition.Leader] = true
+	}
+	if len(leaders) < 2 {
+		return nil
+	}
+
+	n := int32(len(metadata.Partitions))
+	unkeyed := int32(atomic.AddUint32(&c.unkeyed, 1) % uint32(n))
+	routed := make(map[int32][]*pb.Message)
+	for _, message := range request.Messages {
+		id := unkeyed
+		if len(message.Key) > 0 {
+			id = pb.PartitionForKey(message.Key, n)
+		}
+		routed[id] = append(routed[id], message)
+	}
+	return routed
+}
+
+// CommitOffset commits a consumer group's offset to the leader of the offsets
+// topic, which coordinates the group. Subscriptions with the group resume from
+// it.
+func (c *Client) CommitOffset(ctx context.Context, request *pb.CommitOffsetRequest) error {
+	return c.retry(ctx, pb.OffsetsTopic, retriable, func() error {
+		return c.call(ctx, pb.OffsetsTopic, 0, func(leader pb.PubSubClient) error {
+			_, err := leader.CommitOffset(ctx, request)
+			return err
+		})
+	})
+}
+
+// Subscription is a subscription to a partition that follows it from leader
+// to leader.
+type Subscription struct {
+	client  *Client
+	ctx     context.Context
+	request pb.SubscribeRequest
+	stream  pb.PubSub_SubscribeClient
+}
+
+// Subscribe subscribes to the leader of a partition.
+func (c *Client) Subscribe(ctx context.Context, request *pb.SubscribeRequest) (*Subscription, error) {
+	s := Subscription{client: c, ctx: ctx, request: *request}
+	if err := c.retry(ctx, request.Topic, retriable, s.subscribe); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *Subscription) subscribe() error {
+	return s.client.call(s.ctx, s.request.Topic, s.request.Partition, func(leader pb.PubSubClient) (err error) {
+		s.stream, err = leader.Subscribe(s.ctx, &s.request)
+		return err
+	})
+}
+
+// Recv returns the next response from the leader. If leadership moves, the
+// subscription is made again to the new leader from after the last message
+// returned.
+func (s *Subscription) Recv() (*pb.SubscribeResponse, error) {
+	var response *pb.SubscribeResponse
+	err := s.client.retry(s.ctx, s.request.Topic, retriable, func() error {
+		if s.stream == nil {
+			if err := s.subscribe(); err != nil {
+				return err
+			}
+		}
+		var err error
+		if response, err = s.stream.Recv(); err != nil {
+			s.stream = nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	next, received := s.request.Offset, false
+	for _, message := range response.GetMessages() {
+		next, received = message.Offset+1, true
+	}
+	for _, batch := range response.GetBatches() {
+		if batch.LastOffset+1 > next || !received {
+			next, received = batch.LastOffset+1, true
+		}
+	}
+	if received {
+		// Any resubscription continues from here rather than from where the
+		// group or start position first said.
+		s.request.Offset, s.request.Start, s.request.Group = next, pb.StartPosition_OFFSET, ""
+	}
+	return response, nil
+}
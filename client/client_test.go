@@ -0,0 +1,232 @@
+// Copyright (C) 2015 Daniel Harrison
+
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	pb "github.com/paperstreet/gopubsub/server"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// testBroker is a broker serving the others in its cluster over loopback.
+type testBroker struct {
+	*pb.Server
+	dir     string
+	address string
+	config  pb.ServerConfig
+	grpc    *grpc.Server
+	stopped bool
+}
+
+func (b *testBroker) serve(t *testing.T) {
+	s, err := pb.NewServer(b.dir, b.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", b.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Server, b.grpc, b.stopped = s, grpc.NewServer(), false
+	pb.RegisterPubSubServer(b.grpc, s)
+	go b.grpc.Serve(lis)
+}
+
+// kill stops the broker, keeping its data so it can be served again.
+func (b *testBroker) kill() {
+	if !b.stopped {
+		b.stopped = true
+		b.grpc.Stop()
+		b.Close()
+	}
+}
+
+// startCluster starts n brokers in one process.
+func startCluster(t *testing.T, n int, config pb.ServerConfig) []*testBroker {
+	config.Brokers = make(map[int32]string)
+	for i := 0; i < n; i++ {
+		// Find a free port for each broker before any of them start.
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Brokers[int32(i)] = lis.Addr().String()
+		lis.Close()
+	}
+	brokers := make([]*testBroker, n)
+	for i := range brokers {
+		dir, err := ioutil.TempDir("", "gopubsub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.BrokerID = int32(i)
+		brokers[i] = &testBroker{dir: dir, address: config.Brokers[int32(i)], config: config}
+		brokers[i].serve(t)
+	}
+	return brokers
+}
+
+// waitFor fails the test if cond doesn't become true within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRetriable(t *testing.T) {
+	tests := []struct {
+		err       error
+		notLeader bool
+		retriable bool
+	}{
+		{grpc.Errorf(codes.Aborted, "Not the leader of test/0, broker 1 is"), true, true},
+		{grpc.Errorf(codes.Unavailable, "Only 1 replicas of test/0 are in sync, 2 are needed"), false, true},
+		{grpc.Errorf(codes.FailedPrecondition, "Not the leader of test/0, broker 1 is"), false, false},
+		{grpc.Errorf(codes.FailedPrecondition, "Out of order sequence 5 from producer 1, expected 1"), false, false},
+		{grpc.Errorf(codes.FailedPrecondition, "Producer 1 has no transaction open"), false, false},
+	}
+	for _, test := range tests {
+		if notLeader := pb.IsNotLeader(test.err); notLeader != test.notLeader {
+			t.Errorf("%v: expected not leader %v got %v", test.err, test.notLeader, notLeader)
+		}
+		if retriable := retriable(test.err); retriable != test.retriable {
+			t.Errorf("%v: expected retriable %v got %v", test.err, test.retriable, retriable)
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	config := pb.DefaultServerConfig()
+	config.ReplicationFactor = 3
+	config.MinInsyncReplicas = 2
+	config.ReplicaLagTime = time.Second
+	config.BrokerTimeout = 600 * time.Millisecond
+	brokers := startCluster(t, 3, config)
+	defer func() {
+		for _, broker := range brokers {
+			broker.kill()
+			os.RemoveAll(broker.dir)
+		}
+	}()
+	ctx := context.Background()
+
+	if _, err := brokers[0].CreateTopic(ctx, &pb.CreateTopicRequest{Topic: "events", Partitions: 1}); err != nil {
+		t.Fatal(err)
+	}
+	var addresses []string
+	for _, broker := range brokers {
+		addresses = append(addresses, broker.address)
+	}
+	c, err := NewClient(ctx, addresses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// leader returns the leader of partition 0 of a topic as broker knows it.
+	leader := func(broker *testBroker, topic string) int32 {
+		reply, err := broker.DescribeTopic(ctx, &pb.DescribeTopicRequest{Topic: topic})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply.Partitions[0].Leader
+	}
+	// stale makes the client think broker 0 still leads the partition.
+	stale := func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.topics["events"].Partitions[0].Leader = 0
+	}
+	publish := func(producerID int64, sequence int32, value string) (*pb.PublishMultiReply, error) {
+		request := pb.PublishMultiRequest{
+			Topic:      "events",
+			Messages:   []*pb.Message{{Value: []byte(value)}},
+			Acks:       pb.Acks_ALL,
+			ProducerId: producerID,
+			Sequence:   sequence,
+		}
+		return c.Publish(ctx, &request)
+	}
+
+	if reply, err := publish(0, 0, "a"); err != nil || reply.BaseOffset != 0 {
+		t.Fatalf("got %v %v", reply, err)
+	}
+	brokers[0].kill()
+	waitFor(t, "a new leader", func() bool {
+		id := leader(brokers[1], "events")
+		return id != 0 && leader(brokers[2], "events") == id
+	})
+
+	// A publish without a producer id that can't reach the leader isn't
+	// retried, since it can't be told apart from a new one if it was written.
+	if _, err := publish(0, 0, "lost"); grpc.Code(err) != codes.Unavailable {
+		t.Errorf("expected Unavailable got %v", err)
+	}
+	// One with a producer id is, and the broker turns away a second copy.
+	producer, err := brokers[1].InitProducerId(ctx, &pb.InitProducerIdRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale()
+	for i := 0; i < 2; i++ {
+		if reply, err := publish(producer.ProducerId, 0, "b"); err != nil || reply.BaseOffset != 1 {
+			t.Fatalf("got %v %v", reply, err)
+		}
+	}
+	if _, err := publish(producer.ProducerId, 5, "c"); grpc.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected an out of order sequence to fail without retrying, got %v", err)
+	}
+
+	// Anything sent to a broker that isn't the leader wasn't written, so it's
+	// always retried.
+	brokers[0].serve(t)
+	waitFor(t, "broker 0 to follow", func() bool { return leader(brokers[0], "events") != 0 })
+	// A connection that failed while broker 0 was down is redialed rather
+	// than left backing off.
+	waitFor(t, "the client to reach broker 0", func() bool {
+		c.mu.Lock()
+		conn, err := c.conn(brokers[0].address)
+		c.mu.Unlock()
+		if err == nil {
+			_, err = pb.NewPubSubClient(conn).GetMetadata(ctx, &pb.GetMetadataRequest{})
+			c.redial(brokers[0].address, conn, err)
+		}
+		return err == nil
+	})
+	stale()
+	if reply, err := publish(0, 0, "d"); err != nil || reply.BaseOffset != 2 {
+		t.Fatalf("got %v %v", reply, err)
+	}
+	reply, err := brokers[leader(brokers[0], "events")].Fetch(ctx, &pb.FetchRequest{Topic: "events"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	for _, message := range reply.GetMessages() {
+		values = append(values, string(message.Value))
+	}
+	if fmt.Sprint(values) != "[a b d]" {
+		t.Errorf("got %v", values)
+	}
+
+	// Offsets go to the leader of the offsets topic, wherever it moved to.
+	if err := c.CommitOffset(ctx, &pb.CommitOffsetRequest{Group: "g", Topic: "events", Offset: 3}); err != nil {
+		t.Fatal(err)
+	}
+	offsets := brokers[leader(brokers[0], pb.OffsetsTopic)]
+	committed, err := offsets.FetchCommittedOffset(ctx, &pb.FetchCommittedOffsetRequest{Group: "g", Topic: "events"})
+	if err != nil || committed.Offset != 3 {
+		t.Errorf("got %v %v", committed, err)
+	}
+}
@@ -23,21 +23,25 @@ type Reader struct {
 
 // TODO(dan): Use inotify instead of polling if available.
 func NewReader(ctx context.Context, file *os.File, ping <-chan int64) *Reader {
-	reader := Reader{ctx, file, bufio.NewReader(file), 0, 0, make(chan int64)}
+	reader := Reader{ctx, file, bufio.NewReader(file), 0, 0, make(chan int64, 1)}
 	go func() {
+		// The size last notified is kept here rather than read from
+		// reader.Size, which belongs to the reading goroutine. A pending
+		// notification is as good as a new one, so never block on it.
+		var size int64
 		for {
 			select {
 			case <-ctx.Done():
 				return
 			case <-ping:
-				fi, err := file.Stat()
-				if err == nil && fi.Size() != reader.Size {
-					reader.Notify <- fi.Size()
-				}
 			case <-time.After(250 * time.Millisecond):
-				fi, err := file.Stat()
-				if err == nil && fi.Size() != reader.Size {
-					reader.Notify <- fi.Size()
+			}
+			fi, err := file.Stat()
+			if err == nil && fi.Size() != size {
+				size = fi.Size()
+				select {
+				case reader.Notify <- size:
+				default:
 				}
 			}
 		}
@@ -51,6 +55,29 @@ func (r *Reader) Read(buf []byte) (n int, err error) {
 	return
 }
 
+// Seek moves the reader to a new position in the file, discarding anything
+// buffered.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	n, err := r.f.Seek(offset, whence)
+	if err != nil {
+		return n, err
+	}
+	r.r.Reset(r.f)
+	r.Offset = n
+	return n, nil
+}
+
+// Available returns the number of bytes currently in the file after the
+// reader's position.
+func (r *Reader) Available() (int64, error) {
+	fi, err := r.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	r.Size = fi.Size()
+	return r.Size - r.Offset, nil
+}
+
 func (r *Reader) WaitBytes(size int64) error {
 	for {
 		if fi, err := r.f.Stat(); err != nil {
@@ -3,18 +3,66 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"strconv"
+	"strings"
 
 	"github.com/paperstreet/gopubsub/server"
 	"google.golang.org/grpc"
 )
 
+// parseBrokers parses a comma separated list of id=address.
+func parseBrokers(list string) (map[int32]string, error) {
+	brokers := make(map[int32]string)
+	for _, broker := range strings.Split(list, ",") {
+		if broker == "" {
+			continue
+		}
+		idAddress := strings.SplitN(broker, "=", 2)
+		if len(idAddress) != 2 {
+			return nil, errors.New(fmt.Sprintf("Expected id=address: %s", broker))
+		}
+		id, err := strconv.Atoi(idAddress[0])
+		if err != nil {
+			return nil, err
+		}
+		brokers[int32(id)] = idAddress[1]
+	}
+	return brokers, nil
+}
+
 func main() {
 	var port = flag.Int("port", 8054, "")
 	var path = flag.String("path", "/tmp/gopubsub", "")
+	var partitions = flag.Int("partitions", int(server.DefaultServerConfig().Partitions), "Number of partitions for topics created without one given")
+	var subscribeMaxBytes = flag.Int64("subscribe_max_bytes", server.DefaultServerConfig().SubscribeMaxBytes, "Most bytes sent in each subscribe response")
+	var subscribeMaxMessages = flag.Int64("subscribe_max_messages", server.DefaultServerConfig().SubscribeMaxMessages, "Most messages sent in each subscribe response")
+	var sessionTimeout = flag.Duration("session_timeout", server.DefaultServerConfig().SessionTimeout, "How long consumer group members can go without a heartbeat by default")
+	var brokerID = flag.Int("broker_id", int(server.DefaultServerConfig().BrokerID), "Id of this broker in brokers")
+	var brokers = flag.String("brokers", "", "Comma separated id=host:port of every broker in the cluster, including this one")
+	var replicationFactor = flag.Int("replication_factor", int(server.DefaultServerConfig().ReplicationFactor), "Number of brokers storing each partition of new topics")
+	var minInsyncReplicas = flag.Int("min_insync_replicas", int(server.DefaultServerConfig().MinInsyncReplicas), "Replicas a message must reach before it can be read")
+	var replicaLagTime = flag.Duration("replica_lag_time", server.DefaultServerConfig().ReplicaLagTime, "How long a follower can be behind before it is dropped from the in-sync replicas")
+	var brokerTimeout = flag.Duration("broker_timeout", server.DefaultServerConfig().BrokerTimeout, "How long a broker can go without a heartbeat before its partitions get new leaders")
+	var reassignmentThrottle = flag.Int64("reassignment_throttle", server.DefaultServerConfig().ReassignmentThrottle, "Bytes per second sent to replicas catching up with a partition, 0 to disable")
+	var transactionTimeout = flag.Duration("transaction_timeout", server.DefaultServerConfig().TransactionTimeout, "How long a transaction can be left open before it is aborted")
+	var autoCreateTopics = flag.Bool("auto_create_topics", server.DefaultServerConfig().AutoCreateTopics, "Create topics on their first publish instead of requiring CreateTopic")
+	var segmentBytes = flag.Int64("segment_bytes", server.DefaultTopicConfig().SegmentBytes, "Size at which a topic's message set is rolled, at most 4 GiB")
+	var segmentAge = flag.Duration("segment_age", server.DefaultTopicConfig().SegmentAge, "Age at which a topic's message set is rolled, 0 to disable")
+	var retentionAge = flag.Duration("retention_age", server.DefaultTopicConfig().RetentionAge, "Age after which a topic's sealed message sets are deleted, 0 to disable")
+	var retentionBytes = flag.Int64("retention_bytes", server.DefaultTopicConfig().RetentionBytes, "Size past which a topic's oldest message sets are deleted, 0 to disable")
+	var cleanupPolicy = flag.String("cleanup_policy", server.DefaultTopicConfig().CleanupPolicy, "Either delete to enforce retention or compact to keep the latest message per key")
+	var tombstoneRetention = flag.Duration("tombstone_retention", server.DefaultTopicConfig().TombstoneRetention, "How long compacted topics keep messages with an empty value")
+	var compression = flag.String("compression", server.DefaultTopicConfig().Compression, "Compression for published batches: producer, none, gzip, snappy or zstd")
+	var syncMessages = flag.Int64("sync_messages", server.DefaultTopicConfig().SyncMessages, "Messages published to a topic between fsyncs, 1 to fsync every batch, 0 to disable")
+	var syncInterval = flag.Duration("sync_interval", server.DefaultTopicConfig().SyncInterval, "How often topics are fsynced in the background, 0 to disable")
+	var maxMessageBytes = flag.Int64("max_message_bytes", server.DefaultTopicConfig().MaxMessageBytes, "Largest key, value and headers accepted in a published message, 0 to disable")
+	var timestampType = flag.String("message_timestamp_type", server.DefaultTopicConfig().TimestampType, "CreateTime to keep producer timestamps or LogAppendTime")
+	var indexIntervalBytes = flag.Int64("index_interval_bytes", server.DefaultTopicConfig().IndexIntervalBytes, "Bytes of records between offset index entries")
 
 	flag.Parse()
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
@@ -24,7 +72,35 @@ func main() {
 	log.Print("Listening on port ", *port)
 	s := grpc.NewServer()
 
-	impl, err := server.NewServer(*path)
+	config := server.DefaultServerConfig()
+	config.AutoCreateTopics = *autoCreateTopics
+	config.Partitions = int32(*partitions)
+	config.SessionTimeout = *sessionTimeout
+	config.SubscribeMaxBytes = *subscribeMaxBytes
+	config.SubscribeMaxMessages = *subscribeMaxMessages
+	config.BrokerID = int32(*brokerID)
+	if config.Brokers, err = parseBrokers(*brokers); err != nil {
+		log.Fatalf("Failed to parse brokers: %v", err)
+	}
+	config.ReplicationFactor = int32(*replicationFactor)
+	config.MinInsyncReplicas = int32(*minInsyncReplicas)
+	config.ReplicaLagTime = *replicaLagTime
+	config.BrokerTimeout = *brokerTimeout
+	config.ReassignmentThrottle = *reassignmentThrottle
+	config.TransactionTimeout = *transactionTimeout
+	config.Topic.SegmentBytes = *segmentBytes
+	config.Topic.SegmentAge = *segmentAge
+	config.Topic.IndexIntervalBytes = *indexIntervalBytes
+	config.Topic.RetentionAge = *retentionAge
+	config.Topic.RetentionBytes = *retentionBytes
+	config.Topic.CleanupPolicy = *cleanupPolicy
+	config.Topic.TombstoneRetention = *tombstoneRetention
+	config.Topic.Compression = *compression
+	config.Topic.SyncMessages = *syncMessages
+	config.Topic.SyncInterval = *syncInterval
+	config.Topic.MaxMessageBytes = *maxMessageBytes
+	config.Topic.TimestampType = *timestampType
+	impl, err := server.NewServer(*path, config)
 	if err != nil {
 		log.Fatalf("Failed to configure: %v", err)
 	}
@@ -8,51 +8,67 @@ import (
 	"log"
 	"math/rand"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/paperstreet/gopubsub/client"
 	pb "github.com/paperstreet/gopubsub/server"
 	"golang.org/x/net/context"
-	"google.golang.org/grpc"
 )
 
-func SendTest(c *pb.PubSubClient, topic string, size int, wg *sync.WaitGroup) {
-	var request = pb.PublishMultiRequest{Topic: topic}
+func SendTest(c *client.Client, topic string, partition int32, size int, compression pb.Compression, acks pb.Acks, wg *sync.WaitGroup) {
+	var request = pb.PublishMultiRequest{Topic: topic, Partition: partition, Compression: compression, Acks: acks}
 	for i := 0; i < size; i++ {
-		if key, err := time.Now().MarshalText(); err == nil {
-			var message = pb.Message{Key: key, Value: []byte(fmt.Sprintf("value-%d", i))}
-			request.Messages = append(request.Messages, &message)
+		var message = pb.Message{
+			Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+			Headers:   []*pb.Header{{Key: "content-type", Value: []byte("text/plain")}},
+			Key:       []byte(fmt.Sprintf("key-%d", i)),
+			Value:     []byte(fmt.Sprintf("value-%d", i)),
 		}
+		request.Messages = append(request.Messages, &message)
 	}
 
 	var t = rand.Intn(100)
 	time.Sleep(time.Duration(t) * time.Millisecond)
-	_, err := (*c).PublishMulti(context.Background(), &request)
+	reply, err := c.Publish(context.Background(), &request)
 	if err != nil {
 		log.Fatalf("Could not send: %v", err)
 	}
-	log.Print("[", topic, "] Wrote ", size, " messages")
+	for _, offsets := range reply.GetPartitions() {
+		log.Print("[", topic, "/", offsets.Partition, "] Wrote messages at offsets ", offsets.BaseOffset, "-", offsets.LastOffset)
+	}
 	wg.Done()
 }
 
 func main() {
-	var address = flag.String("address", "localhost:8054", "")
+	var address = flag.String("address", "localhost:8054", "Comma separated addresses of brokers to find the rest of the cluster from")
 	var size = flag.Int("size", 3, "")
 	var topics = flag.Int("topics", 3, "")
+	var compression = flag.String("compression", "none", "none, gzip, snappy or zstd")
+	var partition = flag.Int("partition", 0, "Partition to publish to, -1 to route by key")
+	var acks = flag.String("acks", "leader", "none, leader or all")
 
 	flag.Parse()
+	codec, ok := pb.Compression_value[strings.ToUpper(*compression)]
+	if !ok {
+		log.Fatalf("Unknown compression: %s", *compression)
+	}
+	ackLevel, ok := pb.Acks_value[strings.ToUpper(*acks)]
+	if !ok {
+		log.Fatalf("Unknown acks: %s", *acks)
+	}
 
-	conn, err := grpc.Dial(*address)
+	c, err := client.NewClient(context.Background(), strings.Split(*address, ","))
 	if err != nil {
 		log.Fatalf("Did not connect: %v", err)
 	}
-	defer conn.Close()
-	c := pb.NewPubSubClient(conn)
+	defer c.Close()
 
 	var wg sync.WaitGroup
 	for i := 0; i < *topics; i++ {
 		wg.Add(1)
-		go SendTest(&c, strconv.Itoa(i), *size, &wg)
+		go SendTest(c, strconv.Itoa(i), int32(*partition), *size, pb.Compression(codec), pb.Acks(ackLevel), &wg)
 	}
 	wg.Wait()
 }
@@ -0,0 +1,226 @@
+// Copyright (C) 2015 Daniel Harrison
+
+package server
+
+import (
+	"sort"
+)
+
+// Assignment is the partitions of each topic assigned to a group member.
+type Assignment map[string][]int32
+
+// AssignorMember is a group member as seen by an Assignor.
+type AssignorMember struct {
+	ID     string
+	Topics []string
+}
+
+// Assignor divides the partitions of the topics subscribed to by a consumer
+// group between its members.
+type Assignor interface {
+	Name() string
+	// Assign returns the assignment of each member by id. members is sorted
+	// by id, partitions holds the number of partitions of each subscribed
+	// topic and previous is the assignment from the last generation.
+	Assign(members []AssignorMember, partitions map[string]int32, previous map[string]Assignment) map[string]Assignment
+}
+
+var assignors = make(map[string]Assignor)
+
+// RegisterAssignor makes an Assignor available to consumer groups by name.
+func RegisterAssignor(assignor Assignor) {
+	assignors[assignor.Name()] = assignor
+}
+
+func init() {
+	RegisterAssignor(rangeAssignor{})
+	RegisterAssignor(roundRobinAssignor{})
+	RegisterAssignor(stickyAssignor{})
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// subscribers returns the members subscribed to each topic, in member order.
+func subscribers(members []AssignorMember) map[string][]string {
+	byTopic := make(map[string][]string)
+	for _, member := range members {
+		for _, topic := range member.Topics {
+			byTopic[topic] = append(byTopic[topic], member.ID)
+		}
+	}
+	return byTopic
+}
+
+// sortedTopicPartitions returns every partition of every topic in order.
+func sortedTopicPartitions(partitions map[string]int32) []topicPartition {
+	topics := make([]string, 0, len(partitions))
+	for topic := range partitions {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	var all []topicPartition
+	for _, topic := range topics {
+		for partition := int32(0); partition < partitions[topic]; partition++ {
+			all = append(all, topicPartition{topic, partition})
+		}
+	}
+	return all
+}
+
+func emptyAssignments(members []AssignorMember) map[string]Assignment {
+	assignments := make(map[string]Assignment)
+	for _, member := range members {
+		assignments[member.ID] = make(Assignment)
+	}
+	return assignments
+}
+
+// rangeAssignor gives each member of a topic a contiguous range of its
+// partitions, with the first members getting one extra if they don't divide
+// evenly.
+type rangeAssignor struct{}
+
+func (rangeAssignor) Name() string { return "range" }
+
+func (rangeAssignor) Assign(members []AssignorMember, partitions map[string]int32, previous map[string]Assignment) map[string]Assignment {
+	assignments := emptyAssignments(members)
+	for topic, ids := range subscribers(members) {
+		n := partitions[topic]
+		per, extra := n/int32(len(ids)), n%int32(len(ids))
+		begin := int32(0)
+		for i, id := range ids {
+			end := begin + per
+			if int32(i) < extra {
+				end++
+			}
+			for partition := begin; partition < end; partition++ {
+				assignments[id][topic] = append(assignments[id][topic], partition)
+			}
+			begin = end
+		}
+	}
+	return assignments
+}
+
+// roundRobinAssignor deals every partition of every topic out in turn to the
+// members subscribed to it.
+type roundRobinAssignor struct{}
+
+func (roundRobinAssignor) Name() string { return "roundrobin" }
+
+func (roundRobinAssignor) Assign(members []AssignorMember, partitions map[string]int32, previous map[string]Assignment) map[string]Assignment {
+	assignments := emptyAssignments(members)
+	byTopic := subscribers(members)
+	next := 0
+	for _, tp := range sortedTopicPartitions(partitions) {
+		if len(byTopic[tp.topic]) == 0 {
+			continue
+		}
+		// Skip ahead to the next member subscribed to the topic.
+		for !subscribes(members[next%len(members)], tp.topic) {
+			next++
+		}
+		id := members[next%len(members)].ID
+		assignments[id][tp.topic] = append(assignments[id][tp.topic], tp.partition)
+		next++
+	}
+	return assignments
+}
+
+func subscribes(member AssignorMember, topic string) bool {
+	for _, t := range member.Topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// stickyAssignor keeps members on the partitions they had in the last
+// generation as far as it can while keeping the number of partitions each
+// member has within one of every other member subscribed to the same topics.
+type stickyAssignor struct{}
+
+func (stickyAssignor) Name() string { return "sticky" }
+
+func (stickyAssignor) Assign(members []AssignorMember, partitions map[string]int32, previous map[string]Assignment) map[string]Assignment {
+	owner := make(map[topicPartition]string)
+	counts := make(map[string]int)
+	byID := make(map[string]AssignorMember)
+	for _, member := range members {
+		byID[member.ID] = member
+		counts[member.ID] = 0
+	}
+
+	// Keep whatever previous partitions are still valid.
+	for _, member := range members {
+		for topic, ps := range previous[member.ID] {
+			if !subscribes(member, topic) {
+				continue
+			}
+			for _, partition := range ps {
+				tp := topicPartition{topic, partition}
+				if _, taken := owner[tp]; taken || partition >= partitions[topic] {
+					continue
+				}
+				owner[tp] = member.ID
+				counts[member.ID]++
+			}
+		}
+	}
+
+	// fewest returns the subscribed member with the fewest partitions.
+	fewest := func(topic string, except string) string {
+		best := ""
+		for _, member := range members {
+			if member.ID == except || !subscribes(member, topic) {
+				continue
+			}
+			if best == "" || counts[member.ID] < counts[best] {
+				best = member.ID
+			}
+		}
+		return best
+	}
+
+	all := sortedTopicPartitions(partitions)
+	for _, tp := range all {
+		if _, ok := owner[tp]; ok {
+			continue
+		}
+		if id := fewest(tp.topic, ""); id != "" {
+			owner[tp] = id
+			counts[id]++
+		}
+	}
+
+	// Move partitions off the most loaded members until no move would make
+	// things more even.
+	for moved := true; moved; {
+		moved = false
+		for _, tp := range all {
+			from, ok := owner[tp]
+			if !ok {
+				continue
+			}
+			to := fewest(tp.topic, from)
+			if to != "" && counts[from]-counts[to] > 1 {
+				owner[tp] = to
+				counts[from]--
+				counts[to]++
+				moved = true
+			}
+		}
+	}
+
+	assignments := emptyAssignments(members)
+	for _, tp := range all {
+		if id, ok := owner[tp]; ok {
+			assignments[id][tp.topic] = append(assignments[id][tp.topic], tp.partition)
+		}
+	}
+	return assignments
+}
@@ -0,0 +1,55 @@
+// Copyright (C) 2015 Daniel Harrison
+
+package server
+
+import (
+	"testing"
+)
+
+func TestAssignors(t *testing.T) {
+	members := []AssignorMember{
+		{ID: "a", Topics: []string{"x", "y"}},
+		{ID: "b", Topics: []string{"x"}},
+		{ID: "c", Topics: []string{"x", "y"}},
+	}
+	partitions := map[string]int32{"x": 5, "y": 2}
+
+	for _, name := range []string{"range", "roundrobin", "sticky"} {
+		assignments := assignors[name].Assign(members, partitions, nil)
+		owners := make(map[topicPartition]string)
+		for id, assignment := range assignments {
+			for topic, ps := range assignment {
+				for _, partition := range ps {
+					tp := topicPartition{topic, partition}
+					if owner, ok := owners[tp]; ok {
+						t.Errorf("%s: %v assigned to both %s and %s", name, tp, owner, id)
+					}
+					if topic == "y" && id == "b" {
+						t.Errorf("%s: %v assigned to unsubscribed member b", name, tp)
+					}
+					owners[tp] = id
+				}
+			}
+		}
+		if len(owners) != 7 {
+			t.Errorf("%s: expected 7 partitions assigned got %d", name, len(owners))
+		}
+	}
+
+	// Sticky keeps partitions where they were when a member leaves.
+	previous := assignors["sticky"].Assign(members, partitions, nil)
+	next := assignors["sticky"].Assign(members[:2], partitions, previous)
+	kept := make(map[topicPartition]bool)
+	for topic, ps := range next["a"] {
+		for _, partition := range ps {
+			kept[topicPartition{topic, partition}] = true
+		}
+	}
+	for topic, ps := range previous["a"] {
+		for _, partition := range ps {
+			if !kept[topicPartition{topic, partition}] {
+				t.Errorf("expected a to keep %s/%d got %v", topic, partition, next["a"])
+			}
+		}
+	}
+}
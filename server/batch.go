@@ -0,0 +1,143 @@
+// Copyright (C) 2015 Daniel Harrison
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// The zstd encoder and decoder are expensive to create but safe to share when
+// used with EncodeAll and DecodeAll.
+var zstdEncoder, _ = zstd.NewWriter(nil)
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+// NewRecordBatch encodes messages, which must already have their offsets
+// assigned, into a batch compressed with compression.
+func NewRecordBatch(messages []*Message, compression Compression) (*RecordBatch, error) {
+	if len(messages) == 0 {
+		return nil, errors.New("Cannot create an empty record batch")
+	}
+	var buf bytes.Buffer
+	lengthBuf := make([]byte, 4)
+	var maxTimestamp int64
+	for _, message := range messages {
+		if message.Timestamp > maxTimestamp {
+			maxTimestamp = message.Timestamp
+		}
+		encoded, err := proto.Marshal(message)
+		if err != nil {
+			return nil, err
+		}
+		binary.LittleEndian.PutUint32(lengthBuf, uint32(len(encoded)))
+		buf.Write(lengthBuf)
+		buf.Write(encoded)
+	}
+
+	records, err := compress(compression, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return &RecordBatch{
+		Compression:  compression,
+		BaseOffset:   messages[0].Offset,
+		LastOffset:   messages[len(messages)-1].Offset,
+		Records:      records,
+		MaxTimestamp: maxTimestamp,
+	}, nil
+}
+
+// DecodeRecordBatch decompresses and decodes the messages in batch.
+func DecodeRecordBatch(batch *RecordBatch) ([]*Message, error) {
+	buf, err := decompress(batch.Compression, batch.Records)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []*Message
+	for len(buf) > 0 {
+		if len(buf) < 4 {
+			return nil, errors.New(fmt.Sprintf("Truncated record batch at offset %d", batch.BaseOffset))
+		}
+		length := binary.LittleEndian.Uint32(buf)
+		buf = buf[4:]
+		if uint32(len(buf)) < length {
+			return nil, errors.New(fmt.Sprintf("Truncated record batch at offset %d", batch.BaseOffset))
+		}
+		message := new(Message)
+		if err := proto.Unmarshal(buf[:length], message); err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+		buf = buf[length:]
+	}
+	return messages, nil
+}
+
+// trimRecordBatch returns an uncompressed batch of the messages in batch at or
+// after offset, from the same producer.
+func trimRecordBatch(batch *RecordBatch, offset uint64) (*RecordBatch, error) {
+	messages, err := DecodeRecordBatch(batch)
+	if err != nil {
+		return nil, err
+	}
+	for len(messages) > 0 && messages[0].Offset < offset {
+		messages = messages[1:]
+	}
+	trimmed, err := NewRecordBatch(messages, Compression_NONE)
+	if err != nil {
+		return nil, err
+	}
+	trimmed.ProducerId, trimmed.Sequence = batch.ProducerId, batch.Sequence
+	trimmed.Transactional, trimmed.Control = batch.Transactional, batch.Control
+	return trimmed, nil
+}
+
+func compress(compression Compression, data []byte) ([]byte, error) {
+	switch compression {
+	case Compression_NONE:
+		return data, nil
+	case Compression_GZIP:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Compression_SNAPPY:
+		return snappy.Encode(nil, data), nil
+	case Compression_ZSTD:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unsupported compression: %s", compression))
+}
+
+func decompress(compression Compression, data []byte) ([]byte, error) {
+	switch compression {
+	case Compression_NONE:
+		return data, nil
+	case Compression_GZIP:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case Compression_SNAPPY:
+		return snappy.Decode(nil, data)
+	case Compression_ZSTD:
+		return zstdDecoder.DecodeAll(data, nil)
+	}
+	return nil, errors.New(fmt.Sprintf("Unsupported compression: %s", compression))
+}
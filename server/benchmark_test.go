@@ -10,28 +10,31 @@ import (
 	"testing"
 
 	"github.com/dustin/randbo"
+	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
 )
 
 const (
 	ValueSize = 1024 * 4
 )
 
-func makeServer(b *testing.B) *Server {
+func makeServer(tb testing.TB, config ServerConfig) *Server {
 	dir, err := ioutil.TempDir("", "gopubsub")
 	if err != nil {
-		b.Fatal(err)
+		tb.Fatal(err)
 	}
 
-	s, err := NewServer(dir)
+	s, err := NewServer(dir, config)
 	if err != nil {
-		b.Fatal(err)
+		tb.Fatal(err)
 	}
 
 	return s
 }
 
 func tidyServer(s *Server) {
+	s.Close()
 	os.RemoveAll(s.dir)
 }
 
@@ -43,14 +46,14 @@ func genMessages(b *testing.B, s *Server) []*Message {
 	}
 	messages := make([]*Message, b.N)
 	for i := 0; i < b.N; i++ {
-		messages[i] = &Message{0, 0, []byte(strconv.Itoa(i)), v}
+		messages[i] = &Message{Key: []byte(strconv.Itoa(i)), Value: v}
 		b.SetBytes(int64(len(messages[i].Key) + len(messages[i].Value)))
 	}
 	return messages
 }
 
 func BenchmarkPublishMulti(b *testing.B) {
-	s := makeServer(b)
+	s := makeServer(b, DefaultServerConfig())
 	defer func() {
 		b.StopTimer()
 		tidyServer(s)
@@ -59,12 +62,12 @@ func BenchmarkPublishMulti(b *testing.B) {
 	messages := genMessages(b, s)
 	b.ResetTimer()
 
-	s.PublishMulti(s.ctx, &PublishMultiRequest{"test", messages})
+	s.PublishMulti(s.ctx, &PublishMultiRequest{Topic: "test", Messages: messages})
 }
 
 func BenchmarkSubscribe(b *testing.B) {
 	ctx, cancel := context.WithCancel(context.Background())
-	s := makeServer(b)
+	s := makeServer(b, DefaultServerConfig())
 	defer func() {
 		b.StopTimer()
 		cancel()
@@ -72,17 +75,76 @@ func BenchmarkSubscribe(b *testing.B) {
 	}()
 
 	messages := genMessages(b, s)
-	s.PublishMulti(s.ctx, &PublishMultiRequest{"test", messages})
-	topic, _ := s.topics["test"]
-	topic.Flush()
+	s.PublishMulti(s.ctx, &PublishMultiRequest{Topic: "test", Messages: messages})
+	partition := s.topics["test"].partitions[0]
 	b.ResetTimer()
 
-	f, _ := os.Open(topic.messageSets[0].path)
-	mReader := NewMessageSetReader(ctx, f, topic.Listen(ctx))
+	tReader, err := NewPartitionReader(ctx, partition, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer tReader.Close()
 	for i := 0; i < b.N; i++ {
-		_, err := mReader.ReadMessage()
+		_, err := tReader.ReadMessage()
 		if err != nil {
 			b.Fatal(err)
 		}
 	}
 }
+
+// discardStream is a PubSub_SubscribeServer that marshals each response, as
+// gRPC would, and then throws it away.
+type discardStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	cancel   context.CancelFunc
+	messages int
+	want     int
+}
+
+func (s *discardStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *discardStream) Send(response *SubscribeResponse) error {
+	if _, err := proto.Marshal(response); err != nil {
+		return err
+	}
+	s.messages += len(response.Messages)
+	if s.messages >= s.want {
+		s.cancel()
+	}
+	return nil
+}
+
+func benchmarkSubscribeResponses(b *testing.B, maxMessages int64) {
+	s := makeServer(b, DefaultServerConfig())
+	defer func() {
+		b.StopTimer()
+		tidyServer(s)
+	}()
+
+	// Publish small messages one at a time so each is its own batch.
+	for i := 0; i < b.N; i++ {
+		message := &Message{Value: []byte(strconv.Itoa(i))}
+		if _, err := s.PublishMulti(s.ctx, &PublishMultiRequest{Topic: "test", Messages: []*Message{message}}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &discardStream{ctx: ctx, cancel: cancel, want: b.N}
+	b.ResetTimer()
+
+	s.Subscribe(&SubscribeRequest{Topic: "test", MaxMessages: maxMessages}, stream)
+	if stream.messages != b.N {
+		b.Fatalf("expected %d messages got %d", b.N, stream.messages)
+	}
+}
+
+func BenchmarkSubscribeUnbatched(b *testing.B) {
+	benchmarkSubscribeResponses(b, 1)
+}
+
+func BenchmarkSubscribeBatched(b *testing.B) {
+	benchmarkSubscribeResponses(b, 0)
+}
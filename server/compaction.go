@@ -0,0 +1,194 @@
+// Copyright (C) 2015 Daniel Harrison
+
+package server
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+// compact rewrites the partition's sealed message sets keeping only the latest
+// record for each key. Records with an empty value are tombstones; they delete
+// the earlier records for their key and are themselves dropped once the
+// message set holding them was last written more than TombstoneRetention ago.
+// Records without a key are always kept. Records of aborted transactions don't
+// replace earlier ones, and message sets holding records of transactions that
+// haven't been decided yet are left alone.
+func (p *Partition) compact(ctx context.Context, now time.Time) error {
+	p.mu.Lock()
+	if !p.stored() {
+		p.mu.Unlock()
+		return nil
+	}
+	stable := p.lastStableOffset()
+	var sealed []*MessageSet
+	for _, messageSet := range p.messageSets[:len(p.messageSets)-1] {
+		if messageSet.offsetEnd > stable {
+			break
+		}
+		sealed = append(sealed, messageSet)
+	}
+	p.mu.Unlock()
+
+	config := p.Config()
+	latest := make(map[string]uint64)
+	for _, messageSet := range sealed {
+		_, err := messageSet.scan(ctx, func(position int64, batch *RecordBatch) error {
+			if batch.Transactional && p.aborted(batch.ProducerId, batch.BaseOffset) {
+				return nil
+			}
+			messages, err := DecodeRecordBatch(batch)
+			if err != nil {
+				return err
+			}
+			for _, message := range messages {
+				if len(message.Key) > 0 {
+					latest[string(message.Key)] = message.Offset
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, messageSet := range sealed {
+		info, err := os.Stat(messageSet.path)
+		if err != nil {
+			return err
+		}
+		dropTombstones := now.Sub(info.ModTime()) > config.TombstoneRetention
+		compacted, err := messageSet.compact(ctx, latest, dropTombstones, config.IndexIntervalBytes)
+		if err != nil {
+			return err
+		}
+		if compacted == nil {
+			continue
+		}
+
+		p.mu.Lock()
+		for i := range p.messageSets {
+			if p.messageSets[i] == messageSet {
+				p.messageSets[i] = compacted
+			}
+		}
+		p.mu.Unlock()
+		log.Print("[", p.name, "] Compacted ", messageSet.path, " from ", messageSet.size, " to ", compacted.size, " bytes")
+	}
+	return nil
+}
+
+// compact writes the messages of the message set that are the latest for their
+// key according to latest to a new file and swaps it into place, returning the
+// new message set. Offsets and each batch's compression are preserved. It
+// returns nil if no messages would be removed.
+//
+// Readers that already have the old file open keep reading it, so the message
+// set is replaced rather than modified.
+func (ms *MessageSet) compact(ctx context.Context, latest map[string]uint64, dropTombstones bool, indexInterval int64) (*MessageSet, error) {
+	info, err := os.Stat(ms.path)
+	if err != nil {
+		return nil, err
+	}
+
+	cleanedPath := strings.TrimSuffix(ms.path, ".pubsub") + ".cleaned"
+	f, err := os.OpenFile(cleanedPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0770)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(cleanedPath)
+	defer f.Close()
+	index, err := NewIndex(cleanedPath + ".index")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(index.path)
+	defer index.Close()
+
+	compacted := MessageSet{path: ms.path, offsetBegin: ms.offsetBegin, offsetEnd: ms.offsetEnd, created: ms.created, index: index}
+	writer := bufio.NewWriter(f)
+	dropped := 0
+	_, err = ms.scan(ctx, func(position int64, batch *RecordBatch) error {
+		messages, err := DecodeRecordBatch(batch)
+		if err != nil {
+			return err
+		}
+		var kept []*Message
+		for _, message := range messages {
+			if len(message.Key) > 0 {
+				if latest[string(message.Key)] != message.Offset || (len(message.Value) == 0 && dropTombstones) {
+					dropped++
+					continue
+				}
+			}
+			kept = append(kept, message)
+		}
+		if len(kept) == 0 {
+			return nil
+		}
+		if len(kept) < len(messages) {
+			original := batch
+			if batch, err = NewRecordBatch(kept, batch.Compression); err != nil {
+				return err
+			}
+			batch.ProducerId, batch.Sequence = original.ProducerId, original.Sequence
+			batch.Transactional, batch.Control = original.Transactional, original.Control
+		}
+		payload, err := proto.Marshal(batch)
+		if err != nil {
+			return err
+		}
+
+		indexed := indexInterval > 0 && compacted.size-index.lastPosition() >= indexInterval
+		if indexed {
+			if err := index.Append(batch.BaseOffset-ms.offsetBegin, compacted.size); err != nil {
+				return err
+			}
+		}
+		compacted.timeIndex.Add(uint32(batch.BaseOffset-ms.offsetBegin), batch, indexed)
+		n, err := writeRecord(writer, payload)
+		compacted.size += int64(n)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if dropped == 0 {
+		return nil, nil
+	}
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	if err := index.Close(); err != nil {
+		return nil, err
+	}
+	// Keep the modification time so retention and tombstone expiry see when
+	// the records were written rather than when they were compacted.
+	if err := os.Chtimes(cleanedPath, info.ModTime(), info.ModTime()); err != nil {
+		return nil, err
+	}
+
+	// If we crash between these, the index is missing and gets rebuilt from
+	// the log on startup rather than pointing into the wrong file.
+	if err := os.Remove(indexPath(ms.path)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := os.Rename(cleanedPath, ms.path); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(index.path, indexPath(ms.path)); err != nil {
+		return nil, err
+	}
+	index.path = indexPath(ms.path)
+	return &compacted, nil
+}
@@ -0,0 +1,318 @@
+// Copyright (C) 2015 Daniel Harrison
+
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// CleanupDelete deletes a topic's old message sets according to its
+	// retention settings.
+	CleanupDelete = "delete"
+	// CleanupCompact keeps only the latest message for each key in a topic.
+	CleanupCompact = "compact"
+
+	// CompressionProducer stores batches with the compression chosen by the
+	// producer. Any other Compression is either none or the lower case name
+	// of a Compression.
+	CompressionProducer = "producer"
+
+	// TimestampCreateTime keeps the timestamp set by the producer, only
+	// setting one if it was left zero. TimestampLogAppendTime always uses the
+	// time the broker appended the message.
+	TimestampCreateTime    = "CreateTime"
+	TimestampLogAppendTime = "LogAppendTime"
+
+	// topicConfigFile is the name of the file in a topic's directory holding
+	// the settings it overrides, one key=value per line.
+	topicConfigFile = "config"
+)
+
+// TopicConfig holds the settings that control how a topic's log is stored.
+type TopicConfig struct {
+	// SegmentBytes is the size after which the active message set is rolled
+	// over to a new one. It can't be more than 4 GiB, the most a message
+	// set's index can address.
+	SegmentBytes int64
+	// SegmentAge is how long a message set is appended to before it is rolled
+	// over to a new one. Zero disables time based rolling.
+	SegmentAge time.Duration
+	// IndexIntervalBytes is the number of bytes of records between entries in
+	// a message set's offset index.
+	IndexIntervalBytes int64
+	// RetentionAge is how long after it was last written to a sealed message
+	// set is deleted. Zero disables time based retention.
+	RetentionAge time.Duration
+	// RetentionBytes is the size past which a topic's oldest sealed message
+	// sets are deleted. Zero disables size based retention.
+	RetentionBytes int64
+	// CleanupPolicy is either CleanupDelete or CleanupCompact.
+	CleanupPolicy string
+	// TombstoneRetention is how long a compacted topic keeps messages with an
+	// empty value after they have deleted their key.
+	TombstoneRetention time.Duration
+	// Compression is CompressionProducer or the compression to use for every
+	// batch published to the topic.
+	Compression string
+	// SyncMessages is how many messages may be published to the topic before
+	// it is fsynced. Publishes wait for the fsync they trigger, so 1 fsyncs
+	// every batch before replying. Zero disables message count based syncs.
+	SyncMessages int64
+	// SyncInterval is how often the topic is fsynced in the background. Zero
+	// disables periodic syncs. With both disabled, data is only fsynced when
+	// a message set is rolled.
+	SyncInterval time.Duration
+	// MaxMessageBytes is the largest key, value and headers accepted for a
+	// message published to the topic. Zero disables the limit.
+	MaxMessageBytes int64
+	// TimestampType is TimestampCreateTime or TimestampLogAppendTime.
+	TimestampType string
+}
+
+// ServerConfig holds the settings for a broker.
+type ServerConfig struct {
+	// AutoCreateTopics creates a topic with the default config the first time
+	// it is published to. Otherwise topics must be created with CreateTopic.
+	AutoCreateTopics bool
+	// Partitions is the number of partitions for topics created without one
+	// given.
+	Partitions int32
+	// SessionTimeout is how long a consumer group member that didn't ask for
+	// a session timeout can go without a heartbeat before it is removed.
+	SessionTimeout time.Duration
+	// SubscribeMaxBytes and SubscribeMaxMessages limit how much is coalesced
+	// into each SubscribeResponse. Subscribers can ask for less.
+	SubscribeMaxBytes    int64
+	SubscribeMaxMessages int64
+	// BrokerID identifies this broker in Brokers.
+	BrokerID int32
+	// Brokers maps the id of every broker in the cluster, this one included,
+	// to its address. Without any, the broker stores every partition itself.
+	Brokers map[int32]string
+	// ReplicationFactor is how many brokers store each partition of a new
+	// topic, capped at the number of brokers.
+	ReplicationFactor int32
+	// MinInsyncReplicas is how many replicas, the leader included, a message
+	// must be written to before it can be read or acknowledged to an Acks_ALL
+	// publish, capped at the partition's replication factor.
+	MinInsyncReplicas int32
+	// ReplicaLagTime is how long a follower can go without catching up to
+	// the leader before it is dropped from the in-sync replicas.
+	ReplicaLagTime time.Duration
+	// BrokerTimeout is how long a broker can go without a heartbeat before
+	// the controller elects new leaders for the partitions it leads. It's
+	// also how long the controller's lease lasts.
+	BrokerTimeout time.Duration
+	// ReassignmentThrottle limits the bytes per second that partition leaders
+	// send to replicas catching up outside the in-sync replicas, such as ones
+	// added by a reassignment. Zero disables it.
+	ReassignmentThrottle int64
+	// TransactionTimeout is how long a transaction can be left open before
+	// the coordinator aborts it.
+	TransactionTimeout time.Duration
+	// Topic is the default config for new topics.
+	Topic TopicConfig
+}
+
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		AutoCreateTopics:     true,
+		Partitions:           1,
+		SessionTimeout:       10 * time.Second,
+		SubscribeMaxBytes:    1024 * 1024,
+		SubscribeMaxMessages: 1000,
+		ReplicationFactor:    1,
+		MinInsyncReplicas:    1,
+		ReplicaLagTime:       10 * time.Second,
+		BrokerTimeout:        6 * time.Second,
+		TransactionTimeout:   time.Minute,
+		Topic:                DefaultTopicConfig(),
+	}
+}
+
+func DefaultTopicConfig() TopicConfig {
+	return TopicConfig{
+		SegmentBytes:       1024 * 1024 * 1024,
+		SegmentAge:         7 * 24 * time.Hour,
+		IndexIntervalBytes: 4096,
+		RetentionAge:       7 * 24 * time.Hour,
+		CleanupPolicy:      CleanupDelete,
+		TombstoneRetention: 24 * time.Hour,
+		Compression:        CompressionProducer,
+		MaxMessageBytes:    1024 * 1024,
+		TimestampType:      TimestampCreateTime,
+	}
+}
+
+func (c TopicConfig) validate() error {
+	if c.SegmentBytes <= 0 || c.SegmentBytes > maxSegmentBytes {
+		return errors.New(fmt.Sprintf("Segment bytes must be between 1 and %d: %d", int64(maxSegmentBytes), c.SegmentBytes))
+	}
+	for key, value := range map[string]int64{
+		"segment.age":          int64(c.SegmentAge),
+		"index.interval.bytes": c.IndexIntervalBytes,
+		"retention.age":        int64(c.RetentionAge),
+		"retention.bytes":      c.RetentionBytes,
+		"tombstone.retention":  int64(c.TombstoneRetention),
+		"sync.messages":        c.SyncMessages,
+		"sync.interval":        int64(c.SyncInterval),
+		"max.message.bytes":    c.MaxMessageBytes,
+	} {
+		if value < 0 {
+			return errors.New(fmt.Sprintf("Negative value for %s: %s", key, c.Map()[key]))
+		}
+	}
+	if c.CleanupPolicy != CleanupDelete && c.CleanupPolicy != CleanupCompact {
+		return errors.New(fmt.Sprintf("Unknown cleanup policy: %s", c.CleanupPolicy))
+	}
+	if _, ok := c.compression(Compression_NONE); !ok {
+		return errors.New(fmt.Sprintf("Unknown compression: %s", c.Compression))
+	}
+	if c.TimestampType != TimestampCreateTime && c.TimestampType != TimestampLogAppendTime {
+		return errors.New(fmt.Sprintf("Unknown timestamp type: %s", c.TimestampType))
+	}
+	return nil
+}
+
+// compression returns the compression to use for a batch that the producer
+// asked to be compressed with requested.
+func (c TopicConfig) compression(requested Compression) (Compression, bool) {
+	if c.Compression == CompressionProducer {
+		return requested, true
+	}
+	value, ok := Compression_value[strings.ToUpper(c.Compression)]
+	return Compression(value), ok
+}
+
+// Map returns the config keyed by the setting names accepted by Set.
+func (c TopicConfig) Map() map[string]string {
+	return map[string]string{
+		"segment.bytes":          strconv.FormatInt(c.SegmentBytes, 10),
+		"segment.age":            c.SegmentAge.String(),
+		"index.interval.bytes":   strconv.FormatInt(c.IndexIntervalBytes, 10),
+		"retention.age":          c.RetentionAge.String(),
+		"retention.bytes":        strconv.FormatInt(c.RetentionBytes, 10),
+		"cleanup.policy":         c.CleanupPolicy,
+		"tombstone.retention":    c.TombstoneRetention.String(),
+		"compression":            c.Compression,
+		"sync.messages":          strconv.FormatInt(c.SyncMessages, 10),
+		"sync.interval":          c.SyncInterval.String(),
+		"max.message.bytes":      strconv.FormatInt(c.MaxMessageBytes, 10),
+		"message.timestamp.type": c.TimestampType,
+	}
+}
+
+// Set parses value into the setting named key. Durations use the
+// time.ParseDuration format.
+func (c *TopicConfig) Set(key string, value string) error {
+	var err error
+	switch key {
+	case "segment.bytes":
+		c.SegmentBytes, err = strconv.ParseInt(value, 10, 64)
+	case "segment.age":
+		c.SegmentAge, err = time.ParseDuration(value)
+	case "index.interval.bytes":
+		c.IndexIntervalBytes, err = strconv.ParseInt(value, 10, 64)
+	case "retention.age":
+		c.RetentionAge, err = time.ParseDuration(value)
+	case "retention.bytes":
+		c.RetentionBytes, err = strconv.ParseInt(value, 10, 64)
+	case "cleanup.policy":
+		c.CleanupPolicy = value
+	case "tombstone.retention":
+		c.TombstoneRetention, err = time.ParseDuration(value)
+	case "compression":
+		c.Compression = value
+	case "sync.messages":
+		c.SyncMessages, err = strconv.ParseInt(value, 10, 64)
+	case "sync.interval":
+		c.SyncInterval, err = time.ParseDuration(value)
+	case "max.message.bytes":
+		c.MaxMessageBytes, err = strconv.ParseInt(value, 10, 64)
+	case "message.timestamp.type":
+		c.TimestampType = value
+	default:
+		return errors.New(fmt.Sprintf("Unknown topic config: %s", key))
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid value for %s: %v", key, err))
+	}
+	return nil
+}
+
+// override returns a copy of c with the given settings applied.
+func (c TopicConfig) override(overrides map[string]string) (TopicConfig, error) {
+	for key, value := range overrides {
+		if err := c.Set(key, value); err != nil {
+			return c, err
+		}
+	}
+	return c, c.validate()
+}
+
+// readTopicConfig returns the settings overridden by the topic in dir.
+func readTopicConfig(dir string) (map[string]string, error) {
+	overrides := make(map[string]string)
+	f, err := os.Open(path.Join(dir, topicConfigFile))
+	if os.IsNotExist(err) {
+		return overrides, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New(fmt.Sprintf("Malformed line in %s: %s", f.Name(), line))
+		}
+		overrides[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return overrides, scanner.Err()
+}
+
+// writeTopicConfig durably replaces the settings overridden by the topic in
+// dir.
+func writeTopicConfig(dir string, overrides map[string]string) error {
+	keys := make([]string, 0, len(overrides))
+	for key := range overrides {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tmpPath := path.Join(dir, topicConfigFile+".tmp")
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s=%s\n", key, overrides[key])
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path.Join(dir, topicConfigFile))
+}
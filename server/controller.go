@@ -0,0 +1,617 @@
+// Copyright (C) 2015 Daniel Harrison
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// controllerFile is the name of the file in the server's directory holding the
+// latest controller epoch this broker has granted a lease for, and the broker
+// it granted it to.
+const controllerFile = "controller"
+
+// controller tracks which brokers are alive from the heartbeats they send each
+// other. The live broker with the lowest id tries to become the controller,
+// which elects a new leader from the in-sync replicas of each partition whose
+// leader has died. To do so it needs a lease for a controller epoch from a
+// majority of the brokers, counting itself. A broker grants a lease to one
+// broker at a time, until a broker timeout after it last granted it, and
+// never for an epoch before one it has granted, which it persists. The
+// controller's own lease runs out a broker timeout after it asked for it, so
+// as long as clocks run at about the same rate, at most one broker holds a
+// lease at a time and no two controllers share an epoch. Brokers ignore
+// changes sent by the controller of an earlier epoch. A leader only drops
+// replicas from its in-sync replicas once the controller has accepted, so
+// the replicas the controller elects from have everything below the high
+// watermark.
+type controller struct {
+	server *Server
+
+	// electMu serializes elections with accepting shrunk in-sync replicas, so
+	// an election doesn't pick a replica dropped while it ran.
+	electMu sync.Mutex
+
+	mu       sync.Mutex
+	lastSeen map[int32]time.Time
+	alive    map[int32]bool
+	// epoch is the latest controller epoch this broker has granted a lease
+	// for and granted is the broker holding it, until expires. leaseEnd is
+	// when this broker's own lease as the controller of epoch runs out.
+	epoch    int32
+	granted  int32
+	expires  time.Time
+	leaseEnd time.Time
+	// offline holds partitions without a live in-sync replica to lead them,
+	// so they're only logged once.
+	offline map[string]bool
+	// unconfirmed holds the changes this broker made as controller that the
+	// partition's leader hasn't yet sent a heartbeat for. They're resent until
+	// it does.
+	unconfirmed map[string]*PartitionState
+}
+
+func newController(server *Server) (*controller, error) {
+	c := controller{
+		server:   server,
+		lastSeen: make(map[int32]time.Time),
+		alive:    make(map[int32]bool),
+		granted:  -1,
+		offline:  make(map[string]bool),
+
+		unconfirmed: make(map[string]*PartitionState),
+	}
+	// Every broker gets a full timeout to show up after this one starts.
+	now := time.Now()
+	for id := range server.config.Brokers {
+		c.lastSeen[id] = now
+		c.alive[id] = true
+	}
+	granted, epoch, ok, err := readController(server.dir)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		// The lease granted before a restart may not have run out yet.
+		c.epoch, c.granted, c.expires = epoch, granted, now.Add(server.config.BrokerTimeout)
+	}
+	return &c, nil
+}
+
+func readController(dir string) (int32, int32, bool, error) {
+	buf, err := ioutil.ReadFile(path.Join(dir, controllerFile))
+	if os.IsNotExist(err) {
+		return 0, 0, false, nil
+	} else if err != nil {
+		return 0, 0, false, err
+	}
+	var controller, epoch int32
+	if _, err := fmt.Sscanf(string(buf), "%d %d", &controller, &epoch); err != nil {
+		return 0, 0, false, errors.New(fmt.Sprintf("Malformed %s: %v", path.Join(dir, controllerFile), err))
+	}
+	return controller, epoch, true, nil
+}
+
+// writeController durably replaces the controller and controller epoch stored
+// in dir.
+func writeController(dir string, controller int32, epoch int32) error {
+	tmpPath := path.Join(dir, controllerFile+".tmp")
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d %d\n", controller, epoch)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path.Join(dir, controllerFile))
+}
+
+// run sends heartbeats to the other brokers and elects leaders while this
+// broker holds the controller lease, until the server's context is done.
+func (c *controller) run() {
+	if len(c.server.config.Brokers) == 0 {
+		return
+	}
+	interval := c.server.config.BrokerTimeout / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.server.ctx.Done():
+			return
+		case now := <-ticker.C:
+			// Giving up on each broker within the interval keeps one that's
+			// down from holding up renewing the lease.
+			c.sendHeartbeats(interval)
+			if c.checkAlive(now) == c.server.config.BrokerID && c.lease(interval) {
+				c.announce(append(c.elect(), c.reassign()...))
+			}
+		}
+	}
+}
+
+// grant grants a broker the lease for a controller epoch if this broker
+// hasn't granted it or a later one to another broker, and the lease it last
+// granted has run out. It returns whether it did and the latest epoch granted.
+func (c *controller) grant(id int32, epoch int32, now time.Time) (bool, int32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	renewal := epoch == c.epoch && id == c.granted
+	if !renewal && (epoch <= c.epoch || (c.granted != id && now.Before(c.expires))) {
+		return false, c.epoch, nil
+	}
+	if !renewal {
+		if err := writeController(c.server.dir, id, epoch); err != nil {
+			return false, c.epoch, err
+		}
+		if id != c.server.config.BrokerID {
+			log.Print("Granted broker ", id, " the controller lease for epoch ", epoch)
+		}
+		c.epoch, c.granted = epoch, id
+	}
+	c.expires = now.Add(c.server.config.BrokerTimeout)
+	return true, c.epoch, nil
+}
+
+// lease asks every broker for the controller lease, renewing it if this
+// broker already holds one, and returns whether a majority granted it within
+// timeout.
+func (c *controller) lease(timeout time.Duration) bool {
+	self := c.server.config.BrokerID
+	now := time.Now()
+	c.mu.Lock()
+	epoch := c.epoch
+	if c.granted != self {
+		epoch++
+	}
+	c.mu.Unlock()
+	ok, latest, err := c.grant(self, epoch, now)
+	if err != nil {
+		log.Print("Failed to grant the controller lease: ", err)
+	}
+	if !ok {
+		return false
+	}
+
+	var mu sync.Mutex
+	granted := 1
+	c.broadcast(timeout, func(ctx context.Context, client PubSubClient) error {
+		reply, err := client.ControllerLease(ctx, &ControllerLeaseRequest{BrokerId: self, ControllerEpoch: epoch})
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if reply.Granted {
+			granted++
+		} else if reply.ControllerEpoch > latest {
+			latest = reply.ControllerEpoch
+		}
+		return nil
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if latest > c.epoch {
+		// Ask for a later epoch than that next time.
+		c.epoch, c.granted = latest, -1
+	}
+	leaseEnd := now.Add(c.server.config.BrokerTimeout)
+	if granted <= len(c.server.config.Brokers)/2 || !time.Now().Before(leaseEnd) {
+		if now.Before(c.leaseEnd) {
+			log.Print("Lost the controller lease for epoch ", epoch)
+		}
+		c.leaseEnd = time.Time{}
+		c.unconfirmed = make(map[string]*PartitionState)
+		return false
+	}
+	if !now.Before(c.leaseEnd) {
+		log.Print("Became the controller in epoch ", epoch)
+	}
+	c.leaseEnd = leaseEnd
+	return true
+}
+
+// controlling returns whether this broker holds the controller lease, and
+// its epoch.
+func (c *controller) controlling() (bool, int32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Now().Before(c.leaseEnd), c.epoch
+}
+
+// heardFrom returns whether a request from the controller of epoch should be
+// applied, which it shouldn't if a later epoch has been granted.
+func (c *controller) heardFrom(id int32, epoch int32, now time.Time) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if epoch < c.epoch || (epoch == c.epoch && id != c.granted) {
+		return false, nil
+	}
+	if epoch > c.epoch {
+		// Granted by a majority this broker wasn't part of.
+		if err := writeController(c.server.dir, id, epoch); err != nil {
+			return false, err
+		}
+		c.epoch, c.granted, c.expires = epoch, id, now.Add(c.server.config.BrokerTimeout)
+	}
+	return true, nil
+}
+
+// ledStates returns the state of every partition this broker leads.
+func (c *controller) ledStates() []*PartitionState {
+	var states []*PartitionState
+	for _, topic := range c.server.allTopics() {
+		for _, partition := range topic.partitions {
+			partition.mu.Lock()
+			if partition.leader == partition.self {
+				states = append(states, partition.state())
+			}
+			partition.mu.Unlock()
+		}
+	}
+	return states
+}
+
+// sendHeartbeats tells every other broker that this one is alive and what
+// the partitions it leads look like.
+func (c *controller) sendHeartbeats(timeout time.Duration) {
+	request := BrokerHeartbeatRequest{BrokerId: c.server.config.BrokerID, Partitions: c.ledStates()}
+	c.broadcast(timeout, func(ctx context.Context, client PubSubClient) error {
+		_, err := client.BrokerHeartbeat(ctx, &request)
+		return err
+	})
+}
+
+// broadcast calls send concurrently for every other broker and waits for them
+// all, giving up on each after timeout.
+func (c *controller) broadcast(timeout time.Duration, send func(context.Context, PubSubClient) error) {
+	var wg sync.WaitGroup
+	for id := range c.server.config.Brokers {
+		if id == c.server.config.BrokerID {
+			continue
+		}
+		wg.Add(1)
+		go func(id int32) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(c.server.ctx, timeout)
+			defer cancel()
+			client, err := c.server.client(id)
+			if err == nil {
+				err = send(ctx, client)
+			}
+			if err != nil && c.server.ctx.Err() == nil {
+				c.mu.Lock()
+				alive := c.alive[id]
+				c.mu.Unlock()
+				if alive {
+					log.Print("Failed to reach broker ", id, ": ", err)
+				}
+			}
+		}(id)
+	}
+	wg.Wait()
+}
+
+// heard records a heartbeat from a broker, along with the partitions it
+// leads.
+func (c *controller) heard(id int32, states []*PartitionState, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.lastSeen[id]; !ok {
+		return
+	}
+	for _, state := range states {
+		key := fmt.Sprintf("%s/%d", state.Topic, state.Partition)
+		if elected, ok := c.unconfirmed[key]; ok && state.LeaderEpoch >= elected.LeaderEpoch {
+			delete(c.unconfirmed, key)
+		}
+	}
+	c.lastSeen[id] = now
+	if !c.alive[id] {
+		c.alive[id] = true
+		log.Print("Broker ", id, " is alive")
+	}
+}
+
+// id returns the broker holding the controller lease as far as this broker
+// knows, or -1 if none is.
+func (c *controller) id() int32 {
+	if len(c.server.config.Brokers) == 0 {
+		return c.server.config.BrokerID
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Now().Before(c.expires) {
+		return c.granted
+	}
+	return -1
+}
+
+// checkAlive marks the brokers that have stopped sending heartbeats as dead,
+// and returns the live broker with the lowest id.
+func (c *controller) checkAlive(now time.Time) int32 {
+	self := c.server.config.BrokerID
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastSeen[self] = now
+	lowest := self
+	for id, seen := range c.lastSeen {
+		alive := now.Sub(seen) <= c.server.config.BrokerTimeout
+		if c.alive[id] && !alive {
+			log.Print("Broker ", id, " stopped sending heartbeats")
+		}
+		c.alive[id] = alive
+		if alive && id < lowest {
+			lowest = id
+		}
+	}
+	return lowest
+}
+
+// elect picks new leaders for the partitions whose leader has stopped
+// sending heartbeats, and returns their new states. It is only called while
+// this broker holds the controller lease.
+func (c *controller) elect() []*PartitionState {
+	c.electMu.Lock()
+	defer c.electMu.Unlock()
+	c.mu.Lock()
+	epoch := c.epoch
+	alive := make(map[int32]bool)
+	for id, ok := range c.alive {
+		alive[id] = ok
+	}
+	c.mu.Unlock()
+
+	var elected []*PartitionState
+	for _, topic := range c.server.allTopics() {
+		for _, partition := range topic.partitions {
+			partition.mu.Lock()
+			current, replicas := partition.state(), partition.replicas
+			partition.mu.Unlock()
+			if alive[current.Leader] {
+				continue
+			}
+			state := PartitionState{Topic: current.Topic, Partition: current.Partition, Leader: -1, LeaderEpoch: current.LeaderEpoch + 1, ControllerEpoch: epoch, Replicas: replicas, TargetReplicas: current.TargetReplicas}
+			for _, id := range current.Isr {
+				if alive[id] {
+					state.Isr = append(state.Isr, id)
+				}
+			}
+			for _, id := range replicas {
+				if alive[id] && containsBroker(state.Isr, id) {
+					state.Leader = id
+					break
+				}
+			}
+			c.mu.Lock()
+			wasOffline := c.offline[partition.name]
+			c.offline[partition.name] = state.Leader < 0
+			c.mu.Unlock()
+			if state.Leader < 0 {
+				if !wasOffline {
+					log.Print("[", partition.name, "] No live in-sync replica to take over from broker ", current.Leader)
+				}
+				continue
+			}
+			sort.Sort(int32Slice(state.Isr))
+			if c.change(partition, &state) {
+				elected = append(elected, &state)
+			}
+		}
+	}
+	return elected
+}
+
+// acceptShrink records the in-sync replicas a leader has proposed dropping
+// replicas from, if this broker holds the controller lease and the leader
+// still leads the partition, and passes them on to the other brokers for
+// whichever of them controls next. It returns the version of the in-sync
+// replicas the leader carries on from.
+func (c *controller) acceptShrink(proposed *PartitionState) (int32, error) {
+	c.electMu.Lock()
+	if ok, _ := c.controlling(); !ok {
+		c.electMu.Unlock()
+		return 0, grpc.Errorf(codes.FailedPrecondition, "Broker %d isn't the controller", c.server.config.BrokerID)
+	}
+	topic, err := c.server.topic(proposed.Topic)
+	if err != nil {
+		c.electMu.Unlock()
+		return 0, err
+	}
+	partition, err := topic.Partition(proposed.Partition)
+	if err != nil {
+		c.electMu.Unlock()
+		return 0, err
+	}
+	partition.mu.Lock()
+	if proposed.Leader != partition.leader || proposed.LeaderEpoch != partition.leaderEpoch || proposed.ControllerEpoch != partition.controllerEpoch {
+		partition.mu.Unlock()
+		c.electMu.Unlock()
+		return 0, grpc.Errorf(codes.FailedPrecondition, "Broker %d doesn't lead %s in epoch %d", proposed.Leader, partition.name, proposed.LeaderEpoch)
+	}
+	accepted := *proposed
+	if accepted.IsrVersion <= partition.isrVersion {
+		// Heard of from a leader that restarted since.
+		accepted.IsrVersion = partition.isrVersion + 1
+	}
+	if partition.leader != partition.self {
+		partition.isr = make(map[int32]bool)
+		for _, id := range accepted.Isr {
+			partition.isr[id] = true
+		}
+		partition.isrVersion = accepted.IsrVersion
+	}
+	partition.mu.Unlock()
+	c.electMu.Unlock()
+
+	_, epoch := c.controlling()
+	request := LeaderAndIsrRequest{ControllerId: c.server.config.BrokerID, ControllerEpoch: epoch, Partitions: []*PartitionState{&accepted}}
+	c.broadcast(c.server.config.BrokerTimeout, func(ctx context.Context, client PubSubClient) error {
+		_, err := client.LeaderAndIsr(ctx, &request)
+		return err
+	})
+	return accepted.IsrVersion, nil
+}
+
+// change applies a new state of a partition decided by this broker as
+// controller, returning whether it succeeded. Unless this broker is the new
+// leader, the state is resent until the leader confirms it.
+func (c *controller) change(partition *Partition, state *PartitionState) bool {
+	if err := c.server.changeLeader(partition, state); err != nil {
+		log.Print("[", partition.name, "] Failed to change to leader ", state.Leader, " replicas ", state.Replicas, ": ", err)
+		return false
+	}
+	if state.Leader != c.server.config.BrokerID {
+		c.mu.Lock()
+		c.unconfirmed[partition.name] = state
+		c.mu.Unlock()
+	}
+	return true
+}
+
+// announce sends the changed partition states to every other broker, along
+// with any earlier ones that haven't been confirmed.
+func (c *controller) announce(changed []*PartitionState) {
+	sent := make(map[*PartitionState]bool)
+	for _, state := range changed {
+		sent[state] = true
+	}
+	c.mu.Lock()
+	for _, state := range c.unconfirmed {
+		if !sent[state] {
+			changed = append(changed, state)
+		}
+	}
+	c.mu.Unlock()
+	if len(changed) == 0 {
+		return
+	}
+	_, epoch := c.controlling()
+	request := LeaderAndIsrRequest{ControllerId: c.server.config.BrokerID, ControllerEpoch: epoch, Partitions: changed}
+	c.broadcast(c.server.config.BrokerTimeout, func(ctx context.Context, client PubSubClient) error {
+		_, err := client.LeaderAndIsr(ctx, &request)
+		return err
+	})
+}
+
+func containsBroker(brokers []int32, id int32) bool {
+	for _, broker := range brokers {
+		if broker == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) BrokerHeartbeat(ctx context.Context, in *BrokerHeartbeatRequest) (*BrokerHeartbeatReply, error) {
+	s.controller.heard(in.BrokerId, in.Partitions, time.Now())
+	s.applyStates(in.Partitions)
+	return &BrokerHeartbeatReply{}, nil
+}
+
+func (s *Server) LeaderAndIsr(ctx context.Context, in *LeaderAndIsrRequest) (*LeaderAndIsrReply, error) {
+	ok, err := s.controller.heardFrom(in.ControllerId, in.ControllerEpoch, time.Now())
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "Controller epoch %d of broker %d is stale", in.ControllerEpoch, in.ControllerId)
+	}
+	s.applyStates(in.Partitions)
+	return &LeaderAndIsrReply{}, nil
+}
+
+func (s *Server) ShrinkIsr(ctx context.Context, in *ShrinkIsrRequest) (*ShrinkIsrReply, error) {
+	if in.Partition == nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "No partition to shrink the in-sync replicas of")
+	}
+	version, err := s.controller.acceptShrink(in.Partition)
+	if err != nil {
+		return nil, err
+	}
+	return &ShrinkIsrReply{IsrVersion: version}, nil
+}
+
+func (s *Server) ControllerLease(ctx context.Context, in *ControllerLeaseRequest) (*ControllerLeaseReply, error) {
+	if _, ok := s.config.Brokers[in.BrokerId]; !ok {
+		return nil, grpc.Errorf(codes.InvalidArgument, "No broker %d", in.BrokerId)
+	}
+	granted, epoch, err := s.controller.grant(in.BrokerId, in.ControllerEpoch, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &ControllerLeaseReply{Granted: granted, ControllerEpoch: epoch}, nil
+}
+
+func (s *Server) GetMetadata(ctx context.Context, in *GetMetadataRequest) (*GetMetadataReply, error) {
+	reply := GetMetadataReply{ControllerId: s.controller.id()}
+	for id, address := range s.config.Brokers {
+		reply.Brokers = append(reply.Brokers, &BrokerMetadata{Id: id, Address: address})
+	}
+	sort.Sort(brokersByID(reply.Brokers))
+
+	var topics []*Topic
+	if len(in.Topics) == 0 {
+		for _, topic := range s.allTopics() {
+			if !internalTopic(topic.name) {
+				topics = append(topics, topic)
+			}
+		}
+	} else {
+		for _, name := range in.Topics {
+			if topic, err := s.topic(name); err == nil {
+				topics = append(topics, topic)
+			}
+		}
+	}
+	for _, topic := range topics {
+		metadata := TopicMetadata{Topic: topic.name}
+		for _, partition := range topic.partitions {
+			partition.mu.Lock()
+			state := partition.state()
+			metadata.Partitions = append(metadata.Partitions, &PartitionMetadata{
+				Partition:   partition.id,
+				Leader:      state.Leader,
+				LeaderEpoch: state.LeaderEpoch,
+				Replicas:    partition.replicas,
+				Isr:         state.Isr,
+			})
+			partition.mu.Unlock()
+		}
+		reply.Topics = append(reply.Topics, &metadata)
+	}
+	sort.Sort(topicsByName(reply.Topics))
+	return &reply, nil
+}
+
+type brokersByID []*BrokerMetadata
+
+func (b brokersByID) Len() int           { return len(b) }
+func (b brokersByID) Less(i, j int) bool { return b[i].Id < b[j].Id }
+func (b brokersByID) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+type topicsByName []*TopicMetadata
+
+func (t topicsByName) Len() int           { return len(t) }
+func (t topicsByName) Less(i, j int) bool { return t[i].Topic < t[j].Topic }
+func (t topicsByName) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
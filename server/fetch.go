@@ -0,0 +1,93 @@
+// Copyright (C) 2015 Daniel Harrison
+
+package server
+
+import (
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+// defaultFetchMaxBytes is used when a fetch doesn't give a max_bytes.
+const defaultFetchMaxBytes = 1024 * 1024
+
+func (s *Server) Fetch(ctx context.Context, in *FetchRequest) (*FetchReply, error) {
+	topic, err := s.topic(in.Topic)
+	if err != nil {
+		return nil, err
+	}
+	partition, err := topic.Partition(in.Partition)
+	if err != nil {
+		return nil, err
+	}
+	if err := partition.checkLeader(); err != nil {
+		return nil, err
+	}
+	maxBytes := in.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultFetchMaxBytes
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, time.Duration(in.MaxWaitMs)*time.Millisecond)
+	defer cancel()
+	reader, err := NewPartitionReader(waitCtx, partition, in.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	reply := FetchReply{}
+	var bytes int64
+	for bytes < maxBytes {
+		// Once min_bytes have been read, only keep going while there's more
+		// to read without waiting.
+		var batch *RecordBatch
+		if bytes >= in.MinBytes {
+			batch, err = reader.TryReadBatch()
+		} else {
+			batch, err = reader.ReadBatch()
+		}
+		if err != nil && err == waitCtx.Err() && ctx.Err() == nil {
+			// Waited max_wait_ms for min_bytes.
+			break
+		} else if err != nil {
+			return nil, err
+		} else if batch == nil {
+			break
+		}
+		// A batch bigger than max_bytes is still returned on its own so a
+		// consumer can't get stuck behind it.
+		size := int64(proto.Size(batch))
+		if bytes > 0 && (bytes+size > maxBytes || mixesKinds(batch, reply.Messages, reply.Batches)) {
+			break
+		}
+		bytes += size
+
+		// Compressed batches are shipped as is for the consumer to decode.
+		if batch.Compression == Compression_NONE {
+			messages, err := DecodeRecordBatch(batch)
+			if err != nil {
+				return nil, err
+			}
+			reply.Messages = append(reply.Messages, messages...)
+		} else {
+			reply.Batches = append(reply.Batches, batch)
+		}
+	}
+
+	partition.mu.Lock()
+	reply.HighWatermark = partition.highWatermark()
+	partition.mu.Unlock()
+	return &reply, nil
+}
+
+// mixesKinds returns whether adding batch to a reply would put decoded
+// messages and compressed batches in it together. Consumers can't tell the
+// order they were read in, so a reply stops at a change of kind.
+func mixesKinds(batch *RecordBatch, messages []*Message, batches []*RecordBatch) bool {
+	if batch.Compression == Compression_NONE {
+		return len(batches) > 0
+	}
+	return len(messages) > 0
+}
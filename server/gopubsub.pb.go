@@ -9,11 +9,75 @@ It is generated from these files:
 	gopubsub.proto
 
 It has these top-level messages:
+	Header
 	Message
+	RecordBatch
 	PublishMultiRequest
+	PartitionOffsets
 	PublishMultiReply
 	SubscribeRequest
 	SubscribeResponse
+	CreateTopicRequest
+	CreateTopicReply
+	DeleteTopicRequest
+	DeleteTopicReply
+	ListTopicsRequest
+	ListTopicsReply
+	DescribeTopicRequest
+	PartitionDescription
+	DescribeTopicReply
+	AlterTopicConfigRequest
+	AlterTopicConfigReply
+	CommitOffsetRequest
+	CommitOffsetReply
+	FetchCommittedOffsetRequest
+	FetchCommittedOffsetReply
+	OffsetCommitKey
+	OffsetCommitValue
+	TopicPartitions
+	JoinGroupRequest
+	JoinGroupReply
+	HeartbeatRequest
+	HeartbeatReply
+	LeaveGroupRequest
+	LeaveGroupReply
+	FetchRequest
+	FetchReply
+	ListOffsetsRequest
+	ListOffsetsReply
+	InitProducerIdRequest
+	InitProducerIdReply
+	BeginTransactionRequest
+	BeginTransactionReply
+	CommitTransactionRequest
+	CommitTransactionReply
+	AbortTransactionRequest
+	AbortTransactionReply
+	TransactionKey
+	TransactionDecision
+	PartitionReplicas
+	ReplicateRequest
+	ReplicateReply
+	PartitionState
+	BrokerHeartbeatRequest
+	BrokerHeartbeatReply
+	LeaderAndIsrRequest
+	LeaderAndIsrReply
+	ControllerLeaseRequest
+	ControllerLeaseReply
+	AddPartitionsToTransactionRequest
+	AddPartitionsToTransactionReply
+	WriteTransactionMarkerRequest
+	WriteTransactionMarkerReply
+	ShrinkIsrRequest
+	ShrinkIsrReply
+	BrokerMetadata
+	PartitionMetadata
+	TopicMetadata
+	GetMetadataRequest
+	GetMetadataReply
+	ReassignPartitionsRequest
+	ReassignPartitionsReply
 */
 package server
 
@@ -31,20 +95,186 @@ var _ grpc.ClientConn
 // Reference imports to suppress errors if they are not otherwise used.
 var _ = proto.Marshal
 
+type Compression int32
+
+const (
+	Compression_NONE   Compression = 0
+	Compression_GZIP   Compression = 1
+	Compression_SNAPPY Compression = 2
+	Compression_ZSTD   Compression = 3
+)
+
+var Compression_name = map[int32]string{
+	0: "NONE",
+	1: "GZIP",
+	2: "SNAPPY",
+	3: "ZSTD",
+}
+var Compression_value = map[string]int32{
+	"NONE":   0,
+	"GZIP":   1,
+	"SNAPPY": 2,
+	"ZSTD":   3,
+}
+
+func (x Compression) String() string {
+	return proto.EnumName(Compression_name, int32(x))
+}
+
+// How much of a publish has to be done before it is acknowledged.
+type Acks int32
+
+const (
+	// Written to the log, and fsynced if the topic's sync settings call for
+	// it.
+	Acks_LEADER Acks = 0
+	// Queued to be written. No offsets are returned and errors writing to the
+	// log aren't reported.
+	Acks_NONE Acks = 1
+	// Fsynced regardless of the topic's sync settings.
+	Acks_ALL Acks = 2
+)
+
+var Acks_name = map[int32]string{
+	0: "LEADER",
+	1: "NONE",
+	2: "ALL",
+}
+var Acks_value = map[string]int32{
+	"LEADER": 0,
+	"NONE":   1,
+	"ALL":    2,
+}
+
+func (x Acks) String() string {
+	return proto.EnumName(Acks_name, int32(x))
+}
+
+type ControlType int32
+
+const (
+	ControlType_DATA   ControlType = 0
+	ControlType_COMMIT ControlType = 1
+	ControlType_ABORT  ControlType = 2
+)
+
+var ControlType_name = map[int32]string{
+	0: "DATA",
+	1: "COMMIT",
+	2: "ABORT",
+}
+var ControlType_value = map[string]int32{
+	"DATA":   0,
+	"COMMIT": 1,
+	"ABORT":  2,
+}
+
+func (x ControlType) String() string {
+	return proto.EnumName(ControlType_name, int32(x))
+}
+
+// Where a subscription starts reading from.
+type StartPosition int32
+
+const (
+	StartPosition_OFFSET   StartPosition = 0
+	StartPosition_EARLIEST StartPosition = 1
+	// Only messages published after subscribing.
+	StartPosition_LATEST StartPosition = 2
+	// The first message with a timestamp at or after start_timestamp.
+	StartPosition_TIMESTAMP StartPosition = 3
+)
+
+var StartPosition_name = map[int32]string{
+	0: "OFFSET",
+	1: "EARLIEST",
+	2: "LATEST",
+	3: "TIMESTAMP",
+}
+var StartPosition_value = map[string]int32{
+	"OFFSET":    0,
+	"EARLIEST":  1,
+	"LATEST":    2,
+	"TIMESTAMP": 3,
+}
+
+func (x StartPosition) String() string {
+	return proto.EnumName(StartPosition_name, int32(x))
+}
+
+type Header struct {
+	Key   string `protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
+	Value []byte `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+}
+
+func (m *Header) Reset()         { *m = Header{} }
+func (m *Header) String() string { return proto.CompactTextString(m) }
+func (*Header) ProtoMessage()    {}
+
 type Message struct {
 	Offset uint64 `protobuf:"varint,1,opt,name=offset" json:"offset,omitempty"`
 	Crc    uint32 `protobuf:"varint,2,opt,name=crc" json:"crc,omitempty"`
-	Key    []byte `protobuf:"bytes,10,opt,name=key,proto3" json:"key,omitempty"`
-	Value  []byte `protobuf:"bytes,11,opt,name=value,proto3" json:"value,omitempty"`
+	// Milliseconds since the epoch. Set by the broker when appended if the
+	// publisher leaves it zero or the topic uses LogAppendTime.
+	Timestamp int64 `protobuf:"varint,3,opt,name=timestamp" json:"timestamp,omitempty"`
+	// Metadata such as trace ids and content types, kept out of the value.
+	Headers []*Header `protobuf:"bytes,4,rep,name=headers" json:"headers,omitempty"`
+	Key     []byte    `protobuf:"bytes,10,opt,name=key,proto3" json:"key,omitempty"`
+	Value   []byte    `protobuf:"bytes,11,opt,name=value,proto3" json:"value,omitempty"`
 }
 
 func (m *Message) Reset()         { *m = Message{} }
 func (m *Message) String() string { return proto.CompactTextString(m) }
 func (*Message) ProtoMessage()    {}
 
+func (m *Message) GetHeaders() []*Header {
+	if m != nil {
+		return m.Headers
+	}
+	return nil
+}
+
+// A batch of messages with consecutive offsets, encoded together and
+// compressed as a unit. This is stored as is in the log and shipped to
+// subscribers without decompressing.
+type RecordBatch struct {
+	Compression Compression `protobuf:"varint,1,opt,name=compression,enum=server.Compression" json:"compression,omitempty"`
+	BaseOffset  uint64      `protobuf:"varint,2,opt,name=base_offset" json:"base_offset,omitempty"`
+	LastOffset  uint64      `protobuf:"varint,3,opt,name=last_offset" json:"last_offset,omitempty"`
+	// Each message prefixed by its little endian uint32 length, compressed.
+	Records []byte `protobuf:"bytes,4,opt,name=records,proto3" json:"records,omitempty"`
+	// The latest timestamp of any of the messages.
+	MaxTimestamp int64 `protobuf:"varint,5,opt,name=max_timestamp" json:"max_timestamp,omitempty"`
+	// The producer and sequence of the publish it was part of, if any.
+	ProducerId    int64 `protobuf:"varint,6,opt,name=producer_id" json:"producer_id,omitempty"`
+	Sequence      int32 `protobuf:"varint,7,opt,name=sequence" json:"sequence,omitempty"`
+	Transactional bool  `protobuf:"varint,8,opt,name=transactional" json:"transactional,omitempty"`
+	// Control batches end a producer's transaction in the partition. They
+	// hold a single empty message and aren't returned to subscribers.
+	Control ControlType `protobuf:"varint,9,opt,name=control,enum=server.ControlType" json:"control,omitempty"`
+}
+
+func (m *RecordBatch) Reset()         { *m = RecordBatch{} }
+func (m *RecordBatch) String() string { return proto.CompactTextString(m) }
+func (*RecordBatch) ProtoMessage()    {}
+
 type PublishMultiRequest struct {
 	Topic    string     `protobuf:"bytes,1,opt,name=topic" json:"topic,omitempty"`
 	Messages []*Message `protobuf:"bytes,2,rep,name=messages" json:"messages,omitempty"`
+	// Used unless the topic is configured with a specific compression.
+	Compression Compression `protobuf:"varint,3,opt,name=compression,enum=server.Compression" json:"compression,omitempty"`
+	// -1 routes each message by a hash of its key.
+	Partition int32 `protobuf:"varint,4,opt,name=partition" json:"partition,omitempty"`
+	Acks      Acks  `protobuf:"varint,5,opt,name=acks,enum=server.Acks" json:"acks,omitempty"`
+	// If producer_id is set, sequence must go up by one with each request to
+	// the topic. A retry of the last request is dropped and answered with its
+	// original offsets, or with Unavailable while the original is still being
+	// published. Other duplicates and skipped sequences are rejected, as is
+	// acks NONE.
+	ProducerId int64 `protobuf:"varint,6,opt,name=producer_id" json:"producer_id,omitempty"`
+	Sequence   int32 `protobuf:"varint,7,opt,name=sequence" json:"sequence,omitempty"`
+	// Publish as part of the producer's open transaction.
+	Transactional bool `protobuf:"varint,8,opt,name=transactional" json:"transactional,omitempty"`
 }
 
 func (m *PublishMultiRequest) Reset()         { *m = PublishMultiRequest{} }
@@ -58,16 +288,51 @@ func (m *PublishMultiRequest) GetMessages() []*Message {
 	return nil
 }
 
+type PartitionOffsets struct {
+	Partition  int32  `protobuf:"varint,1,opt,name=partition" json:"partition,omitempty"`
+	BaseOffset uint64 `protobuf:"varint,2,opt,name=base_offset" json:"base_offset,omitempty"`
+	LastOffset uint64 `protobuf:"varint,3,opt,name=last_offset" json:"last_offset,omitempty"`
+}
+
+func (m *PartitionOffsets) Reset()         { *m = PartitionOffsets{} }
+func (m *PartitionOffsets) String() string { return proto.CompactTextString(m) }
+func (*PartitionOffsets) ProtoMessage()    {}
+
 type PublishMultiReply struct {
+	// Set when the messages were all published to one partition.
+	BaseOffset uint64              `protobuf:"varint,1,opt,name=base_offset" json:"base_offset,omitempty"`
+	LastOffset uint64              `protobuf:"varint,2,opt,name=last_offset" json:"last_offset,omitempty"`
+	Partitions []*PartitionOffsets `protobuf:"bytes,3,rep,name=partitions" json:"partitions,omitempty"`
 }
 
 func (m *PublishMultiReply) Reset()         { *m = PublishMultiReply{} }
 func (m *PublishMultiReply) String() string { return proto.CompactTextString(m) }
 func (*PublishMultiReply) ProtoMessage()    {}
 
+func (m *PublishMultiReply) GetPartitions() []*PartitionOffsets {
+	if m != nil {
+		return m.Partitions
+	}
+	return nil
+}
+
 type SubscribeRequest struct {
-	Topic  string `protobuf:"bytes,1,opt,name=topic" json:"topic,omitempty"`
-	Offset uint64 `protobuf:"varint,2,opt,name=offset" json:"offset,omitempty"`
+	Topic     string `protobuf:"bytes,1,opt,name=topic" json:"topic,omitempty"`
+	Offset    uint64 `protobuf:"varint,2,opt,name=offset" json:"offset,omitempty"`
+	Partition int32  `protobuf:"varint,3,opt,name=partition" json:"partition,omitempty"`
+	// If set, resume from the offset committed by this consumer group, or
+	// from offset if it has never committed one.
+	Group string `protobuf:"bytes,4,opt,name=group" json:"group,omitempty"`
+	// Limits on how much is sent in each response. Zero, or more than the
+	// server allows, uses the server's limit.
+	MaxBytes    int64 `protobuf:"varint,5,opt,name=max_bytes" json:"max_bytes,omitempty"`
+	MaxMessages int64 `protobuf:"varint,6,opt,name=max_messages" json:"max_messages,omitempty"`
+	// Ignored if group has committed an offset.
+	Start          StartPosition `protobuf:"varint,7,opt,name=start,enum=server.StartPosition" json:"start,omitempty"`
+	StartTimestamp int64         `protobuf:"varint,8,opt,name=start_timestamp" json:"start_timestamp,omitempty"`
+	// Only return transactional messages once they are committed, and never
+	// if they are aborted.
+	ReadCommitted bool `protobuf:"varint,9,opt,name=read_committed" json:"read_committed,omitempty"`
 }
 
 func (m *SubscribeRequest) Reset()         { *m = SubscribeRequest{} }
@@ -75,7 +340,10 @@ func (m *SubscribeRequest) String() string { return proto.CompactTextString(m) }
 func (*SubscribeRequest) ProtoMessage()    {}
 
 type SubscribeResponse struct {
-	Messages []*Message `protobuf:"bytes,1,rep,name=messages" json:"messages,omitempty"`
+	// A response holds either decoded messages or compressed batches, never
+	// both, so that they're in offset order.
+	Messages []*Message     `protobuf:"bytes,1,rep,name=messages" json:"messages,omitempty"`
+	Batches  []*RecordBatch `protobuf:"bytes,2,rep,name=batches" json:"batches,omitempty"`
 }
 
 func (m *SubscribeResponse) Reset()         { *m = SubscribeResponse{} }
@@ -89,117 +357,1583 @@ func (m *SubscribeResponse) GetMessages() []*Message {
 	return nil
 }
 
-func init() {
+func (m *SubscribeResponse) GetBatches() []*RecordBatch {
+	if m != nil {
+		return m.Batches
+	}
+	return nil
 }
 
-// Client API for PubSub service
+type CreateTopicRequest struct {
+	Topic string `protobuf:"bytes,1,opt,name=topic" json:"topic,omitempty"`
+	// Overrides of the server's default topic config, keyed by setting name
+	// (e.g. "cleanup.policy").
+	Config map[string]string `protobuf:"bytes,2,rep,name=config" json:"config,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// Zero uses the server's default.
+	Partitions int32 `protobuf:"varint,3,opt,name=partitions" json:"partitions,omitempty"`
+	// The brokers storing each partition, leader first. Empty lets the broker
+	// assign them and create the topic on the others.
+	Replicas []*PartitionReplicas `protobuf:"bytes,4,rep,name=replicas" json:"replicas,omitempty"`
+}
 
-type PubSubClient interface {
-	PublishMulti(ctx context.Context, in *PublishMultiRequest, opts ...grpc.CallOption) (*PublishMultiReply, error)
-	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (PubSub_SubscribeClient, error)
+func (m *CreateTopicRequest) Reset()         { *m = CreateTopicRequest{} }
+func (m *CreateTopicRequest) String() string { return proto.CompactTextString(m) }
+func (*CreateTopicRequest) ProtoMessage()    {}
+
+func (m *CreateTopicRequest) GetConfig() map[string]string {
+	if m != nil {
+		return m.Config
+	}
+	return nil
 }
 
-type pubSubClient struct {
-	cc *grpc.ClientConn
+func (m *CreateTopicRequest) GetReplicas() []*PartitionReplicas {
+	if m != nil {
+		return m.Replicas
+	}
+	return nil
 }
 
-func NewPubSubClient(cc *grpc.ClientConn) PubSubClient {
-	return &pubSubClient{cc}
+type CreateTopicReply struct {
 }
 
-func (c *pubSubClient) PublishMulti(ctx context.Context, in *PublishMultiRequest, opts ...grpc.CallOption) (*PublishMultiReply, error) {
-	out := new(PublishMultiReply)
-	err := grpc.Invoke(ctx, "/server.PubSub/PublishMulti", in, out, c.cc, opts...)
-	if err != nil {
-		return nil, err
+func (m *CreateTopicReply) Reset()         { *m = CreateTopicReply{} }
+func (m *CreateTopicReply) String() string { return proto.CompactTextString(m) }
+func (*CreateTopicReply) ProtoMessage()    {}
+
+type DeleteTopicRequest struct {
+	Topic string `protobuf:"bytes,1,opt,name=topic" json:"topic,omitempty"`
+}
+
+func (m *DeleteTopicRequest) Reset()         { *m = DeleteTopicRequest{} }
+func (m *DeleteTopicRequest) String() string { return proto.CompactTextString(m) }
+func (*DeleteTopicRequest) ProtoMessage()    {}
+
+type DeleteTopicReply struct {
+}
+
+func (m *DeleteTopicReply) Reset()         { *m = DeleteTopicReply{} }
+func (m *DeleteTopicReply) String() string { return proto.CompactTextString(m) }
+func (*DeleteTopicReply) ProtoMessage()    {}
+
+type ListTopicsRequest struct {
+}
+
+func (m *ListTopicsRequest) Reset()         { *m = ListTopicsRequest{} }
+func (m *ListTopicsRequest) String() string { return proto.CompactTextString(m) }
+func (*ListTopicsRequest) ProtoMessage()    {}
+
+type ListTopicsReply struct {
+	Topics []string `protobuf:"bytes,1,rep,name=topics" json:"topics,omitempty"`
+}
+
+func (m *ListTopicsReply) Reset()         { *m = ListTopicsReply{} }
+func (m *ListTopicsReply) String() string { return proto.CompactTextString(m) }
+func (*ListTopicsReply) ProtoMessage()    {}
+
+type DescribeTopicRequest struct {
+	Topic string `protobuf:"bytes,1,opt,name=topic" json:"topic,omitempty"`
+}
+
+func (m *DescribeTopicRequest) Reset()         { *m = DescribeTopicRequest{} }
+func (m *DescribeTopicRequest) String() string { return proto.CompactTextString(m) }
+func (*DescribeTopicRequest) ProtoMessage()    {}
+
+type PartitionDescription struct {
+	Partition int32 `protobuf:"varint,1,opt,name=partition" json:"partition,omitempty"`
+	// The first offset that can be subscribed to.
+	EarliestOffset uint64 `protobuf:"varint,2,opt,name=earliest_offset" json:"earliest_offset,omitempty"`
+	// The offset that will be assigned to the next published message.
+	LatestOffset uint64  `protobuf:"varint,3,opt,name=latest_offset" json:"latest_offset,omitempty"`
+	Segments     uint64  `protobuf:"varint,4,opt,name=segments" json:"segments,omitempty"`
+	Bytes        uint64  `protobuf:"varint,5,opt,name=bytes" json:"bytes,omitempty"`
+	Leader       int32   `protobuf:"varint,6,opt,name=leader" json:"leader,omitempty"`
+	Replicas     []int32 `protobuf:"varint,7,rep,name=replicas" json:"replicas,omitempty"`
+	// The replicas that have caught up with the leader.
+	Isr []int32 `protobuf:"varint,8,rep,name=isr" json:"isr,omitempty"`
+	// One past the last offset that subscribers can read.
+	HighWatermark uint64 `protobuf:"varint,9,opt,name=high_watermark" json:"high_watermark,omitempty"`
+	// Goes up by one each time a new leader is elected.
+	LeaderEpoch int32 `protobuf:"varint,10,opt,name=leader_epoch" json:"leader_epoch,omitempty"`
+}
+
+func (m *PartitionDescription) Reset()         { *m = PartitionDescription{} }
+func (m *PartitionDescription) String() string { return proto.CompactTextString(m) }
+func (*PartitionDescription) ProtoMessage()    {}
+
+type DescribeTopicReply struct {
+	Topic      string                  `protobuf:"bytes,1,opt,name=topic" json:"topic,omitempty"`
+	Partitions []*PartitionDescription `protobuf:"bytes,2,rep,name=partitions" json:"partitions,omitempty"`
+	Config     map[string]string       `protobuf:"bytes,3,rep,name=config" json:"config,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+}
+
+func (m *DescribeTopicReply) Reset()         { *m = DescribeTopicReply{} }
+func (m *DescribeTopicReply) String() string { return proto.CompactTextString(m) }
+func (*DescribeTopicReply) ProtoMessage()    {}
+
+func (m *DescribeTopicReply) GetPartitions() []*PartitionDescription {
+	if m != nil {
+		return m.Partitions
 	}
-	return out, nil
+	return nil
 }
 
-func (c *pubSubClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (PubSub_SubscribeClient, error) {
-	stream, err := grpc.NewClientStream(ctx, &_PubSub_serviceDesc.Streams[0], c.cc, "/server.PubSub/Subscribe", opts...)
-	if err != nil {
-		return nil, err
+func (m *DescribeTopicReply) GetConfig() map[string]string {
+	if m != nil {
+		return m.Config
 	}
-	x := &pubSubSubscribeClient{stream}
-	if err := x.ClientStream.SendProto(in); err != nil {
-		return nil, err
+	return nil
+}
+
+type AlterTopicConfigRequest struct {
+	Topic string `protobuf:"bytes,1,opt,name=topic" json:"topic,omitempty"`
+	// Settings to override, keyed by setting name.
+	Set map[string]string `protobuf:"bytes,2,rep,name=set" json:"set,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// Names of overridden settings to return to the server's defaults.
+	Remove []string `protobuf:"bytes,3,rep,name=remove" json:"remove,omitempty"`
+}
+
+func (m *AlterTopicConfigRequest) Reset()         { *m = AlterTopicConfigRequest{} }
+func (m *AlterTopicConfigRequest) String() string { return proto.CompactTextString(m) }
+func (*AlterTopicConfigRequest) ProtoMessage()    {}
+
+func (m *AlterTopicConfigRequest) GetSet() map[string]string {
+	if m != nil {
+		return m.Set
 	}
-	if err := x.ClientStream.CloseSend(); err != nil {
-		return nil, err
+	return nil
+}
+
+type AlterTopicConfigReply struct {
+	// The topic's settings after the change.
+	Config map[string]string `protobuf:"bytes,1,rep,name=config" json:"config,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+}
+
+func (m *AlterTopicConfigReply) Reset()         { *m = AlterTopicConfigReply{} }
+func (m *AlterTopicConfigReply) String() string { return proto.CompactTextString(m) }
+func (*AlterTopicConfigReply) ProtoMessage()    {}
+
+func (m *AlterTopicConfigReply) GetConfig() map[string]string {
+	if m != nil {
+		return m.Config
 	}
-	return x, nil
+	return nil
 }
 
-type PubSub_SubscribeClient interface {
-	Recv() (*SubscribeResponse, error)
-	grpc.ClientStream
+type CommitOffsetRequest struct {
+	Group     string `protobuf:"bytes,1,opt,name=group" json:"group,omitempty"`
+	Topic     string `protobuf:"bytes,2,opt,name=topic" json:"topic,omitempty"`
+	Partition int32  `protobuf:"varint,3,opt,name=partition" json:"partition,omitempty"`
+	// The next offset the group will consume.
+	Offset   uint64 `protobuf:"varint,4,opt,name=offset" json:"offset,omitempty"`
+	Metadata string `protobuf:"bytes,5,opt,name=metadata" json:"metadata,omitempty"`
+	// If set, the commit is rejected unless the partition is assigned to this
+	// member in the group's current generation.
+	MemberId   string `protobuf:"bytes,6,opt,name=member_id" json:"member_id,omitempty"`
+	Generation int32  `protobuf:"varint,7,opt,name=generation" json:"generation,omitempty"`
 }
 
-type pubSubSubscribeClient struct {
-	grpc.ClientStream
+func (m *CommitOffsetRequest) Reset()         { *m = CommitOffsetRequest{} }
+func (m *CommitOffsetRequest) String() string { return proto.CompactTextString(m) }
+func (*CommitOffsetRequest) ProtoMessage()    {}
+
+type CommitOffsetReply struct {
 }
 
-func (x *pubSubSubscribeClient) Recv() (*SubscribeResponse, error) {
-	m := new(SubscribeResponse)
-	if err := x.ClientStream.RecvProto(m); err != nil {
-		return nil, err
+func (m *CommitOffsetReply) Reset()         { *m = CommitOffsetReply{} }
+func (m *CommitOffsetReply) String() string { return proto.CompactTextString(m) }
+func (*CommitOffsetReply) ProtoMessage()    {}
+
+type FetchCommittedOffsetRequest struct {
+	Group     string `protobuf:"bytes,1,opt,name=group" json:"group,omitempty"`
+	Topic     string `protobuf:"bytes,2,opt,name=topic" json:"topic,omitempty"`
+	Partition int32  `protobuf:"varint,3,opt,name=partition" json:"partition,omitempty"`
+}
+
+func (m *FetchCommittedOffsetRequest) Reset()         { *m = FetchCommittedOffsetRequest{} }
+func (m *FetchCommittedOffsetRequest) String() string { return proto.CompactTextString(m) }
+func (*FetchCommittedOffsetRequest) ProtoMessage()    {}
+
+type FetchCommittedOffsetReply struct {
+	// False if the group has never committed an offset for the partition.
+	Committed bool   `protobuf:"varint,1,opt,name=committed" json:"committed,omitempty"`
+	Offset    uint64 `protobuf:"varint,2,opt,name=offset" json:"offset,omitempty"`
+	Metadata  string `protobuf:"bytes,3,opt,name=metadata" json:"metadata,omitempty"`
+}
+
+func (m *FetchCommittedOffsetReply) Reset()         { *m = FetchCommittedOffsetReply{} }
+func (m *FetchCommittedOffsetReply) String() string { return proto.CompactTextString(m) }
+func (*FetchCommittedOffsetReply) ProtoMessage()    {}
+
+// The key and value of messages in the internal __consumer_offsets topic.
+type OffsetCommitKey struct {
+	Group     string `protobuf:"bytes,1,opt,name=group" json:"group,omitempty"`
+	Topic     string `protobuf:"bytes,2,opt,name=topic" json:"topic,omitempty"`
+	Partition int32  `protobuf:"varint,3,opt,name=partition" json:"partition,omitempty"`
+}
+
+func (m *OffsetCommitKey) Reset()         { *m = OffsetCommitKey{} }
+func (m *OffsetCommitKey) String() string { return proto.CompactTextString(m) }
+func (*OffsetCommitKey) ProtoMessage()    {}
+
+type OffsetCommitValue struct {
+	Offset   uint64 `protobuf:"varint,1,opt,name=offset" json:"offset,omitempty"`
+	Metadata string `protobuf:"bytes,2,opt,name=metadata" json:"metadata,omitempty"`
+	// Unix nanoseconds.
+	CommitTime int64 `protobuf:"varint,3,opt,name=commit_time" json:"commit_time,omitempty"`
+}
+
+func (m *OffsetCommitValue) Reset()         { *m = OffsetCommitValue{} }
+func (m *OffsetCommitValue) String() string { return proto.CompactTextString(m) }
+func (*OffsetCommitValue) ProtoMessage()    {}
+
+type TopicPartitions struct {
+	Topic      string  `protobuf:"bytes,1,opt,name=topic" json:"topic,omitempty"`
+	Partitions []int32 `protobuf:"varint,2,rep,name=partitions" json:"partitions,omitempty"`
+}
+
+func (m *TopicPartitions) Reset()         { *m = TopicPartitions{} }
+func (m *TopicPartitions) String() string { return proto.CompactTextString(m) }
+func (*TopicPartitions) ProtoMessage()    {}
+
+type JoinGroupRequest struct {
+	Group string `protobuf:"bytes,1,opt,name=group" json:"group,omitempty"`
+	// Empty when joining for the first time.
+	MemberId string   `protobuf:"bytes,2,opt,name=member_id" json:"member_id,omitempty"`
+	Topics   []string `protobuf:"bytes,3,rep,name=topics" json:"topics,omitempty"`
+	// How long the member can go without a heartbeat before it is removed
+	// from the group. Zero uses the server's default.
+	SessionTimeoutMs int64 `protobuf:"varint,4,opt,name=session_timeout_ms" json:"session_timeout_ms,omitempty"`
+	// range, roundrobin or sticky. Every member of a group must use the same
+	// one.
+	Assignor string `protobuf:"bytes,5,opt,name=assignor" json:"assignor,omitempty"`
+}
+
+func (m *JoinGroupRequest) Reset()         { *m = JoinGroupRequest{} }
+func (m *JoinGroupRequest) String() string { return proto.CompactTextString(m) }
+func (*JoinGroupRequest) ProtoMessage()    {}
+
+type JoinGroupReply struct {
+	MemberId   string             `protobuf:"bytes,1,opt,name=member_id" json:"member_id,omitempty"`
+	Generation int32              `protobuf:"varint,2,opt,name=generation" json:"generation,omitempty"`
+	Assignment []*TopicPartitions `protobuf:"bytes,3,rep,name=assignment" json:"assignment,omitempty"`
+}
+
+func (m *JoinGroupReply) Reset()         { *m = JoinGroupReply{} }
+func (m *JoinGroupReply) String() string { return proto.CompactTextString(m) }
+func (*JoinGroupReply) ProtoMessage()    {}
+
+func (m *JoinGroupReply) GetAssignment() []*TopicPartitions {
+	if m != nil {
+		return m.Assignment
 	}
-	return m, nil
+	return nil
 }
 
-// Server API for PubSub service
+// The assignment in the reply changes whenever the generation does, as
+// members join, leave or time out.
+type HeartbeatRequest struct {
+	Group    string `protobuf:"bytes,1,opt,name=group" json:"group,omitempty"`
+	MemberId string `protobuf:"bytes,2,opt,name=member_id" json:"member_id,omitempty"`
+}
 
-type PubSubServer interface {
-	PublishMulti(context.Context, *PublishMultiRequest) (*PublishMultiReply, error)
-	Subscribe(*SubscribeRequest, PubSub_SubscribeServer) error
+func (m *HeartbeatRequest) Reset()         { *m = HeartbeatRequest{} }
+func (m *HeartbeatRequest) String() string { return proto.CompactTextString(m) }
+func (*HeartbeatRequest) ProtoMessage()    {}
+
+type HeartbeatReply struct {
+	Generation int32              `protobuf:"varint,1,opt,name=generation" json:"generation,omitempty"`
+	Assignment []*TopicPartitions `protobuf:"bytes,2,rep,name=assignment" json:"assignment,omitempty"`
 }
 
-func RegisterPubSubServer(s *grpc.Server, srv PubSubServer) {
-	s.RegisterService(&_PubSub_serviceDesc, srv)
+func (m *HeartbeatReply) Reset()         { *m = HeartbeatReply{} }
+func (m *HeartbeatReply) String() string { return proto.CompactTextString(m) }
+func (*HeartbeatReply) ProtoMessage()    {}
+
+func (m *HeartbeatReply) GetAssignment() []*TopicPartitions {
+	if m != nil {
+		return m.Assignment
+	}
+	return nil
 }
 
-func _PubSub_PublishMulti_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
-	in := new(PublishMultiRequest)
-	if err := proto.Unmarshal(buf, in); err != nil {
-		return nil, err
+type LeaveGroupRequest struct {
+	Group    string `protobuf:"bytes,1,opt,name=group" json:"group,omitempty"`
+	MemberId string `protobuf:"bytes,2,opt,name=member_id" json:"member_id,omitempty"`
+}
+
+func (m *LeaveGroupRequest) Reset()         { *m = LeaveGroupRequest{} }
+func (m *LeaveGroupRequest) String() string { return proto.CompactTextString(m) }
+func (*LeaveGroupRequest) ProtoMessage()    {}
+
+type LeaveGroupReply struct {
+}
+
+func (m *LeaveGroupReply) Reset()         { *m = LeaveGroupReply{} }
+func (m *LeaveGroupReply) String() string { return proto.CompactTextString(m) }
+func (*LeaveGroupReply) ProtoMessage()    {}
+
+type FetchRequest struct {
+	Topic     string `protobuf:"bytes,1,opt,name=topic" json:"topic,omitempty"`
+	Partition int32  `protobuf:"varint,2,opt,name=partition" json:"partition,omitempty"`
+	Offset    uint64 `protobuf:"varint,3,opt,name=offset" json:"offset,omitempty"`
+	// The most to return, though a single batch bigger than this is still
+	// returned. Zero uses 1MB.
+	MaxBytes int64 `protobuf:"varint,4,opt,name=max_bytes" json:"max_bytes,omitempty"`
+	// Wait up to max_wait_ms for at least this much to be published.
+	MinBytes  int64 `protobuf:"varint,5,opt,name=min_bytes" json:"min_bytes,omitempty"`
+	MaxWaitMs int64 `protobuf:"varint,6,opt,name=max_wait_ms" json:"max_wait_ms,omitempty"`
+}
+
+func (m *FetchRequest) Reset()         { *m = FetchRequest{} }
+func (m *FetchRequest) String() string { return proto.CompactTextString(m) }
+func (*FetchRequest) ProtoMessage()    {}
+
+type FetchReply struct {
+	// A reply holds either decoded messages or compressed batches, never both,
+	// so that they're in offset order.
+	Messages []*Message     `protobuf:"bytes,1,rep,name=messages" json:"messages,omitempty"`
+	Batches  []*RecordBatch `protobuf:"bytes,2,rep,name=batches" json:"batches,omitempty"`
+	// One past the last offset that can currently be fetched.
+	HighWatermark uint64 `protobuf:"varint,3,opt,name=high_watermark" json:"high_watermark,omitempty"`
+}
+
+func (m *FetchReply) Reset()         { *m = FetchReply{} }
+func (m *FetchReply) String() string { return proto.CompactTextString(m) }
+func (*FetchReply) ProtoMessage()    {}
+
+func (m *FetchReply) GetMessages() []*Message {
+	if m != nil {
+		return m.Messages
 	}
-	out, err := srv.(PubSubServer).PublishMulti(ctx, in)
-	if err != nil {
-		return nil, err
+	return nil
+}
+
+func (m *FetchReply) GetBatches() []*RecordBatch {
+	if m != nil {
+		return m.Batches
 	}
-	return out, nil
+	return nil
 }
 
-func _PubSub_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
-	m := new(SubscribeRequest)
-	if err := stream.RecvProto(m); err != nil {
-		return err
+type ListOffsetsRequest struct {
+	Topic     string `protobuf:"bytes,1,opt,name=topic" json:"topic,omitempty"`
+	Partition int32  `protobuf:"varint,2,opt,name=partition" json:"partition,omitempty"`
+	// One of EARLIEST, LATEST or TIMESTAMP.
+	Position  StartPosition `protobuf:"varint,3,opt,name=position,enum=server.StartPosition" json:"position,omitempty"`
+	Timestamp int64         `protobuf:"varint,4,opt,name=timestamp" json:"timestamp,omitempty"`
+}
+
+func (m *ListOffsetsRequest) Reset()         { *m = ListOffsetsRequest{} }
+func (m *ListOffsetsRequest) String() string { return proto.CompactTextString(m) }
+func (*ListOffsetsRequest) ProtoMessage()    {}
+
+type ListOffsetsReply struct {
+	Offset uint64 `protobuf:"varint,1,opt,name=offset" json:"offset,omitempty"`
+}
+
+func (m *ListOffsetsReply) Reset()         { *m = ListOffsetsReply{} }
+func (m *ListOffsetsReply) String() string { return proto.CompactTextString(m) }
+func (*ListOffsetsReply) ProtoMessage()    {}
+
+type InitProducerIdRequest struct {
+}
+
+func (m *InitProducerIdRequest) Reset()         { *m = InitProducerIdRequest{} }
+func (m *InitProducerIdRequest) String() string { return proto.CompactTextString(m) }
+func (*InitProducerIdRequest) ProtoMessage()    {}
+
+type InitProducerIdReply struct {
+	ProducerId int64 `protobuf:"varint,1,opt,name=producer_id" json:"producer_id,omitempty"`
+}
+
+func (m *InitProducerIdReply) Reset()         { *m = InitProducerIdReply{} }
+func (m *InitProducerIdReply) String() string { return proto.CompactTextString(m) }
+func (*InitProducerIdReply) ProtoMessage()    {}
+
+// A producer has at most one transaction open, which can span any number of
+// topics. Transactions are coordinated by the leader of __transaction_state,
+// which has to lead every partition the transaction writes to as well.
+type BeginTransactionRequest struct {
+	ProducerId int64 `protobuf:"varint,1,opt,name=producer_id" json:"producer_id,omitempty"`
+}
+
+func (m *BeginTransactionRequest) Reset()         { *m = BeginTransactionRequest{} }
+func (m *BeginTransactionRequest) String() string { return proto.CompactTextString(m) }
+func (*BeginTransactionRequest) ProtoMessage()    {}
+
+type BeginTransactionReply struct {
+}
+
+func (m *BeginTransactionReply) Reset()         { *m = BeginTransactionReply{} }
+func (m *BeginTransactionReply) String() string { return proto.CompactTextString(m) }
+func (*BeginTransactionReply) ProtoMessage()    {}
+
+type CommitTransactionRequest struct {
+	ProducerId int64 `protobuf:"varint,1,opt,name=producer_id" json:"producer_id,omitempty"`
+}
+
+func (m *CommitTransactionRequest) Reset()         { *m = CommitTransactionRequest{} }
+func (m *CommitTransactionRequest) String() string { return proto.CompactTextString(m) }
+func (*CommitTransactionRequest) ProtoMessage()    {}
+
+type CommitTransactionReply struct {
+}
+
+func (m *CommitTransactionReply) Reset()         { *m = CommitTransactionReply{} }
+func (m *CommitTransactionReply) String() string { return proto.CompactTextString(m) }
+func (*CommitTransactionReply) ProtoMessage()    {}
+
+type AbortTransactionRequest struct {
+	ProducerId int64 `protobuf:"varint,1,opt,name=producer_id" json:"producer_id,omitempty"`
+}
+
+func (m *AbortTransactionRequest) Reset()         { *m = AbortTransactionRequest{} }
+func (m *AbortTransactionRequest) String() string { return proto.CompactTextString(m) }
+func (*AbortTransactionRequest) ProtoMessage()    {}
+
+type AbortTransactionReply struct {
+}
+
+func (m *AbortTransactionReply) Reset()         { *m = AbortTransactionReply{} }
+func (m *AbortTransactionReply) String() string { return proto.CompactTextString(m) }
+func (*AbortTransactionReply) ProtoMessage()    {}
+
+// Stored in the internal __transaction_state topic.
+type TransactionKey struct {
+	ProducerId int64 `protobuf:"varint,1,opt,name=producer_id" json:"producer_id,omitempty"`
+}
+
+func (m *TransactionKey) Reset()         { *m = TransactionKey{} }
+func (m *TransactionKey) String() string { return proto.CompactTextString(m) }
+func (*TransactionKey) ProtoMessage()    {}
+
+type TransactionDecision struct {
+	Partitions []*TopicPartitions `protobuf:"bytes,1,rep,name=partitions" json:"partitions,omitempty"`
+	// Set while the transaction is open, so a coordinator taking over aborts
+	// it. Otherwise the transaction is being committed.
+	Ongoing bool `protobuf:"varint,2,opt,name=ongoing" json:"ongoing,omitempty"`
+}
+
+func (m *TransactionDecision) Reset()         { *m = TransactionDecision{} }
+func (m *TransactionDecision) String() string { return proto.CompactTextString(m) }
+func (*TransactionDecision) ProtoMessage()    {}
+
+func (m *TransactionDecision) GetPartitions() []*TopicPartitions {
+	if m != nil {
+		return m.Partitions
 	}
-	return srv.(PubSubServer).Subscribe(m, &pubSubSubscribeServer{stream})
+	return nil
 }
 
-type PubSub_SubscribeServer interface {
-	Send(*SubscribeResponse) error
-	grpc.ServerStream
+type PartitionReplicas struct {
+	Brokers []int32 `protobuf:"varint,1,rep,name=brokers" json:"brokers,omitempty"`
 }
 
-type pubSubSubscribeServer struct {
-	grpc.ServerStream
+func (m *PartitionReplicas) Reset()         { *m = PartitionReplicas{} }
+func (m *PartitionReplicas) String() string { return proto.CompactTextString(m) }
+func (*PartitionReplicas) ProtoMessage()    {}
+
+// Sent by a follower to the leader of a partition to fetch the batches
+// after its log, unchanged and including control batches.
+type ReplicateRequest struct {
+	Topic     string `protobuf:"bytes,1,opt,name=topic" json:"topic,omitempty"`
+	Partition int32  `protobuf:"varint,2,opt,name=partition" json:"partition,omitempty"`
+	// One past the last offset in the follower's log.
+	Offset   uint64 `protobuf:"varint,3,opt,name=offset" json:"offset,omitempty"`
+	BrokerId int32  `protobuf:"varint,4,opt,name=broker_id" json:"broker_id,omitempty"`
+	// The leader replies without waiting if its high watermark has moved past
+	// the follower's.
+	HighWatermark uint64 `protobuf:"varint,5,opt,name=high_watermark" json:"high_watermark,omitempty"`
+	MaxWaitMs     int64  `protobuf:"varint,6,opt,name=max_wait_ms" json:"max_wait_ms,omitempty"`
+	// The leader epoch the follower is following. Requests from followers of
+	// another epoch are rejected.
+	LeaderEpoch int32 `protobuf:"varint,7,opt,name=leader_epoch" json:"leader_epoch,omitempty"`
 }
 
-func (x *pubSubSubscribeServer) Send(m *SubscribeResponse) error {
-	return x.ServerStream.SendProto(m)
+func (m *ReplicateRequest) Reset()         { *m = ReplicateRequest{} }
+func (m *ReplicateRequest) String() string { return proto.CompactTextString(m) }
+func (*ReplicateRequest) ProtoMessage()    {}
+
+type ReplicateReply struct {
+	Batches       []*RecordBatch `protobuf:"bytes,1,rep,name=batches" json:"batches,omitempty"`
+	HighWatermark uint64         `protobuf:"varint,2,opt,name=high_watermark" json:"high_watermark,omitempty"`
+	// One past the last offset in the leader's log. A follower whose log goes
+	// past it truncates back to it before replicating anything more.
+	LogEndOffset uint64 `protobuf:"varint,3,opt,name=log_end_offset" json:"log_end_offset,omitempty"`
 }
 
-var _PubSub_serviceDesc = grpc.ServiceDesc{
-	ServiceName: "server.PubSub",
+func (m *ReplicateReply) Reset()         { *m = ReplicateReply{} }
+func (m *ReplicateReply) String() string { return proto.CompactTextString(m) }
+func (*ReplicateReply) ProtoMessage()    {}
+
+func (m *ReplicateReply) GetBatches() []*RecordBatch {
+	if m != nil {
+		return m.Batches
+	}
+	return nil
+}
+
+type PartitionState struct {
+	Topic       string  `protobuf:"bytes,1,opt,name=topic" json:"topic,omitempty"`
+	Partition   int32   `protobuf:"varint,2,opt,name=partition" json:"partition,omitempty"`
+	Leader      int32   `protobuf:"varint,3,opt,name=leader" json:"leader,omitempty"`
+	LeaderEpoch int32   `protobuf:"varint,4,opt,name=leader_epoch" json:"leader_epoch,omitempty"`
+	Isr         []int32 `protobuf:"varint,5,rep,name=isr" json:"isr,omitempty"`
+	// Changes along with the leader epoch when the partition is reassigned.
+	Replicas []int32 `protobuf:"varint,6,rep,name=replicas" json:"replicas,omitempty"`
+	// The epoch of the controller that chose the leader. Of two states with the
+	// same leader epoch, the one from the later controller wins.
+	ControllerEpoch int32 `protobuf:"varint,7,opt,name=controller_epoch" json:"controller_epoch,omitempty"`
+	// The replicas the partition is being reassigned to, if it's being moved.
+	TargetReplicas []int32 `protobuf:"varint,8,rep,name=target_replicas" json:"target_replicas,omitempty"`
+	// Counts the leader's changes to the in-sync replicas within the leader
+	// epoch, so an older list of them doesn't replace a newer one.
+	IsrVersion int32 `protobuf:"varint,9,opt,name=isr_version" json:"isr_version,omitempty"`
+}
+
+func (m *PartitionState) Reset()         { *m = PartitionState{} }
+func (m *PartitionState) String() string { return proto.CompactTextString(m) }
+func (*PartitionState) ProtoMessage()    {}
+
+// Sent by every broker to every other one to show it is alive, along with
+// the state of the partitions it leads.
+type BrokerHeartbeatRequest struct {
+	BrokerId   int32             `protobuf:"varint,1,opt,name=broker_id" json:"broker_id,omitempty"`
+	Partitions []*PartitionState `protobuf:"bytes,2,rep,name=partitions" json:"partitions,omitempty"`
+}
+
+func (m *BrokerHeartbeatRequest) Reset()         { *m = BrokerHeartbeatRequest{} }
+func (m *BrokerHeartbeatRequest) String() string { return proto.CompactTextString(m) }
+func (*BrokerHeartbeatRequest) ProtoMessage()    {}
+
+func (m *BrokerHeartbeatRequest) GetPartitions() []*PartitionState {
+	if m != nil {
+		return m.Partitions
+	}
+	return nil
+}
+
+type BrokerHeartbeatReply struct {
+}
+
+func (m *BrokerHeartbeatReply) Reset()         { *m = BrokerHeartbeatReply{} }
+func (m *BrokerHeartbeatReply) String() string { return proto.CompactTextString(m) }
+func (*BrokerHeartbeatReply) ProtoMessage()    {}
+
+// Sent by the controller to every broker when it elects new leaders.
+type LeaderAndIsrRequest struct {
+	ControllerId int32             `protobuf:"varint,1,opt,name=controller_id" json:"controller_id,omitempty"`
+	Partitions   []*PartitionState `protobuf:"bytes,2,rep,name=partitions" json:"partitions,omitempty"`
+	// Brokers ignore requests from controllers of earlier epochs.
+	ControllerEpoch int32 `protobuf:"varint,3,opt,name=controller_epoch" json:"controller_epoch,omitempty"`
+}
+
+func (m *LeaderAndIsrRequest) Reset()         { *m = LeaderAndIsrRequest{} }
+func (m *LeaderAndIsrRequest) String() string { return proto.CompactTextString(m) }
+func (*LeaderAndIsrRequest) ProtoMessage()    {}
+
+func (m *LeaderAndIsrRequest) GetPartitions() []*PartitionState {
+	if m != nil {
+		return m.Partitions
+	}
+	return nil
+}
+
+type LeaderAndIsrReply struct {
+}
+
+func (m *LeaderAndIsrReply) Reset()         { *m = LeaderAndIsrReply{} }
+func (m *LeaderAndIsrReply) String() string { return proto.CompactTextString(m) }
+func (*LeaderAndIsrReply) ProtoMessage()    {}
+
+// Sent by a broker to every other one to become the controller, or to stay
+// it, for a controller epoch. It is the controller while a majority of the
+// brokers, counting itself, have granted it a lease that hasn't run out.
+type ControllerLeaseRequest struct {
+	BrokerId        int32 `protobuf:"varint,1,opt,name=broker_id" json:"broker_id,omitempty"`
+	ControllerEpoch int32 `protobuf:"varint,2,opt,name=controller_epoch" json:"controller_epoch,omitempty"`
+}
+
+func (m *ControllerLeaseRequest) Reset()         { *m = ControllerLeaseRequest{} }
+func (m *ControllerLeaseRequest) String() string { return proto.CompactTextString(m) }
+func (*ControllerLeaseRequest) ProtoMessage()    {}
+
+type ControllerLeaseReply struct {
+	Granted bool `protobuf:"varint,1,opt,name=granted" json:"granted,omitempty"`
+	// The latest epoch the broker has granted a lease for.
+	ControllerEpoch int32 `protobuf:"varint,2,opt,name=controller_epoch" json:"controller_epoch,omitempty"`
+}
+
+func (m *ControllerLeaseReply) Reset()         { *m = ControllerLeaseReply{} }
+func (m *ControllerLeaseReply) String() string { return proto.CompactTextString(m) }
+func (*ControllerLeaseReply) ProtoMessage()    {}
+
+// Sent by the leader of a partition to the transaction coordinator before it
+// appends a transactional publish to the partition.
+type AddPartitionsToTransactionRequest struct {
+	ProducerId int64   `protobuf:"varint,1,opt,name=producer_id" json:"producer_id,omitempty"`
+	Topic      string  `protobuf:"bytes,2,opt,name=topic" json:"topic,omitempty"`
+	Partitions []int32 `protobuf:"varint,3,rep,name=partitions" json:"partitions,omitempty"`
+}
+
+func (m *AddPartitionsToTransactionRequest) Reset()         { *m = AddPartitionsToTransactionRequest{} }
+func (m *AddPartitionsToTransactionRequest) String() string { return proto.CompactTextString(m) }
+func (*AddPartitionsToTransactionRequest) ProtoMessage()    {}
+
+type AddPartitionsToTransactionReply struct {
+}
+
+func (m *AddPartitionsToTransactionReply) Reset()         { *m = AddPartitionsToTransactionReply{} }
+func (m *AddPartitionsToTransactionReply) String() string { return proto.CompactTextString(m) }
+func (*AddPartitionsToTransactionReply) ProtoMessage()    {}
+
+// Sent by the transaction coordinator to the leader of each partition in a
+// transaction once it is committed or aborted.
+type WriteTransactionMarkerRequest struct {
+	ProducerId int64       `protobuf:"varint,1,opt,name=producer_id" json:"producer_id,omitempty"`
+	Topic      string      `protobuf:"bytes,2,opt,name=topic" json:"topic,omitempty"`
+	Partition  int32       `protobuf:"varint,3,opt,name=partition" json:"partition,omitempty"`
+	Control    ControlType `protobuf:"varint,4,opt,name=control,enum=server.ControlType" json:"control,omitempty"`
+}
+
+func (m *WriteTransactionMarkerRequest) Reset()         { *m = WriteTransactionMarkerRequest{} }
+func (m *WriteTransactionMarkerRequest) String() string { return proto.CompactTextString(m) }
+func (*WriteTransactionMarkerRequest) ProtoMessage()    {}
+
+type WriteTransactionMarkerReply struct {
+}
+
+func (m *WriteTransactionMarkerReply) Reset()         { *m = WriteTransactionMarkerReply{} }
+func (m *WriteTransactionMarkerReply) String() string { return proto.CompactTextString(m) }
+func (*WriteTransactionMarkerReply) ProtoMessage()    {}
+
+// Sent by the leader of a partition to the controller to drop replicas that
+// have fallen behind from its in-sync replicas. Until the controller accepts,
+// the leader keeps waiting for them before advancing the high watermark, so
+// the controller never elects a replica that is missing a message the leader
+// counted as replicated.
+type ShrinkIsrRequest struct {
+	Partition *PartitionState `protobuf:"bytes,1,opt,name=partition" json:"partition,omitempty"`
+}
+
+func (m *ShrinkIsrRequest) Reset()         { *m = ShrinkIsrRequest{} }
+func (m *ShrinkIsrRequest) String() string { return proto.CompactTextString(m) }
+func (*ShrinkIsrRequest) ProtoMessage()    {}
+
+func (m *ShrinkIsrRequest) GetPartition() *PartitionState {
+	if m != nil {
+		return m.Partition
+	}
+	return nil
+}
+
+type ShrinkIsrReply struct {
+	// The version of the in-sync replicas the leader carries on from, which is
+	// past any the controller has heard of.
+	IsrVersion int32 `protobuf:"varint,1,opt,name=isr_version" json:"isr_version,omitempty"`
+}
+
+func (m *ShrinkIsrReply) Reset()         { *m = ShrinkIsrReply{} }
+func (m *ShrinkIsrReply) String() string { return proto.CompactTextString(m) }
+func (*ShrinkIsrReply) ProtoMessage()    {}
+
+type BrokerMetadata struct {
+	Id      int32  `protobuf:"varint,1,opt,name=id" json:"id,omitempty"`
+	Address string `protobuf:"bytes,2,opt,name=address" json:"address,omitempty"`
+}
+
+func (m *BrokerMetadata) Reset()         { *m = BrokerMetadata{} }
+func (m *BrokerMetadata) String() string { return proto.CompactTextString(m) }
+func (*BrokerMetadata) ProtoMessage()    {}
+
+type PartitionMetadata struct {
+	Partition   int32   `protobuf:"varint,1,opt,name=partition" json:"partition,omitempty"`
+	Leader      int32   `protobuf:"varint,2,opt,name=leader" json:"leader,omitempty"`
+	LeaderEpoch int32   `protobuf:"varint,3,opt,name=leader_epoch" json:"leader_epoch,omitempty"`
+	Replicas    []int32 `protobuf:"varint,4,rep,name=replicas" json:"replicas,omitempty"`
+	Isr         []int32 `protobuf:"varint,5,rep,name=isr" json:"isr,omitempty"`
+}
+
+func (m *PartitionMetadata) Reset()         { *m = PartitionMetadata{} }
+func (m *PartitionMetadata) String() string { return proto.CompactTextString(m) }
+func (*PartitionMetadata) ProtoMessage()    {}
+
+type TopicMetadata struct {
+	Topic      string               `protobuf:"bytes,1,opt,name=topic" json:"topic,omitempty"`
+	Partitions []*PartitionMetadata `protobuf:"bytes,2,rep,name=partitions" json:"partitions,omitempty"`
+}
+
+func (m *TopicMetadata) Reset()         { *m = TopicMetadata{} }
+func (m *TopicMetadata) String() string { return proto.CompactTextString(m) }
+func (*TopicMetadata) ProtoMessage()    {}
+
+func (m *TopicMetadata) GetPartitions() []*PartitionMetadata {
+	if m != nil {
+		return m.Partitions
+	}
+	return nil
+}
+
+// Any broker can answer with the whole cluster's metadata, which clients use
+// to find the leader of each partition.
+type GetMetadataRequest struct {
+	// Empty lists every topic. Topics that don't exist are left out.
+	Topics []string `protobuf:"bytes,1,rep,name=topics" json:"topics,omitempty"`
+}
+
+func (m *GetMetadataRequest) Reset()         { *m = GetMetadataRequest{} }
+func (m *GetMetadataRequest) String() string { return proto.CompactTextString(m) }
+func (*GetMetadataRequest) ProtoMessage()    {}
+
+type GetMetadataReply struct {
+	// Empty if the broker isn't part of a cluster, in which case it leads
+	// every partition.
+	Brokers      []*BrokerMetadata `protobuf:"bytes,1,rep,name=brokers" json:"brokers,omitempty"`
+	ControllerId int32             `protobuf:"varint,2,opt,name=controller_id" json:"controller_id,omitempty"`
+	Topics       []*TopicMetadata  `protobuf:"bytes,3,rep,name=topics" json:"topics,omitempty"`
+}
+
+func (m *GetMetadataReply) Reset()         { *m = GetMetadataReply{} }
+func (m *GetMetadataReply) String() string { return proto.CompactTextString(m) }
+func (*GetMetadataReply) ProtoMessage()    {}
+
+func (m *GetMetadataReply) GetBrokers() []*BrokerMetadata {
+	if m != nil {
+		return m.Brokers
+	}
+	return nil
+}
+
+func (m *GetMetadataReply) GetTopics() []*TopicMetadata {
+	if m != nil {
+		return m.Topics
+	}
+	return nil
+}
+
+// Sent to the controller to move partitions between brokers. Each partition
+// gets its new replicas, catches them up, moves its leader to one of them if
+// needed and then drops the replicas it no longer has. This happens in the
+// background, and DescribeTopic shows the replicas as it goes.
+type ReassignPartitionsRequest struct {
+	Topic string `protobuf:"bytes,1,opt,name=topic" json:"topic,omitempty"`
+	// The new brokers for each partition of topic, leader first. Partitions
+	// without any are left alone.
+	Replicas []*PartitionReplicas `protobuf:"bytes,2,rep,name=replicas" json:"replicas,omitempty"`
+	// Instead of reassigning topic, move every partition of every topic off
+	// these brokers onto the others, so they can be shut down.
+	Decommission []int32 `protobuf:"varint,3,rep,name=decommission" json:"decommission,omitempty"`
+}
+
+func (m *ReassignPartitionsRequest) Reset()         { *m = ReassignPartitionsRequest{} }
+func (m *ReassignPartitionsRequest) String() string { return proto.CompactTextString(m) }
+func (*ReassignPartitionsRequest) ProtoMessage()    {}
+
+func (m *ReassignPartitionsRequest) GetReplicas() []*PartitionReplicas {
+	if m != nil {
+		return m.Replicas
+	}
+	return nil
+}
+
+type ReassignPartitionsReply struct {
+}
+
+func (m *ReassignPartitionsReply) Reset()         { *m = ReassignPartitionsReply{} }
+func (m *ReassignPartitionsReply) String() string { return proto.CompactTextString(m) }
+func (*ReassignPartitionsReply) ProtoMessage()    {}
+
+func init() {
+	proto.RegisterEnum("server.Compression", Compression_name, Compression_value)
+	proto.RegisterEnum("server.Acks", Acks_name, Acks_value)
+	proto.RegisterEnum("server.ControlType", ControlType_name, ControlType_value)
+	proto.RegisterEnum("server.StartPosition", StartPosition_name, StartPosition_value)
+}
+
+// Client API for PubSub service
+
+type PubSubClient interface {
+	PublishMulti(ctx context.Context, in *PublishMultiRequest, opts ...grpc.CallOption) (*PublishMultiReply, error)
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (PubSub_SubscribeClient, error)
+	CreateTopic(ctx context.Context, in *CreateTopicRequest, opts ...grpc.CallOption) (*CreateTopicReply, error)
+	DeleteTopic(ctx context.Context, in *DeleteTopicRequest, opts ...grpc.CallOption) (*DeleteTopicReply, error)
+	ListTopics(ctx context.Context, in *ListTopicsRequest, opts ...grpc.CallOption) (*ListTopicsReply, error)
+	DescribeTopic(ctx context.Context, in *DescribeTopicRequest, opts ...grpc.CallOption) (*DescribeTopicReply, error)
+	AlterTopicConfig(ctx context.Context, in *AlterTopicConfigRequest, opts ...grpc.CallOption) (*AlterTopicConfigReply, error)
+	GetMetadata(ctx context.Context, in *GetMetadataRequest, opts ...grpc.CallOption) (*GetMetadataReply, error)
+	ReassignPartitions(ctx context.Context, in *ReassignPartitionsRequest, opts ...grpc.CallOption) (*ReassignPartitionsReply, error)
+	CommitOffset(ctx context.Context, in *CommitOffsetRequest, opts ...grpc.CallOption) (*CommitOffsetReply, error)
+	FetchCommittedOffset(ctx context.Context, in *FetchCommittedOffsetRequest, opts ...grpc.CallOption) (*FetchCommittedOffsetReply, error)
+	JoinGroup(ctx context.Context, in *JoinGroupRequest, opts ...grpc.CallOption) (*JoinGroupReply, error)
+	Heartbeat(ctx context.Context, in *HeartbeatRequest, opts ...grpc.CallOption) (*HeartbeatReply, error)
+	LeaveGroup(ctx context.Context, in *LeaveGroupRequest, opts ...grpc.CallOption) (*LeaveGroupReply, error)
+	Fetch(ctx context.Context, in *FetchRequest, opts ...grpc.CallOption) (*FetchReply, error)
+	ListOffsets(ctx context.Context, in *ListOffsetsRequest, opts ...grpc.CallOption) (*ListOffsetsReply, error)
+	InitProducerId(ctx context.Context, in *InitProducerIdRequest, opts ...grpc.CallOption) (*InitProducerIdReply, error)
+	BeginTransaction(ctx context.Context, in *BeginTransactionRequest, opts ...grpc.CallOption) (*BeginTransactionReply, error)
+	CommitTransaction(ctx context.Context, in *CommitTransactionRequest, opts ...grpc.CallOption) (*CommitTransactionReply, error)
+	AbortTransaction(ctx context.Context, in *AbortTransactionRequest, opts ...grpc.CallOption) (*AbortTransactionReply, error)
+	Replicate(ctx context.Context, in *ReplicateRequest, opts ...grpc.CallOption) (*ReplicateReply, error)
+	BrokerHeartbeat(ctx context.Context, in *BrokerHeartbeatRequest, opts ...grpc.CallOption) (*BrokerHeartbeatReply, error)
+	LeaderAndIsr(ctx context.Context, in *LeaderAndIsrRequest, opts ...grpc.CallOption) (*LeaderAndIsrReply, error)
+	ControllerLease(ctx context.Context, in *ControllerLeaseRequest, opts ...grpc.CallOption) (*ControllerLeaseReply, error)
+	AddPartitionsToTransaction(ctx context.Context, in *AddPartitionsToTransactionRequest, opts ...grpc.CallOption) (*AddPartitionsToTransactionReply, error)
+	WriteTransactionMarker(ctx context.Context, in *WriteTransactionMarkerRequest, opts ...grpc.CallOption) (*WriteTransactionMarkerReply, error)
+	ShrinkIsr(ctx context.Context, in *ShrinkIsrRequest, opts ...grpc.CallOption) (*ShrinkIsrReply, error)
+}
+
+type pubSubClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewPubSubClient(cc *grpc.ClientConn) PubSubClient {
+	return &pubSubClient{cc}
+}
+
+func (c *pubSubClient) PublishMulti(ctx context.Context, in *PublishMultiRequest, opts ...grpc.CallOption) (*PublishMultiReply, error) {
+	out := new(PublishMultiReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/PublishMulti", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (PubSub_SubscribeClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_PubSub_serviceDesc.Streams[0], c.cc, "/server.PubSub/Subscribe", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &pubSubSubscribeClient{stream}
+	if err := x.ClientStream.SendProto(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+func (c *pubSubClient) CreateTopic(ctx context.Context, in *CreateTopicRequest, opts ...grpc.CallOption) (*CreateTopicReply, error) {
+	out := new(CreateTopicReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/CreateTopic", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) DeleteTopic(ctx context.Context, in *DeleteTopicRequest, opts ...grpc.CallOption) (*DeleteTopicReply, error) {
+	out := new(DeleteTopicReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/DeleteTopic", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) ListTopics(ctx context.Context, in *ListTopicsRequest, opts ...grpc.CallOption) (*ListTopicsReply, error) {
+	out := new(ListTopicsReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/ListTopics", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) DescribeTopic(ctx context.Context, in *DescribeTopicRequest, opts ...grpc.CallOption) (*DescribeTopicReply, error) {
+	out := new(DescribeTopicReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/DescribeTopic", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) AlterTopicConfig(ctx context.Context, in *AlterTopicConfigRequest, opts ...grpc.CallOption) (*AlterTopicConfigReply, error) {
+	out := new(AlterTopicConfigReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/AlterTopicConfig", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) CommitOffset(ctx context.Context, in *CommitOffsetRequest, opts ...grpc.CallOption) (*CommitOffsetReply, error) {
+	out := new(CommitOffsetReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/CommitOffset", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) FetchCommittedOffset(ctx context.Context, in *FetchCommittedOffsetRequest, opts ...grpc.CallOption) (*FetchCommittedOffsetReply, error) {
+	out := new(FetchCommittedOffsetReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/FetchCommittedOffset", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) JoinGroup(ctx context.Context, in *JoinGroupRequest, opts ...grpc.CallOption) (*JoinGroupReply, error) {
+	out := new(JoinGroupReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/JoinGroup", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) Heartbeat(ctx context.Context, in *HeartbeatRequest, opts ...grpc.CallOption) (*HeartbeatReply, error) {
+	out := new(HeartbeatReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/Heartbeat", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) LeaveGroup(ctx context.Context, in *LeaveGroupRequest, opts ...grpc.CallOption) (*LeaveGroupReply, error) {
+	out := new(LeaveGroupReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/LeaveGroup", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) Fetch(ctx context.Context, in *FetchRequest, opts ...grpc.CallOption) (*FetchReply, error) {
+	out := new(FetchReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/Fetch", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) ListOffsets(ctx context.Context, in *ListOffsetsRequest, opts ...grpc.CallOption) (*ListOffsetsReply, error) {
+	out := new(ListOffsetsReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/ListOffsets", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) InitProducerId(ctx context.Context, in *InitProducerIdRequest, opts ...grpc.CallOption) (*InitProducerIdReply, error) {
+	out := new(InitProducerIdReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/InitProducerId", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) BeginTransaction(ctx context.Context, in *BeginTransactionRequest, opts ...grpc.CallOption) (*BeginTransactionReply, error) {
+	out := new(BeginTransactionReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/BeginTransaction", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) CommitTransaction(ctx context.Context, in *CommitTransactionRequest, opts ...grpc.CallOption) (*CommitTransactionReply, error) {
+	out := new(CommitTransactionReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/CommitTransaction", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) AbortTransaction(ctx context.Context, in *AbortTransactionRequest, opts ...grpc.CallOption) (*AbortTransactionReply, error) {
+	out := new(AbortTransactionReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/AbortTransaction", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) Replicate(ctx context.Context, in *ReplicateRequest, opts ...grpc.CallOption) (*ReplicateReply, error) {
+	out := new(ReplicateReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/Replicate", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) BrokerHeartbeat(ctx context.Context, in *BrokerHeartbeatRequest, opts ...grpc.CallOption) (*BrokerHeartbeatReply, error) {
+	out := new(BrokerHeartbeatReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/BrokerHeartbeat", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) LeaderAndIsr(ctx context.Context, in *LeaderAndIsrRequest, opts ...grpc.CallOption) (*LeaderAndIsrReply, error) {
+	out := new(LeaderAndIsrReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/LeaderAndIsr", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) GetMetadata(ctx context.Context, in *GetMetadataRequest, opts ...grpc.CallOption) (*GetMetadataReply, error) {
+	out := new(GetMetadataReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/GetMetadata", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) ReassignPartitions(ctx context.Context, in *ReassignPartitionsRequest, opts ...grpc.CallOption) (*ReassignPartitionsReply, error) {
+	out := new(ReassignPartitionsReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/ReassignPartitions", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) ControllerLease(ctx context.Context, in *ControllerLeaseRequest, opts ...grpc.CallOption) (*ControllerLeaseReply, error) {
+	out := new(ControllerLeaseReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/ControllerLease", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) AddPartitionsToTransaction(ctx context.Context, in *AddPartitionsToTransactionRequest, opts ...grpc.CallOption) (*AddPartitionsToTransactionReply, error) {
+	out := new(AddPartitionsToTransactionReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/AddPartitionsToTransaction", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) WriteTransactionMarker(ctx context.Context, in *WriteTransactionMarkerRequest, opts ...grpc.CallOption) (*WriteTransactionMarkerReply, error) {
+	out := new(WriteTransactionMarkerReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/WriteTransactionMarker", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) ShrinkIsr(ctx context.Context, in *ShrinkIsrRequest, opts ...grpc.CallOption) (*ShrinkIsrReply, error) {
+	out := new(ShrinkIsrReply)
+	err := grpc.Invoke(ctx, "/server.PubSub/ShrinkIsr", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type PubSub_SubscribeClient interface {
+	Recv() (*SubscribeResponse, error)
+	grpc.ClientStream
+}
+
+type pubSubSubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *pubSubSubscribeClient) Recv() (*SubscribeResponse, error) {
+	m := new(SubscribeResponse)
+	if err := x.ClientStream.RecvProto(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Server API for PubSub service
+
+type PubSubServer interface {
+	PublishMulti(context.Context, *PublishMultiRequest) (*PublishMultiReply, error)
+	Subscribe(*SubscribeRequest, PubSub_SubscribeServer) error
+	CreateTopic(context.Context, *CreateTopicRequest) (*CreateTopicReply, error)
+	DeleteTopic(context.Context, *DeleteTopicRequest) (*DeleteTopicReply, error)
+	ListTopics(context.Context, *ListTopicsRequest) (*ListTopicsReply, error)
+	DescribeTopic(context.Context, *DescribeTopicRequest) (*DescribeTopicReply, error)
+	AlterTopicConfig(context.Context, *AlterTopicConfigRequest) (*AlterTopicConfigReply, error)
+	GetMetadata(context.Context, *GetMetadataRequest) (*GetMetadataReply, error)
+	ReassignPartitions(context.Context, *ReassignPartitionsRequest) (*ReassignPartitionsReply, error)
+	CommitOffset(context.Context, *CommitOffsetRequest) (*CommitOffsetReply, error)
+	FetchCommittedOffset(context.Context, *FetchCommittedOffsetRequest) (*FetchCommittedOffsetReply, error)
+	JoinGroup(context.Context, *JoinGroupRequest) (*JoinGroupReply, error)
+	Heartbeat(context.Context, *HeartbeatRequest) (*HeartbeatReply, error)
+	LeaveGroup(context.Context, *LeaveGroupRequest) (*LeaveGroupReply, error)
+	Fetch(context.Context, *FetchRequest) (*FetchReply, error)
+	ListOffsets(context.Context, *ListOffsetsRequest) (*ListOffsetsReply, error)
+	InitProducerId(context.Context, *InitProducerIdRequest) (*InitProducerIdReply, error)
+	BeginTransaction(context.Context, *BeginTransactionRequest) (*BeginTransactionReply, error)
+	CommitTransaction(context.Context, *CommitTransactionRequest) (*CommitTransactionReply, error)
+	AbortTransaction(context.Context, *AbortTransactionRequest) (*AbortTransactionReply, error)
+	Replicate(context.Context, *ReplicateRequest) (*ReplicateReply, error)
+	BrokerHeartbeat(context.Context, *BrokerHeartbeatRequest) (*BrokerHeartbeatReply, error)
+	LeaderAndIsr(context.Context, *LeaderAndIsrRequest) (*LeaderAndIsrReply, error)
+	ControllerLease(context.Context, *ControllerLeaseRequest) (*ControllerLeaseReply, error)
+	AddPartitionsToTransaction(context.Context, *AddPartitionsToTransactionRequest) (*AddPartitionsToTransactionReply, error)
+	WriteTransactionMarker(context.Context, *WriteTransactionMarkerRequest) (*WriteTransactionMarkerReply, error)
+	ShrinkIsr(context.Context, *ShrinkIsrRequest) (*ShrinkIsrReply, error)
+}
+
+func RegisterPubSubServer(s *grpc.Server, srv PubSubServer) {
+	s.RegisterService(&_PubSub_serviceDesc, srv)
+}
+
+func _PubSub_PublishMulti_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(PublishMultiRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).PublishMulti(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PubSub_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvProto(m); err != nil {
+		return err
+	}
+	return srv.(PubSubServer).Subscribe(m, &pubSubSubscribeServer{stream})
+}
+
+func _PubSub_CreateTopic_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(CreateTopicRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).CreateTopic(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PubSub_DeleteTopic_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(DeleteTopicRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).DeleteTopic(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PubSub_ListTopics_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(ListTopicsRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).ListTopics(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PubSub_DescribeTopic_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(DescribeTopicRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).DescribeTopic(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PubSub_AlterTopicConfig_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(AlterTopicConfigRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).AlterTopicConfig(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PubSub_CommitOffset_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(CommitOffsetRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).CommitOffset(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PubSub_FetchCommittedOffset_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(FetchCommittedOffsetRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).FetchCommittedOffset(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PubSub_JoinGroup_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(JoinGroupRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).JoinGroup(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PubSub_Heartbeat_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(HeartbeatRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).Heartbeat(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PubSub_LeaveGroup_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(LeaveGroupRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).LeaveGroup(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PubSub_Fetch_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(FetchRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).Fetch(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PubSub_ListOffsets_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(ListOffsetsRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).ListOffsets(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PubSub_InitProducerId_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(InitProducerIdRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).InitProducerId(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PubSub_BeginTransaction_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(BeginTransactionRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).BeginTransaction(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PubSub_CommitTransaction_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(CommitTransactionRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).CommitTransaction(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PubSub_AbortTransaction_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(AbortTransactionRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).AbortTransaction(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PubSub_Replicate_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(ReplicateRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).Replicate(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PubSub_BrokerHeartbeat_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(BrokerHeartbeatRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).BrokerHeartbeat(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PubSub_LeaderAndIsr_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(LeaderAndIsrRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).LeaderAndIsr(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PubSub_GetMetadata_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(GetMetadataRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).GetMetadata(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PubSub_ReassignPartitions_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(ReassignPartitionsRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).ReassignPartitions(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PubSub_ControllerLease_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(ControllerLeaseRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).ControllerLease(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PubSub_AddPartitionsToTransaction_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(AddPartitionsToTransactionRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).AddPartitionsToTransaction(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PubSub_WriteTransactionMarker_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(WriteTransactionMarkerRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).WriteTransactionMarker(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _PubSub_ShrinkIsr_Handler(srv interface{}, ctx context.Context, buf []byte) (proto.Message, error) {
+	in := new(ShrinkIsrRequest)
+	if err := proto.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PubSubServer).ShrinkIsr(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type PubSub_SubscribeServer interface {
+	Send(*SubscribeResponse) error
+	grpc.ServerStream
+}
+
+type pubSubSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *pubSubSubscribeServer) Send(m *SubscribeResponse) error {
+	return x.ServerStream.SendProto(m)
+}
+
+var _PubSub_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "server.PubSub",
 	HandlerType: (*PubSubServer)(nil),
 	Methods: []grpc.MethodDesc{
 		{
 			MethodName: "PublishMulti",
 			Handler:    _PubSub_PublishMulti_Handler,
 		},
+		{
+			MethodName: "CreateTopic",
+			Handler:    _PubSub_CreateTopic_Handler,
+		},
+		{
+			MethodName: "DeleteTopic",
+			Handler:    _PubSub_DeleteTopic_Handler,
+		},
+		{
+			MethodName: "ListTopics",
+			Handler:    _PubSub_ListTopics_Handler,
+		},
+		{
+			MethodName: "DescribeTopic",
+			Handler:    _PubSub_DescribeTopic_Handler,
+		},
+		{
+			MethodName: "AlterTopicConfig",
+			Handler:    _PubSub_AlterTopicConfig_Handler,
+		},
+		{
+			MethodName: "GetMetadata",
+			Handler:    _PubSub_GetMetadata_Handler,
+		},
+		{
+			MethodName: "ReassignPartitions",
+			Handler:    _PubSub_ReassignPartitions_Handler,
+		},
+		{
+			MethodName: "CommitOffset",
+			Handler:    _PubSub_CommitOffset_Handler,
+		},
+		{
+			MethodName: "FetchCommittedOffset",
+			Handler:    _PubSub_FetchCommittedOffset_Handler,
+		},
+		{
+			MethodName: "JoinGroup",
+			Handler:    _PubSub_JoinGroup_Handler,
+		},
+		{
+			MethodName: "Heartbeat",
+			Handler:    _PubSub_Heartbeat_Handler,
+		},
+		{
+			MethodName: "LeaveGroup",
+			Handler:    _PubSub_LeaveGroup_Handler,
+		},
+		{
+			MethodName: "Fetch",
+			Handler:    _PubSub_Fetch_Handler,
+		},
+		{
+			MethodName: "ListOffsets",
+			Handler:    _PubSub_ListOffsets_Handler,
+		},
+		{
+			MethodName: "InitProducerId",
+			Handler:    _PubSub_InitProducerId_Handler,
+		},
+		{
+			MethodName: "BeginTransaction",
+			Handler:    _PubSub_BeginTransaction_Handler,
+		},
+		{
+			MethodName: "CommitTransaction",
+			Handler:    _PubSub_CommitTransaction_Handler,
+		},
+		{
+			MethodName: "AbortTransaction",
+			Handler:    _PubSub_AbortTransaction_Handler,
+		},
+		{
+			MethodName: "Replicate",
+			Handler:    _PubSub_Replicate_Handler,
+		},
+		{
+			MethodName: "BrokerHeartbeat",
+			Handler:    _PubSub_BrokerHeartbeat_Handler,
+		},
+		{
+			MethodName: "LeaderAndIsr",
+			Handler:    _PubSub_LeaderAndIsr_Handler,
+		},
+		{
+			MethodName: "ControllerLease",
+			Handler:    _PubSub_ControllerLease_Handler,
+		},
+		{
+			MethodName: "AddPartitionsToTransaction",
+			Handler:    _PubSub_AddPartitionsToTransaction_Handler,
+		},
+		{
+			MethodName: "WriteTransactionMarker",
+			Handler:    _PubSub_WriteTransactionMarker_Handler,
+		},
+		{
+			MethodName: "ShrinkIsr",
+			Handler:    _PubSub_ShrinkIsr_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -0,0 +1,270 @@
+// Copyright (C) 2015 Daniel Harrison
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// expireInterval is how often members that have stopped heartbeating are
+// looked for.
+const expireInterval = time.Second
+
+type groupMember struct {
+	id             string
+	topics         []string
+	sessionTimeout time.Duration
+	lastHeartbeat  time.Time
+}
+
+// consumerGroup is the membership and current assignment of a consumer group.
+// Groups are only kept in memory; members rejoin after a restart or when
+// another broker takes over leading the offsets topic.
+type consumerGroup struct {
+	name       string
+	assignor   Assignor
+	members    map[string]*groupMember
+	generation int32
+	// partitions is the number of partitions of each subscribed topic when
+	// the group was last rebalanced.
+	partitions  map[string]int32
+	assignments map[string]Assignment
+}
+
+// coordinator tracks every consumer group and rebalances them as members come
+// and go.
+type coordinator struct {
+	server *Server
+
+	mu     sync.Mutex
+	groups map[string]*consumerGroup
+}
+
+// partitionCounts returns the number of partitions of each topic subscribed
+// to by the group's members. Topics that don't exist have none.
+func (c *coordinator) partitionCounts(group *consumerGroup) map[string]int32 {
+	counts := make(map[string]int32)
+	for _, member := range group.members {
+		for _, name := range member.topics {
+			if topic, err := c.server.topic(name); err == nil {
+				counts[name] = int32(len(topic.partitions))
+			} else {
+				counts[name] = 0
+			}
+		}
+	}
+	return counts
+}
+
+// rebalance starts a new generation of the group. c.mu must be held.
+func (c *coordinator) rebalance(group *consumerGroup) {
+	ids := make([]string, 0, len(group.members))
+	for id := range group.members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	members := make([]AssignorMember, 0, len(ids))
+	for _, id := range ids {
+		members = append(members, AssignorMember{ID: id, Topics: group.members[id].topics})
+	}
+
+	group.generation++
+	group.partitions = c.partitionCounts(group)
+	group.assignments = group.assignor.Assign(members, group.partitions, group.assignments)
+	log.Print("[", group.name, "] Rebalanced ", len(members), " members for generation ", group.generation)
+}
+
+// expire removes members whose sessions have timed out and rebalances their
+// groups. c.mu must be held.
+func (c *coordinator) expire(group *consumerGroup, now time.Time) {
+	expired := false
+	for id, member := range group.members {
+		if now.Sub(member.lastHeartbeat) > member.sessionTimeout {
+			log.Print("[", group.name, "] Member ", id, " timed out")
+			delete(group.members, id)
+			expired = true
+		}
+	}
+	if len(group.members) == 0 {
+		delete(c.groups, group.name)
+	} else if expired {
+		c.rebalance(group)
+	}
+}
+
+// expirePeriodically looks for timed out members until the server's context
+// is done.
+func (c *coordinator) expirePeriodically() {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.server.ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			for _, group := range c.groups {
+				c.expire(group, now)
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// member returns a current member of a group, or a NotFound error telling it
+// to rejoin. c.mu must be held.
+func (c *coordinator) member(groupName string, id string) (*consumerGroup, *groupMember, error) {
+	group, ok := c.groups[groupName]
+	if ok {
+		c.expire(group, time.Now())
+		if member, ok := group.members[id]; ok {
+			return group, member, nil
+		}
+	}
+	return nil, nil, grpc.Errorf(codes.NotFound, "Member %s is not in group %s", id, groupName)
+}
+
+// checkOwner returns an error unless the member is assigned the partition in
+// the given generation of the group.
+func (c *coordinator) checkOwner(groupName string, id string, generation int32, topic string, partition int32) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	group, _, err := c.member(groupName, id)
+	if err != nil {
+		return err
+	}
+	if generation != group.generation {
+		return grpc.Errorf(codes.FailedPrecondition, "Generation %d of group %s is stale, current is %d", generation, groupName, group.generation)
+	}
+	for _, p := range group.assignments[id][topic] {
+		if p == partition {
+			return nil
+		}
+	}
+	return grpc.Errorf(codes.FailedPrecondition, "Partition %s/%d is not assigned to member %s", topic, partition, id)
+}
+
+func newMemberID(group string) (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return group + "-" + hex.EncodeToString(buf), nil
+}
+
+func assignmentReply(assignment Assignment) []*TopicPartitions {
+	topics := make([]string, 0, len(assignment))
+	for topic := range assignment {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	var reply []*TopicPartitions
+	for _, topic := range topics {
+		reply = append(reply, &TopicPartitions{Topic: topic, Partitions: assignment[topic]})
+	}
+	return reply
+}
+
+func (s *Server) JoinGroup(ctx context.Context, in *JoinGroupRequest) (*JoinGroupReply, error) {
+	if in.Group == "" {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Group is required")
+	}
+	if err := s.offsets.partition.checkLeader(); err != nil {
+		return nil, err
+	}
+	name := in.Assignor
+	if name == "" {
+		name = "range"
+	}
+	assignor, ok := assignors[name]
+	if !ok {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Unknown assignor: %s", name)
+	}
+	sessionTimeout := time.Duration(in.SessionTimeoutMs) * time.Millisecond
+	if sessionTimeout <= 0 {
+		sessionTimeout = s.config.SessionTimeout
+	}
+
+	c := s.coordinator
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	group, ok := c.groups[in.Group]
+	if !ok {
+		group = &consumerGroup{name: in.Group, assignor: assignor, members: make(map[string]*groupMember)}
+		c.groups[in.Group] = group
+	} else if group.assignor.Name() != name {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "Group %s uses the %s assignor", in.Group, group.assignor.Name())
+	}
+
+	id := in.MemberId
+	if id == "" {
+		var err error
+		if id, err = newMemberID(in.Group); err != nil {
+			return nil, err
+		}
+	} else if _, ok := group.members[id]; !ok {
+		return nil, grpc.Errorf(codes.NotFound, "Member %s is not in group %s", id, in.Group)
+	}
+	topics := append([]string(nil), in.Topics...)
+	sort.Strings(topics)
+	group.members[id] = &groupMember{id: id, topics: topics, sessionTimeout: sessionTimeout, lastHeartbeat: time.Now()}
+	log.Print("[", in.Group, "] Member ", id, " joined for ", topics)
+	c.rebalance(group)
+
+	return &JoinGroupReply{MemberId: id, Generation: group.generation, Assignment: assignmentReply(group.assignments[id])}, nil
+}
+
+func (s *Server) Heartbeat(ctx context.Context, in *HeartbeatRequest) (*HeartbeatReply, error) {
+	if err := s.offsets.partition.checkLeader(); err != nil {
+		return nil, err
+	}
+	c := s.coordinator
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	group, member, err := c.member(in.Group, in.MemberId)
+	if err != nil {
+		return nil, err
+	}
+	member.lastHeartbeat = time.Now()
+
+	// Pick up topics being created or deleted since the last rebalance.
+	counts := c.partitionCounts(group)
+	for topic, n := range counts {
+		if group.partitions[topic] != n {
+			c.rebalance(group)
+			break
+		}
+	}
+
+	return &HeartbeatReply{Generation: group.generation, Assignment: assignmentReply(group.assignments[member.id])}, nil
+}
+
+func (s *Server) LeaveGroup(ctx context.Context, in *LeaveGroupRequest) (*LeaveGroupReply, error) {
+	if err := s.offsets.partition.checkLeader(); err != nil {
+		return nil, err
+	}
+	c := s.coordinator
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	group, _, err := c.member(in.Group, in.MemberId)
+	if err != nil {
+		return nil, err
+	}
+	delete(group.members, in.MemberId)
+	log.Print("[", in.Group, "] Member ", in.MemberId, " left")
+	if len(group.members) == 0 {
+		delete(c.groups, in.Group)
+	} else {
+		c.rebalance(group)
+	}
+	return &LeaveGroupReply{}, nil
+}
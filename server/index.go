@@ -0,0 +1,131 @@
+// Copyright (C) 2015 Daniel Harrison
+
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	indexEntrySize = 8
+
+	// maxSegmentBytes is the largest a message set can grow to, as its index
+	// stores positions as uint32s.
+	maxSegmentBytes = math.MaxUint32
+)
+
+// Index is a sparse mapping from the offsets in a message set to the byte
+// positions of their records. It is stored alongside the message set as a
+// sequence of little endian (relative offset, position) uint32 pairs.
+type Index struct {
+	path    string
+	file    *os.File
+	entries []indexEntry
+}
+
+type indexEntry struct {
+	offset   uint32
+	position uint32
+}
+
+func indexPath(messageSetPath string) string {
+	return strings.TrimSuffix(messageSetPath, ".pubsub") + ".index"
+}
+
+// NewIndex creates an empty index at path.
+func NewIndex(path string) (*Index, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0770)
+	if err != nil {
+		return nil, err
+	}
+	return &Index{path: path, file: f}, nil
+}
+
+// LoadIndex reads the index at path, dropping any partially written entries
+// or entries that point past size, the number of valid bytes in the message
+// set.
+func LoadIndex(path string, size int64) (*Index, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	idx := Index{path: path}
+	for i := 0; i+indexEntrySize <= len(buf); i += indexEntrySize {
+		entry := indexEntry{
+			offset:   binary.LittleEndian.Uint32(buf[i : i+4]),
+			position: binary.LittleEndian.Uint32(buf[i+4 : i+8]),
+		}
+		if int64(entry.position) >= size {
+			break
+		}
+		idx.entries = append(idx.entries, entry)
+	}
+	if len(idx.entries)*indexEntrySize != len(buf) {
+		if err := os.Truncate(path, int64(len(idx.entries)*indexEntrySize)); err != nil {
+			return nil, err
+		}
+	}
+	return &idx, nil
+}
+
+// Append adds an entry for the record at the given offset, relative to the
+// start of the message set, and byte position.
+func (idx *Index) Append(offset uint64, position int64) error {
+	if offset > math.MaxUint32 || position < 0 || position > maxSegmentBytes {
+		return errors.New(fmt.Sprintf("Index entry %d at %d is out of range for %s", offset, position, idx.path))
+	}
+	if idx.file == nil {
+		f, err := os.OpenFile(idx.path, os.O_WRONLY|os.O_APPEND, 0770)
+		if err != nil {
+			return err
+		}
+		idx.file = f
+	}
+
+	buf := make([]byte, indexEntrySize)
+	entry := indexEntry{offset: uint32(offset), position: uint32(position)}
+	binary.LittleEndian.PutUint32(buf[0:4], entry.offset)
+	binary.LittleEndian.PutUint32(buf[4:8], entry.position)
+	if _, err := idx.file.Write(buf); err != nil {
+		return err
+	}
+	idx.entries = append(idx.entries, entry)
+	return nil
+}
+
+// Lookup returns the closest indexed record at or before offset. Reading may
+// start from the returned position without missing offset.
+func (idx *Index) Lookup(offset uint32) (uint32, uint32) {
+	i := sort.Search(len(idx.entries), func(i int) bool {
+		return idx.entries[i].offset > offset
+	})
+	if i == 0 {
+		return 0, 0
+	}
+	entry := idx.entries[i-1]
+	return entry.offset, entry.position
+}
+
+// lastPosition returns the byte position of the last indexed record.
+func (idx *Index) lastPosition() int64 {
+	if len(idx.entries) == 0 {
+		return 0
+	}
+	return int64(idx.entries[len(idx.entries)-1].position)
+}
+
+func (idx *Index) Close() error {
+	if idx.file == nil {
+		return nil
+	}
+	err := idx.file.Close()
+	idx.file = nil
+	return err
+}
@@ -13,7 +13,9 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/paperstreet/gopubsub/follow"
 
 	"golang.org/x/net/context"
@@ -22,10 +24,22 @@ import (
 type MessageSet struct {
 	path        string
 	offsetBegin uint64
-	offsetEnd   uint64
+	// offsetEnd is one past the last offset stored in the message set.
+	offsetEnd uint64
+	// size is the number of bytes of records visible to readers.
+	size      int64
+	created   time.Time
+	index     *Index
+	timeIndex TimeIndex
+	// producerBatches holds the batches with a producer id found when the
+	// message set was validated, until the topic recovers its producers.
+	producerBatches []*RecordBatch
 }
 
-func NewMessageSet(ctx context.Context, path string) (*MessageSet, error) {
+// NewMessageSet loads and validates the message set at path. Its time index,
+// and its index if missing, are rebuilt with an entry every indexInterval
+// bytes.
+func NewMessageSet(ctx context.Context, path string, indexInterval int64) (*MessageSet, error) {
 	basename := filepath.Base(path)
 	offset, err := strconv.ParseUint(strings.TrimSuffix(basename, filepath.Ext(basename)), 10, 64)
 	if err != nil {
@@ -33,47 +47,173 @@ func NewMessageSet(ctx context.Context, path string) (*MessageSet, error) {
 	}
 
 	messageSet := MessageSet{path: path, offsetBegin: offset}
-	if err = messageSet.validate(ctx); err != nil {
+	rebuildIndex := false
+	if _, err := os.Stat(indexPath(path)); os.IsNotExist(err) {
+		log.Print("Rebuilding missing index for message set: ", path)
+		rebuildIndex = true
+		if messageSet.index, err = NewIndex(indexPath(path)); err != nil {
+			return nil, err
+		}
+		defer messageSet.index.Close()
+	} else if err != nil {
 		return nil, err
 	}
 
+	if err = messageSet.validate(ctx, indexInterval, rebuildIndex); err != nil {
+		return nil, err
+	}
+
+	if !rebuildIndex {
+		if messageSet.index, err = LoadIndex(indexPath(path), messageSet.size); err != nil {
+			return nil, err
+		}
+	}
+
 	return &messageSet, nil
 }
 
-func (ms *MessageSet) validate(ctx context.Context) error {
+// RecoverMessageSet truncates the message set at path after its last intact
+// record, dropping anything partially written or corrupted by a crash, and
+// then loads it like NewMessageSet. It should only be used for the message set
+// that was being appended to.
+func RecoverMessageSet(ctx context.Context, path string, indexInterval int64) (*MessageSet, error) {
+	ms := MessageSet{path: path}
+	size, err := ms.scan(ctx, func(position int64, batch *RecordBatch) error {
+		return nil
+	})
+	if _, ok := err.(*corruptRecordError); ok {
+		info, statErr := os.Stat(path)
+		if statErr != nil {
+			return nil, statErr
+		}
+		log.Print("Truncating message set ", path, " to ", size, " bytes, dropping ", info.Size()-size, " bytes: ", err)
+		if err := os.Truncate(path, size); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return NewMessageSet(ctx, path, indexInterval)
+}
+
+// validate reads every record in the message set to find its size and
+// offsetEnd. If indexInterval is non-zero, time index entries, and index
+// entries if rebuildIndex is set, are added as it goes.
+func (ms *MessageSet) validate(ctx context.Context, indexInterval int64, rebuildIndex bool) error {
 	log.Print("Validating message set: ", *ms)
 
-	f, err := os.Open(ms.path)
+	ms.offsetEnd = ms.offsetBegin
+	ms.timeIndex = TimeIndex{}
+	ms.producerBatches = nil
+	var lastIndexed int64
+	size, err := ms.scan(ctx, func(position int64, batch *RecordBatch) error {
+		if batch.BaseOffset < ms.offsetEnd || batch.LastOffset < batch.BaseOffset {
+			return errors.New(fmt.Sprintf("Out of order offsets %d-%d after %d in %s", batch.BaseOffset, batch.LastOffset, ms.offsetEnd-1, ms.path))
+		}
+		indexed := indexInterval > 0 && position-lastIndexed >= indexInterval
+		if indexed {
+			lastIndexed = position
+			if rebuildIndex {
+				if err := ms.index.Append(batch.BaseOffset-ms.offsetBegin, position); err != nil {
+					return err
+				}
+			}
+		}
+		ms.timeIndex.Add(uint32(batch.BaseOffset-ms.offsetBegin), batch, indexed)
+		if batch.ProducerId != 0 {
+			ms.producerBatches = append(ms.producerBatches, &RecordBatch{
+				BaseOffset:    batch.BaseOffset,
+				LastOffset:    batch.LastOffset,
+				ProducerId:    batch.ProducerId,
+				Sequence:      batch.Sequence,
+				Transactional: batch.Transactional,
+				Control:       batch.Control,
+			})
+		}
+		ms.offsetEnd = batch.LastOffset + 1
+		return nil
+	})
 	if err != nil {
 		return err
 	}
+	ms.size = size
+	log.Print("Validated message set:  ", *ms)
+	return nil
+}
 
-	r := NewMessageSetReader(ctx, f, nil)
-	ms.offsetEnd = ms.offsetBegin
+// scan calls fn with the position and batch of every record in the message set
+// and returns the position of the end of the last one.
+func (ms *MessageSet) scan(ctx context.Context, fn func(position int64, batch *RecordBatch) error) (int64, error) {
+	f, err := os.Open(ms.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := NewMessageSetReader(ctx, f, nil, ms.offsetBegin)
 	for {
-		_, err = r.readNoWait()
+		position := r.r.Offset
+		batch, err := r.readNoWait()
 		if err == io.EOF {
-			log.Print("Validated message set:  ", *ms)
-			return nil
+			return position, nil
 		} else if err != nil {
-			return err
+			return position, &corruptRecordError{position, err}
+		}
+		if err := fn(position, batch); err != nil {
+			return position, err
 		}
-		ms.offsetEnd++
 	}
-	return nil
+}
+
+// corruptRecordError is returned by scan for a record that is truncated or
+// fails to decode.
+type corruptRecordError struct {
+	position int64
+	err      error
+}
+
+func (e *corruptRecordError) Error() string {
+	return fmt.Sprintf("Corrupt record at position %d: %v", e.position, e.err)
+}
+
+// remove deletes the message set and its index from disk.
+func (ms *MessageSet) remove() error {
+	if err := ms.index.Close(); err != nil {
+		return err
+	}
+	if err := os.Remove(indexPath(ms.path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(ms.path)
 }
 
 type MessageSetReader struct {
 	ctx context.Context
 	r   *follow.Reader
+	// next is the offset after the last record read. Records written with
+	// magicMessage don't store their offset, so they're numbered from it.
+	next uint64
 }
 
-func NewMessageSetReader(ctx context.Context, f *os.File, ping chan int64) *MessageSetReader {
+// NewMessageSetReader reads the message set in f, which begins at offset.
+func NewMessageSetReader(ctx context.Context, f *os.File, ping chan int64, offset uint64) *MessageSetReader {
 	follower := follow.NewReader(ctx, f, ping)
-	return &MessageSetReader{ctx, follower}
+	return &MessageSetReader{ctx, follower, offset}
 }
 
-func (ms *MessageSetReader) ReadMessage() ([]byte, error) {
+// SeekRecord moves the reader to the record at position, which holds offset.
+func (ms *MessageSetReader) SeekRecord(position int64, offset uint64) error {
+	if _, err := ms.r.Seek(position, os.SEEK_SET); err != nil {
+		return err
+	}
+	ms.next = offset
+	return nil
+}
+
+// ReadBatch returns the next record in the message set, waiting for it to be
+// written if necessary. Records written with magicMessage are returned as a
+// batch of one uncompressed message.
+func (ms *MessageSetReader) ReadBatch() (*RecordBatch, error) {
 	if err := ms.r.WaitBytes(4); err != nil {
 		return nil, err
 	}
@@ -84,15 +224,81 @@ func (ms *MessageSetReader) ReadMessage() ([]byte, error) {
 	if err := ms.r.WaitBytes(int64(length)); err != nil {
 		return nil, err
 	}
-	return readPayload(ms.r, length)
+	magic, payload, err := readPayload(ms.r, length)
+	if err != nil {
+		return nil, err
+	}
+	return ms.decode(magic, payload)
 }
 
-func (ms *MessageSetReader) readNoWait() ([]byte, error) {
+func (ms *MessageSetReader) readNoWait() (*RecordBatch, error) {
 	length, err := readLength(ms.r)
 	if err != nil {
 		return nil, err
 	}
-	return readPayload(ms.r, length)
+	available, err := ms.r.Available()
+	if err != nil {
+		return nil, err
+	}
+	if int64(length) > available {
+		return nil, io.ErrUnexpectedEOF
+	}
+	magic, payload, err := readPayload(ms.r, length)
+	if err != nil {
+		return nil, err
+	}
+	return ms.decode(magic, payload)
+}
+
+const (
+	// magicMessage records hold a single encoded Message, with its offset
+	// left zero. They are no longer written but are still read from old
+	// message sets.
+	magicMessage byte = 0
+	// magicBatch records hold an encoded RecordBatch.
+	magicBatch byte = 1
+)
+
+// decode returns the batch in the payload of a record, giving a magicMessage
+// record the offset after the last record read.
+func (ms *MessageSetReader) decode(magic byte, payload []byte) (*RecordBatch, error) {
+	batch := new(RecordBatch)
+	if magic == magicMessage {
+		message := new(Message)
+		if err := proto.Unmarshal(payload, message); err != nil {
+			return nil, err
+		}
+		message.Offset = ms.next
+		var err error
+		if batch, err = NewRecordBatch([]*Message{message}, Compression_NONE); err != nil {
+			return nil, err
+		}
+	} else if err := proto.Unmarshal(payload, batch); err != nil {
+		return nil, err
+	}
+	ms.next = batch.LastOffset + 1
+	return batch, nil
+}
+
+// recordSize returns the number of bytes writeRecord uses for payload.
+func recordSize(payload []byte) int64 {
+	return int64(len(payload) + 9)
+}
+
+// writeRecord frames payload, an encoded RecordBatch, with its length, magic
+// and crc and writes it to writer.
+func writeRecord(writer io.Writer, payload []byte) (int, error) {
+	headerBuf := make([]byte, 9)
+	binary.LittleEndian.PutUint32(headerBuf[0:4], uint32(len(payload)+5))
+	headerBuf[4] = magicBatch
+	binary.LittleEndian.PutUint32(headerBuf[5:9], crc32.ChecksumIEEE(payload))
+
+	n, err := writer.Write(headerBuf)
+	if err != nil {
+		return n, err
+	}
+	m, err := writer.Write(payload)
+	return n + m, err
 }
 
 func readLength(reader io.Reader) (uint32, error) {
@@ -104,40 +310,48 @@ func readLength(reader io.Reader) (uint32, error) {
 	return binary.LittleEndian.Uint32(lengthBuf), nil
 }
 
-func readPayload(reader io.Reader, length uint32) ([]byte, error) {
+func readPayload(reader io.Reader, length uint32) (byte, []byte, error) {
+	if length < 5 {
+		return 0, nil, errors.New(fmt.Sprintf("Invalid record length: %d", length))
+	}
 	magicBuf := make([]byte, 1)
 	_, err := io.ReadFull(reader, magicBuf)
 	if err != nil {
-		return nil, err
+		return 0, nil, err
 	}
-	if magicBuf[0] != 0 {
-		return nil, errors.New(fmt.Sprintf("Unsupported magic: %d", magicBuf[0]))
+	magic := magicBuf[0]
+	if magic != magicMessage && magic != magicBatch {
+		return 0, nil, errors.New(fmt.Sprintf("Unsupported magic: %d", magic))
 	}
 
 	crcBuf := make([]byte, 4)
 	_, err = io.ReadFull(reader, crcBuf)
 	if err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 	crcCheck := binary.LittleEndian.Uint32(crcBuf)
 
 	dataBuf := make([]byte, int(length-5))
 	_, err = io.ReadFull(reader, dataBuf)
 	if err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 
-	crc := crc32.NewIEEE()
-	crc.Sum(dataBuf)
-	crcData := crc.Sum32()
+	var crcData uint32
+	if magic == magicBatch {
+		crcData = crc32.ChecksumIEEE(dataBuf)
+	} else {
+		// Records with magicMessage were written with the checksum of nothing.
+		crcData = crc32.ChecksumIEEE(nil)
+	}
 	if crcCheck != crcData {
-		return nil, errors.New(fmt.Sprintf("Mismatched crc got %d expected %d", crcCheck, crcData))
+		return 0, nil, errors.New(fmt.Sprintf("Mismatched crc got %d expected %d", crcCheck, crcData))
 	}
 
-	return dataBuf, nil
+	return magic, dataBuf, nil
 }
 
-type MessageSetSort []MessageSet
+type MessageSetSort []*MessageSet
 
 func (s MessageSetSort) Len() int           { return len(s) }
 func (s MessageSetSort) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,220 @@
+// Copyright (C) 2015 Daniel Harrison
+
+package server
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// OffsetsTopic is the internal topic that consumer groups commit their offsets
+// to. It is compacted, so only the latest commit for each group and partition
+// is kept. The leader of its one partition coordinates every consumer group,
+// and the other brokers turn away group and offset requests.
+const OffsetsTopic = "__consumer_offsets"
+
+var offsetsTopicConfig = map[string]string{
+	"cleanup.policy": CleanupCompact,
+	"segment.bytes":  "104857600",
+}
+
+// internalTopic returns whether name is reserved for the server's own use.
+func internalTopic(name string) bool {
+	return strings.HasPrefix(name, "__")
+}
+
+type offsetKey struct {
+	group     string
+	topic     string
+	partition int32
+}
+
+// offsetStore holds the latest offset committed by each consumer group for
+// each partition, backed by the offsets topic.
+type offsetStore struct {
+	partition *Partition
+
+	// mu is held while committing so the offsets topic and offsets agree on
+	// which commit was last. offsets are loaded from the log as of leader
+	// epoch, and reloaded when this broker becomes the leader again, since
+	// the commits replicated while it followed aren't applied.
+	mu      sync.Mutex
+	epoch   int32
+	offsets map[offsetKey]*OffsetCommitValue
+}
+
+// initOffsets opens or creates the offsets topic and loads every committed
+// offset from it.
+func (s *Server) initOffsets() error {
+	s.mu.Lock()
+	topic, ok := s.topics[OffsetsTopic]
+	if !ok {
+		var err error
+		if topic, _, err = s.createTopic(OffsetsTopic, 1, offsetsTopicConfig, nil); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	s.mu.Unlock()
+
+	store := offsetStore{partition: topic.partitions[0], epoch: -1}
+	s.offsets = &store
+	return nil
+}
+
+// load replays the offsets topic if this broker has become its leader since
+// it was last loaded. o.mu must be held.
+func (o *offsetStore) load(ctx context.Context) error {
+	o.partition.mu.Lock()
+	if leader := o.partition.leader; leader != o.partition.self {
+		o.partition.mu.Unlock()
+		return notLeader(o.partition.name, leader)
+	}
+	epoch := o.partition.leaderEpoch
+	if epoch == o.epoch {
+		o.partition.mu.Unlock()
+		return nil
+	}
+	if err := o.partition.Flush(); err != nil {
+		o.partition.mu.Unlock()
+		return err
+	}
+	messageSets := make([]*MessageSet, len(o.partition.messageSets))
+	copy(messageSets, o.partition.messageSets)
+	o.partition.mu.Unlock()
+
+	o.offsets = make(map[offsetKey]*OffsetCommitValue)
+	for _, messageSet := range messageSets {
+		_, err := messageSet.scan(ctx, func(position int64, batch *RecordBatch) error {
+			messages, err := DecodeRecordBatch(batch)
+			if err != nil {
+				return err
+			}
+			for _, message := range messages {
+				key := new(OffsetCommitKey)
+				if err := proto.Unmarshal(message.Key, key); err != nil {
+					return err
+				}
+				k := offsetKey{key.Group, key.Topic, key.Partition}
+				if len(message.Value) == 0 {
+					delete(o.offsets, k)
+					continue
+				}
+				value := new(OffsetCommitValue)
+				if err := proto.Unmarshal(message.Value, value); err != nil {
+					return err
+				}
+				o.offsets[k] = value
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	o.epoch = epoch
+	return nil
+}
+
+// commit durably records offset as the position of group in a partition.
+func (o *offsetStore) commit(ctx context.Context, k offsetKey, offset uint64, metadata string) error {
+	value := OffsetCommitValue{Offset: offset, Metadata: metadata, CommitTime: time.Now().UnixNano()}
+	encodedKey, err := proto.Marshal(&OffsetCommitKey{Group: k.group, Topic: k.topic, Partition: k.partition})
+	if err != nil {
+		return err
+	}
+	encodedValue, err := proto.Marshal(&value)
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.load(ctx); err != nil {
+		return err
+	}
+	if err := o.partition.checkInsync(); err != nil {
+		return err
+	}
+	_, last, err := o.partition.Publish(ctx, []*Message{{Key: encodedKey, Value: encodedValue}}, Compression_NONE)
+	if err != nil {
+		return err
+	}
+	if err := o.partition.syncTo(last + 1); err != nil {
+		return err
+	}
+	o.offsets[k] = &value
+	// A commit that only this broker has could be lost if it fails.
+	return o.partition.waitReplicated(ctx, last+1)
+}
+
+// committed returns the latest offset committed by a group for a partition.
+func (o *offsetStore) committed(ctx context.Context, k offsetKey) (*OffsetCommitValue, bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.load(ctx); err != nil {
+		return nil, false, err
+	}
+	value, ok := o.offsets[k]
+	return value, ok, nil
+}
+
+// committedOffset returns the latest offset committed by a group for a
+// partition, asking the leader of the offsets topic if it's another broker.
+func (s *Server) committedOffset(ctx context.Context, k offsetKey) (*FetchCommittedOffsetReply, error) {
+	request := FetchCommittedOffsetRequest{Group: k.group, Topic: k.topic, Partition: k.partition}
+	reply, err := s.FetchCommittedOffset(ctx, &request)
+	if !IsNotLeader(err) {
+		return reply, err
+	}
+	s.offsets.partition.mu.Lock()
+	leader := s.offsets.partition.leader
+	s.offsets.partition.mu.Unlock()
+	client, err := s.client(leader)
+	if err != nil {
+		return nil, err
+	}
+	return client.FetchCommittedOffset(ctx, &request)
+}
+
+func (s *Server) CommitOffset(ctx context.Context, in *CommitOffsetRequest) (*CommitOffsetReply, error) {
+	if in.Group == "" {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Group is required")
+	}
+	if err := s.offsets.partition.checkLeader(); err != nil {
+		return nil, err
+	}
+	topic, err := s.topic(in.Topic)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := topic.Partition(in.Partition); err != nil {
+		return nil, err
+	}
+	if in.MemberId != "" {
+		if err := s.coordinator.checkOwner(in.Group, in.MemberId, in.Generation, in.Topic, in.Partition); err != nil {
+			return nil, err
+		}
+	}
+	k := offsetKey{in.Group, in.Topic, in.Partition}
+	if err := s.offsets.commit(ctx, k, in.Offset, in.Metadata); err != nil {
+		return nil, err
+	}
+	return &CommitOffsetReply{}, nil
+}
+
+func (s *Server) FetchCommittedOffset(ctx context.Context, in *FetchCommittedOffsetRequest) (*FetchCommittedOffsetReply, error) {
+	value, ok, err := s.offsets.committed(ctx, offsetKey{in.Group, in.Topic, in.Partition})
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return &FetchCommittedOffsetReply{}, nil
+	}
+	return &FetchCommittedOffsetReply{Committed: true, Offset: value.Offset, Metadata: value.Metadata}, nil
+}
@@ -0,0 +1,855 @@
+// Copyright (C) 2015 Daniel Harrison
+
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Partition is one of a topic's logs of messages, stored as a sequence of
+// message sets. Appends are made only by the partition's writer goroutine,
+// started by Start, while readers and the cleaner may run concurrently with
+// it.
+type Partition struct {
+	topic *Topic
+	id    int32
+	// name identifies the partition in logs and errors as topic/id.
+	name string
+	dir  string
+
+	// reconfigured is notified when the topic's config changes.
+	reconfigured chan struct{}
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	appends chan appendRequest
+
+	// mu guards messageSets and their offsets along with everything used to
+	// append to the partition.
+	mu           sync.Mutex
+	messageSets  []*MessageSet
+	file         *os.File
+	writer       *bufio.Writer
+	pending      uint64
+	pendingBytes int64
+	listeners    []partitionListener
+	// openTransactions maps each producer with an undecided transaction to
+	// the first offset it wrote. abortedTransactions holds every aborted
+	// transaction, for read committed readers.
+	openTransactions    map[int64]uint64
+	abortedTransactions []abortedTransaction
+	// replicas are the brokers storing the partition, including this one,
+	// and leader is the one that accepts publishes while the rest follow it.
+	// On the leader, followers tracks how far each follower has replicated
+	// and isr holds the replicas that are in sync. Elsewhere, isr is as last
+	// heard from the leader. replicated is the high watermark: everything
+	// before it is on MinInsyncReplicas replicas and can be read.
+	// isrVersion counts the leader's changes to isr within the leader epoch.
+	// shrinking is set on the leader while the controller is being asked to
+	// drop followers from isr, which keep counting towards the high watermark
+	// until it accepts.
+	// controllerEpoch is the epoch of the controller that chose the leader.
+	// target is the replicas the partition is being reassigned to, if any.
+	self                int32
+	leader              int32
+	leaderEpoch         int32
+	controllerEpoch     int32
+	followerRunning     bool
+	replicas            []int32
+	target              []int32
+	followers           map[int32]*followerState
+	isr                 map[int32]bool
+	isrVersion          int32
+	shrinking           bool
+	minInsync           int
+	replicated          uint64
+	leaderHighWatermark uint64
+
+	// checkpointMu guards checkpointed, the high watermark last written to
+	// the partition's high watermark file.
+	checkpointMu sync.Mutex
+	checkpointed uint64
+
+	// markerMu is held for reading by a transactional publish from joining
+	// the transaction until it is appended, and for writing while a
+	// transaction marker is written, so no publish lands after the marker of
+	// the transaction it joined.
+	markerMu sync.RWMutex
+
+	// fileMu is held for reading while file is being fsynced, which is done
+	// without holding mu.
+	fileMu sync.RWMutex
+	// syncMu guards synced, syncing and syncs. Offsets before synced are
+	// durable, and syncs counts the fsyncs done by syncTo.
+	syncMu   sync.Mutex
+	syncCond *sync.Cond
+	synced   uint64
+	syncing  bool
+	syncs    uint64
+}
+
+// NewPartition creates the directory for a new partition of topic along with
+// its first message set.
+func NewPartition(topic *Topic, id int32) (*Partition, error) {
+	partition := newPartition(topic, id)
+	if err := partition.store(); err != nil {
+		return nil, err
+	}
+	return partition, nil
+}
+
+// OpenPartition loads and validates the message sets of an existing partition
+// of topic and opens the last of them for appending.
+func OpenPartition(ctx context.Context, topic *Topic, id int32) (*Partition, error) {
+	partition := newPartition(topic, id)
+	files, err := ioutil.ReadDir(partition.dir)
+	if err != nil {
+		return nil, err
+	}
+	// Zero padded names mean the last message set file listed is the one that
+	// was being appended to, so any torn write would be there.
+	last := ""
+	for _, messageSetFile := range files {
+		if filepath.Ext(messageSetFile.Name()) == ".pubsub" {
+			last = messageSetFile.Name()
+		}
+	}
+	for _, messageSetFile := range files {
+		if strings.HasSuffix(messageSetFile.Name(), ".cleaned") || strings.HasSuffix(messageSetFile.Name(), ".cleaned.index") {
+			// Left behind by an interrupted compaction.
+			if err := os.Remove(path.Join(partition.dir, messageSetFile.Name())); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if filepath.Ext(messageSetFile.Name()) != ".pubsub" {
+			continue
+		}
+
+		load := NewMessageSet
+		if messageSetFile.Name() == last {
+			load = RecoverMessageSet
+		}
+		messageSet, err := load(ctx, path.Join(partition.dir, messageSetFile.Name()), topic.Config().IndexIntervalBytes)
+		if err != nil {
+			return nil, err
+		}
+		partition.messageSets = append(partition.messageSets, messageSet)
+	}
+	if len(partition.messageSets) == 0 {
+		if err := partition.roll(); err != nil {
+			return nil, err
+		}
+		return partition, nil
+	}
+	sort.Sort(MessageSetSort(partition.messageSets))
+	// Compaction may have removed the last records of a sealed message set, so
+	// its end is where the next one begins.
+	// TODO(dan): Validate that the message sets don't overlap.
+	for i := 0; i+1 < len(partition.messageSets); i++ {
+		partition.messageSets[i].offsetEnd = partition.messageSets[i+1].offsetBegin
+	}
+	for _, ms := range partition.messageSets {
+		for _, batch := range ms.producerBatches {
+			partition.trackTransaction(batch)
+		}
+	}
+
+	active := partition.active()
+	// TODO(dan): Persist when a message set was created so time based rolling
+	// survives restarts.
+	active.created = time.Now()
+	partition.file, err = os.OpenFile(active.path, os.O_WRONLY|os.O_APPEND, 0770)
+	if err != nil {
+		return nil, err
+	}
+	partition.writer = bufio.NewWriter(partition.file)
+	partition.synced = partition.nextOffset()
+	// Partitions from before replication have no checkpoint, and everything
+	// in them was committed once written.
+	highWatermark, ok, err := readHighWatermark(partition.dir)
+	if err != nil {
+		return nil, err
+	}
+	partition.replicated = partition.logEndOffset()
+	if ok && highWatermark < partition.replicated {
+		partition.replicated = highWatermark
+	}
+	partition.checkpointed = highWatermark
+	return partition, nil
+}
+
+func newPartition(topic *Topic, id int32) *Partition {
+	partition := Partition{
+		topic:        topic,
+		id:           id,
+		name:         fmt.Sprintf("%s/%d", topic.name, id),
+		dir:          path.Join(topic.dir, strconv.Itoa(int(id))),
+		reconfigured: make(chan struct{}, 1),
+
+		openTransactions: make(map[int64]uint64),
+		replicas:         []int32{0},
+		followers:        make(map[int32]*followerState),
+		isr:              map[int32]bool{0: true},
+		minInsync:        1,
+	}
+	partition.syncCond = sync.NewCond(&partition.syncMu)
+	return &partition
+}
+
+// Config returns the current settings of the partition's topic.
+func (p *Partition) Config() TopicConfig {
+	return p.topic.Config()
+}
+
+// Start runs the partition's writer and periodic sync goroutines until ctx is
+// done or the partition is closed.
+func (p *Partition) Start(ctx context.Context) {
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	p.appends = make(chan appendRequest)
+	go p.write()
+	go p.syncPeriodically(p.ctx)
+	go p.checkpointPeriodically(p.ctx)
+}
+
+// Close stops the partition's goroutines, checkpoints its high watermark and
+// closes its files.
+func (p *Partition) Close() error {
+	if p.cancel != nil {
+		p.cancel()
+	}
+	if err := p.checkpointHighWatermark(); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.stored() {
+		return nil
+	}
+	if err := p.writer.Flush(); err != nil {
+		return err
+	}
+	if err := p.active().index.Close(); err != nil {
+		return err
+	}
+	p.fileMu.Lock()
+	defer p.fileMu.Unlock()
+	return p.file.Close()
+}
+
+// active returns the message set currently being appended to.
+func (p *Partition) active() *MessageSet {
+	return p.messageSets[len(p.messageSets)-1]
+}
+
+// earliestOffset returns the first offset still stored in the partition.
+func (p *Partition) earliestOffset() uint64 {
+	if len(p.messageSets) == 0 {
+		return 0
+	}
+	return p.messageSets[0].offsetBegin
+}
+
+// nextOffset returns the offset that will be assigned to the next message
+// appended to the partition.
+func (p *Partition) nextOffset() uint64 {
+	if len(p.messageSets) == 0 {
+		return 0
+	}
+	return p.active().offsetEnd + p.pending
+}
+
+// logEndOffset returns one past the last offset that has been flushed to the
+// log. p.mu must be held.
+func (p *Partition) logEndOffset() uint64 {
+	if len(p.messageSets) == 0 {
+		return 0
+	}
+	return p.active().offsetEnd
+}
+
+// highWatermark returns one past the last offset that has been replicated and
+// so can be read. p.mu must be held.
+func (p *Partition) highWatermark() uint64 {
+	return p.replicated
+}
+
+// offsetForTimestamp returns the first offset with a timestamp at or after
+// timestamp, or the high watermark if there isn't one yet.
+func (p *Partition) offsetForTimestamp(ctx context.Context, timestamp int64) (uint64, error) {
+	p.mu.Lock()
+	start, found := uint64(0), false
+	for _, ms := range p.messageSets {
+		if ms.timeIndex.maxTimestamp >= timestamp {
+			start, found = ms.offsetBegin+uint64(ms.timeIndex.Lookup(timestamp)), true
+			break
+		}
+	}
+	highWatermark := p.highWatermark()
+	p.mu.Unlock()
+	if !found {
+		return highWatermark, nil
+	}
+
+	r, err := NewPartitionReader(ctx, p, start)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	for {
+		batch, err := r.TryReadBatch()
+		if err != nil {
+			return 0, err
+		} else if batch == nil {
+			return r.offset, nil
+		}
+		if batch.MaxTimestamp < timestamp {
+			continue
+		}
+		messages, err := DecodeRecordBatch(batch)
+		if err != nil {
+			return 0, err
+		}
+		for _, message := range messages {
+			if message.Timestamp >= timestamp {
+				return message.Offset, nil
+			}
+		}
+	}
+}
+
+// messageSetAfter returns the message set following ms or nil if ms is the
+// active one.
+func (p *Partition) messageSetAfter(ms *MessageSet) *MessageSet {
+	for _, messageSet := range p.messageSets {
+		if messageSet.offsetBegin > ms.offsetBegin {
+			return messageSet
+		}
+	}
+	return nil
+}
+
+// Append assigns messages the next offsets in the partition and writes them to
+// the active message set as one batch, rolling over to a new message set first
+// if needed. They are not visible to readers until the next Flush. p.mu must be
+// held.
+func (p *Partition) Append(producer batchProducer, messages []*Message, compression Compression) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	now := timestamp(time.Now())
+	logAppendTime := p.Config().TimestampType == TimestampLogAppendTime
+	for i, message := range messages {
+		message.Offset = p.nextOffset() + uint64(i)
+		if message.Timestamp == 0 || logAppendTime {
+			message.Timestamp = now
+		}
+	}
+	batch, err := NewRecordBatch(messages, compression)
+	if err != nil {
+		return err
+	}
+	batch.ProducerId, batch.Sequence = producer.id, producer.sequence
+	batch.Transactional, batch.Control = producer.transactional, producer.control
+	return p.appendBatch(batch)
+}
+
+// appendBatch writes a batch starting at or after the next offset to the
+// active message set. p.mu must be held.
+func (p *Partition) appendBatch(batch *RecordBatch) error {
+	if next := p.nextOffset(); batch.BaseOffset < next {
+		return errors.New(fmt.Sprintf("Batch at offset %d overlaps %s, which ends at %d", batch.BaseOffset, p.name, next))
+	}
+	encoded, err := proto.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	if p.shouldRoll(recordSize(encoded)) {
+		if err := p.roll(); err != nil {
+			return err
+		}
+	}
+
+	active := p.active()
+	position := active.size + p.pendingBytes
+	interval := p.Config().IndexIntervalBytes
+	indexed := interval > 0 && position-active.index.lastPosition() >= interval
+	if indexed {
+		if err := active.index.Append(batch.BaseOffset-active.offsetBegin, position); err != nil {
+			return err
+		}
+	}
+	active.timeIndex.Add(uint32(batch.BaseOffset-active.offsetBegin), batch, indexed)
+	n, err := writeRecord(p.writer, encoded)
+	p.pendingBytes += int64(n)
+	if err != nil {
+		return err
+	}
+	// Replicated batches from a compacted log can skip offsets.
+	p.pending += batch.LastOffset + 1 - p.nextOffset()
+	p.trackTransaction(batch)
+	return nil
+}
+
+// Flush writes out any buffered messages and makes them visible to readers.
+// p.mu must be held.
+func (p *Partition) Flush() error {
+	if !p.stored() {
+		return nil
+	}
+	if err := p.writer.Flush(); err != nil {
+		return err
+	}
+	if p.pending > 0 {
+		active := p.active()
+		active.offsetEnd += p.pending
+		active.size += p.pendingBytes
+		p.pending = 0
+		p.pendingBytes = 0
+		p.broadcast(int64(active.offsetEnd))
+	}
+	p.updateHighWatermark()
+	return nil
+}
+
+// shouldRoll returns whether a record of the given size should be written to
+// a new message set instead of the active one.
+func (p *Partition) shouldRoll(size int64) bool {
+	active := p.active()
+	activeSize := active.size + p.pendingBytes
+	if activeSize == 0 {
+		return false
+	}
+	config := p.Config()
+	if activeSize+size > config.SegmentBytes {
+		return true
+	}
+	if config.SegmentAge > 0 && time.Since(active.created) >= config.SegmentAge {
+		return true
+	}
+	return false
+}
+
+// roll seals the active message set, if any, and starts a new one named after
+// the next offset.
+func (p *Partition) roll() error {
+	if p.writer != nil {
+		if err := p.Flush(); err != nil {
+			return err
+		}
+	}
+
+	offset := p.nextOffset()
+	messageSetPath := path.Join(p.dir, fmt.Sprintf("%012d.pubsub", offset))
+	f, err := os.OpenFile(messageSetPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0770)
+	if err != nil {
+		return err
+	}
+	index, err := NewIndex(indexPath(messageSetPath))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	log.Print("[", p.name, "] Created ", messageSetPath)
+
+	if p.file != nil {
+		if err := p.active().index.Close(); err != nil {
+			f.Close()
+			index.Close()
+			return err
+		}
+		// Sealed message sets are always durable.
+		p.fileMu.Lock()
+		err := p.file.Sync()
+		if err == nil {
+			err = p.file.Close()
+		}
+		p.fileMu.Unlock()
+		if err != nil {
+			f.Close()
+			index.Close()
+			return err
+		}
+		p.markSynced(offset)
+	}
+	messageSet := MessageSet{path: messageSetPath, offsetBegin: offset, offsetEnd: offset, created: time.Now(), index: index}
+	p.messageSets = append(p.messageSets, &messageSet)
+	p.file = f
+	p.writer = bufio.NewWriter(f)
+	return nil
+}
+
+// stored returns whether this broker stores the partition's log. Every broker
+// knows about every partition, but only its replicas store it. p.mu must be
+// held.
+func (p *Partition) stored() bool {
+	return len(p.messageSets) > 0
+}
+
+// store creates the directory and first message set of a partition that this
+// broker doesn't store yet. p.mu must be held.
+func (p *Partition) store() error {
+	if err := os.MkdirAll(p.dir, 0770); err != nil {
+		return err
+	}
+	if err := writeHighWatermark(p.dir, 0); err != nil {
+		return err
+	}
+	return p.roll()
+}
+
+// drop deletes everything this broker stores of the partition, including its
+// directory, once it's no longer one of the replicas. p.mu must be held.
+func (p *Partition) drop() error {
+	if !p.stored() {
+		return nil
+	}
+	// Holding fileMu keeps syncTo from using the file while it's closed.
+	p.fileMu.Lock()
+	defer p.fileMu.Unlock()
+	if err := p.active().index.Close(); err != nil {
+		return err
+	}
+	if err := p.file.Close(); err != nil {
+		return err
+	}
+	p.topic.forgetProducers(p.id, 0)
+	p.messageSets, p.file, p.writer, p.pending, p.pendingBytes = nil, nil, nil, 0, 0
+	p.openTransactions, p.abortedTransactions = make(map[int64]uint64), nil
+	p.replicated, p.leaderHighWatermark = 0, 0
+	p.syncMu.Lock()
+	p.synced = 0
+	p.syncMu.Unlock()
+	return os.RemoveAll(p.dir)
+}
+
+// truncate drops everything from offset on, so the partition can replicate
+// a new leader's log from there. Message sets starting at or after offset are
+// deleted, unless it is the first. p.mu must be held.
+// TODO(dan): Reopen committed transactions whose markers are truncated.
+func (p *Partition) truncate(ctx context.Context, offset uint64) error {
+	if offset >= p.nextOffset() {
+		return nil
+	}
+	if err := p.Flush(); err != nil {
+		return err
+	}
+	log.Print("[", p.name, "] Truncating from ", p.logEndOffset(), " to ", offset)
+	// Holding fileMu keeps syncTo from using the file while it's replaced.
+	p.fileMu.Lock()
+	defer p.fileMu.Unlock()
+	if err := p.file.Close(); err != nil {
+		return err
+	}
+	for len(p.messageSets) > 1 && p.active().offsetBegin >= offset {
+		if err := p.active().remove(); err != nil {
+			return err
+		}
+		p.messageSets = p.messageSets[:len(p.messageSets)-1]
+	}
+
+	p.topic.forgetProducers(p.id, offset)
+
+	active := p.active()
+	size := int64(-1)
+	_, err := active.scan(ctx, func(position int64, batch *RecordBatch) error {
+		if size < 0 && batch.LastOffset >= offset {
+			size = position
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if size >= 0 {
+		if err := active.index.Close(); err != nil {
+			return err
+		}
+		if err := os.Truncate(active.path, size); err != nil {
+			return err
+		}
+		truncated, err := NewMessageSet(ctx, active.path, p.Config().IndexIntervalBytes)
+		if err != nil {
+			return err
+		}
+		truncated.created = active.created
+		p.messageSets[len(p.messageSets)-1] = truncated
+	}
+	if p.file, err = os.OpenFile(active.path, os.O_WRONLY|os.O_APPEND, 0770); err != nil {
+		return err
+	}
+	p.writer = bufio.NewWriter(p.file)
+
+	end := p.logEndOffset()
+	for producerID, first := range p.openTransactions {
+		if first >= end {
+			delete(p.openTransactions, producerID)
+		}
+	}
+	aborted := p.abortedTransactions[:0]
+	for _, txn := range p.abortedTransactions {
+		if txn.marker < end {
+			aborted = append(aborted, txn)
+		} else if txn.first < end {
+			p.openTransactions[txn.producerID] = txn.first
+		}
+	}
+	p.abortedTransactions = aborted
+	if p.replicated > end {
+		p.replicated = end
+	}
+	p.syncMu.Lock()
+	if p.synced > end {
+		p.synced = end
+	}
+	p.syncMu.Unlock()
+	return nil
+}
+
+// Listen returns a channel that is notified whenever messages are flushed to
+// the partition, until ctx is done.
+func (p *Partition) Listen(ctx context.Context) chan int64 {
+	ping := make(chan int64, 1)
+	p.mu.Lock()
+	p.listeners = append(p.listeners, partitionListener{ctx, ping})
+	p.mu.Unlock()
+	return ping
+}
+
+// broadcast notifies every listener. p.mu must be held.
+func (p *Partition) broadcast(n int64) {
+	listeners := p.listeners[:0]
+	for _, listener := range p.listeners {
+		select {
+		case <-listener.ctx.Done():
+			log.Print("[", p.name, "] Removing subscriber from notifications")
+			continue
+		default:
+		}
+		// A pending notification is as good as a new one, so never block the
+		// writer on a slow listener.
+		select {
+		case listener.notify <- n:
+		default:
+		}
+		listeners = append(listeners, listener)
+	}
+	p.listeners = listeners
+}
+
+// outOfRange returns the error for a read at an offset that is no longer
+// stored because retention deleted it.
+func outOfRange(partition string, offset uint64, earliest uint64) error {
+	return grpc.Errorf(codes.OutOfRange, "Offset %d of partition %s has been deleted, earliest offset is at least %d", offset, partition, earliest)
+}
+
+type partitionListener struct {
+	ctx    context.Context
+	notify chan int64
+}
+
+// PartitionReader reads messages from a partition in offset order, following it
+// from one message set into the next as they are rolled. Offsets may be missing
+// from compacted message sets, so it tracks the next offset it wants and skips
+// any records before it.
+type PartitionReader struct {
+	ctx        context.Context
+	partition  *Partition
+	notify     chan int64
+	messageSet *MessageSet
+	f          *os.File
+	cancel     context.CancelFunc
+	r          *MessageSetReader
+	offset     uint64
+	// messages holds what is left of the last batch read by ReadMessage.
+	messages []*Message
+	// readCommitted hides transactional batches until their transaction is
+	// committed and drops them if it is aborted.
+	readCommitted bool
+	// replica reads everything flushed to the log, including control
+	// batches, rather than stopping at the high watermark.
+	replica bool
+}
+
+func NewPartitionReader(ctx context.Context, partition *Partition, offset uint64) (*PartitionReader, error) {
+	partition.mu.Lock()
+	if len(partition.messageSets) == 0 {
+		partition.mu.Unlock()
+		return nil, errors.New(fmt.Sprintf("INTERNAL ERROR: No messagesets for partition: %s offset: %d", partition.name, offset))
+	}
+	if earliest := partition.earliestOffset(); offset < earliest {
+		partition.mu.Unlock()
+		return nil, outOfRange(partition.name, offset, earliest)
+	}
+	messageSet := partition.messageSets[0]
+	for _, ms := range partition.messageSets {
+		if ms.offsetBegin <= offset {
+			messageSet = ms
+		} else {
+			break
+		}
+	}
+	partition.mu.Unlock()
+
+	// Anything flushed between the lookup and listening is found by the
+	// size check in ReadBatch before it ever waits.
+	r := PartitionReader{ctx: ctx, partition: partition, notify: partition.Listen(ctx), offset: offset}
+	if err := r.open(messageSet); os.IsNotExist(err) {
+		// Deleted by retention since we looked it up.
+		return nil, outOfRange(partition.name, offset, messageSet.offsetEnd)
+	} else if err != nil {
+		return nil, err
+	}
+	if offset > messageSet.offsetBegin {
+		indexed, position := messageSet.index.Lookup(uint32(offset - messageSet.offsetBegin))
+		if err := r.r.SeekRecord(int64(position), messageSet.offsetBegin+uint64(indexed)); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	return &r, nil
+}
+
+// ReadMessage returns the next message in the partition, blocking until one is
+// published if necessary.
+func (r *PartitionReader) ReadMessage() (*Message, error) {
+	for len(r.messages) == 0 {
+		batch, err := r.ReadBatch()
+		if err != nil {
+			return nil, err
+		}
+		if r.messages, err = DecodeRecordBatch(batch); err != nil {
+			return nil, err
+		}
+	}
+	message := r.messages[0]
+	r.messages = r.messages[1:]
+	return message, nil
+}
+
+// ReadBatch returns the next batch of messages in the partition, blocking until
+// one is published if necessary. Batches are returned still compressed unless
+// they contain offsets before the one the reader was started at. Transaction
+// control batches are skipped, and nothing past the high watermark is read.
+func (r *PartitionReader) ReadBatch() (*RecordBatch, error) {
+	return r.readBatch(true)
+}
+
+// TryReadBatch is ReadBatch, except it returns a nil batch instead of waiting
+// when everything published so far has been read.
+func (r *PartitionReader) TryReadBatch() (*RecordBatch, error) {
+	return r.readBatch(false)
+}
+
+func (r *PartitionReader) readBatch(wait bool) (*RecordBatch, error) {
+	if len(r.messages) > 0 {
+		messages := r.messages
+		r.messages = nil
+		return NewRecordBatch(messages, Compression_NONE)
+	}
+
+	for {
+		r.partition.mu.Lock()
+		size := r.messageSet.size
+		next := r.partition.messageSetAfter(r.messageSet)
+		// Nothing past the first offset of an undecided transaction can be
+		// read committed.
+		limit := r.partition.highWatermark()
+		if r.readCommitted {
+			limit = r.partition.lastStableOffset()
+		}
+		visible := r.replica || r.offset < limit
+		leader := r.partition.leader
+		led := leader == r.partition.self
+		r.partition.mu.Unlock()
+		if !led {
+			return nil, notLeader(r.partition.name, leader)
+		}
+
+		if r.r.r.Offset < size && visible {
+			batch, err := r.r.ReadBatch()
+			if err != nil {
+				return nil, err
+			}
+			if batch.LastOffset < r.offset {
+				continue
+			}
+			if batch.Control != ControlType_DATA && !r.replica {
+				r.offset = batch.LastOffset + 1
+				continue
+			}
+			if r.readCommitted && batch.Transactional && r.partition.aborted(batch.ProducerId, batch.BaseOffset) {
+				r.offset = batch.LastOffset + 1
+				continue
+			}
+			if batch.BaseOffset < r.offset {
+				if batch, err = trimRecordBatch(batch, r.offset); err != nil {
+					return nil, err
+				}
+			}
+			r.offset = batch.LastOffset + 1
+			return batch, nil
+		}
+		if next != nil && visible {
+			if err := r.open(next); os.IsNotExist(err) {
+				return nil, outOfRange(r.partition.name, r.offset, next.offsetEnd)
+			} else if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !wait {
+			return nil, nil
+		}
+		select {
+		case <-r.notify:
+		case <-r.ctx.Done():
+			return nil, r.ctx.Err()
+		case <-r.partition.ctx.Done():
+			return nil, grpc.Errorf(codes.NotFound, "Partition closed: %s", r.partition.name)
+		}
+	}
+}
+
+func (r *PartitionReader) open(messageSet *MessageSet) error {
+	f, err := os.Open(messageSet.path)
+	if err != nil {
+		return err
+	}
+	r.Close()
+
+	ctx, cancel := context.WithCancel(r.ctx)
+	r.messageSet = messageSet
+	r.f = f
+	r.cancel = cancel
+	r.r = NewMessageSetReader(ctx, f, nil, messageSet.offsetBegin)
+	return nil
+}
+
+func (r *PartitionReader) Close() error {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	if r.f != nil {
+		return r.f.Close()
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+// Copyright (C) 2015 Daniel Harrison
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// batchProducer identifies the idempotent producer request a batch was
+// appended for and whether it is part of, or ends, a transaction. The zero
+// value is a batch published without a producer id.
+type batchProducer struct {
+	id            int64
+	sequence      int32
+	transactional bool
+	control       ControlType
+}
+
+// producerState is the last request an idempotent producer published to a
+// topic and the offsets it was written at.
+type producerState struct {
+	sequence int32
+	offsets  []*PartitionOffsets
+	// pending is set until the request has been appended and its offsets are
+	// known.
+	pending bool
+}
+
+// addBatch folds a batch read from the log into the producer states.
+func addBatch(producers map[int64]*producerState, partition int32, batch *RecordBatch) {
+	if batch.ProducerId == 0 || batch.Control != ControlType_DATA {
+		return
+	}
+	offsets := &PartitionOffsets{Partition: partition, BaseOffset: batch.BaseOffset, LastOffset: batch.LastOffset}
+	state, ok := producers[batch.ProducerId]
+	if !ok || batch.Sequence > state.sequence {
+		producers[batch.ProducerId] = &producerState{sequence: batch.Sequence, offsets: []*PartitionOffsets{offsets}}
+	} else if batch.Sequence == state.sequence {
+		state.offsets = append(state.offsets, offsets)
+	}
+}
+
+// recoverProducers rebuilds the topic's producer states from the batches
+// found while loading its message sets.
+func (t *Topic) recoverProducers() {
+	t.producers = make(map[int64]*producerState)
+	for _, partition := range t.partitions {
+		for _, ms := range partition.messageSets {
+			for _, batch := range ms.producerBatches {
+				addBatch(t.producers, partition.id, batch)
+			}
+			ms.producerBatches = nil
+		}
+	}
+}
+
+// forgetProducers drops the states of producers whose last request was
+// written to a partition at or after offset, which it is being truncated to,
+// so a retry is written again rather than answered with offsets that are
+// gone.
+func (t *Topic) forgetProducers(partition int32, offset uint64) {
+	t.producersMu.Lock()
+	defer t.producersMu.Unlock()
+	for id, state := range t.producers {
+		for _, offsets := range state.offsets {
+			if offsets.Partition == partition && offsets.LastOffset >= offset {
+				delete(t.producers, id)
+				break
+			}
+		}
+	}
+}
+
+// checkSequence returns the reply to resend if sequence is a retry of the last
+// request from the producer, or an error if it is an older duplicate or skips
+// ahead. t.producersMu must be held.
+func (t *Topic) checkSequence(producerID int64, sequence int32) (*PublishMultiReply, error) {
+	state, ok := t.producers[producerID]
+	if !ok {
+		// Either new or its batches have since been deleted by retention.
+		return nil, nil
+	}
+	switch {
+	case state.pending && sequence >= state.sequence:
+		return nil, grpc.Errorf(codes.Unavailable, "Sequence %d from producer %d is still being published", state.sequence, producerID)
+	case sequence == state.sequence:
+		reply := PublishMultiReply{Partitions: state.offsets}
+		if len(reply.Partitions) == 1 {
+			reply.BaseOffset = reply.Partitions[0].BaseOffset
+			reply.LastOffset = reply.Partitions[0].LastOffset
+		}
+		return &reply, nil
+	case sequence < state.sequence:
+		return nil, grpc.Errorf(codes.AlreadyExists, "Duplicate sequence %d from producer %d, last was %d", sequence, producerID, state.sequence)
+	case sequence > state.sequence+1:
+		return nil, grpc.Errorf(codes.FailedPrecondition, "Out of order sequence %d from producer %d, expected %d", sequence, producerID, state.sequence+1)
+	}
+	return nil, nil
+}
+
+// beginSequence checks the sequence of a request from an idempotent producer
+// like checkSequence and records it as pending, turning away its retries and
+// later requests until it is done. The returned function is called with the
+// offsets the request was appended at once it is, or with nil if it failed
+// without being appended, which forgets it.
+func (t *Topic) beginSequence(producerID int64, sequence int32) (*PublishMultiReply, func([]*PartitionOffsets), error) {
+	t.producersMu.Lock()
+	defer t.producersMu.Unlock()
+	if duplicate, err := t.checkSequence(producerID, sequence); duplicate != nil || err != nil {
+		return duplicate, nil, err
+	}
+	previous, existed := t.producers[producerID]
+	state := &producerState{sequence: sequence, pending: true}
+	t.producers[producerID] = state
+	return nil, func(offsets []*PartitionOffsets) {
+		t.producersMu.Lock()
+		defer t.producersMu.Unlock()
+		switch {
+		case offsets != nil:
+			state.offsets, state.pending = offsets, false
+		case existed:
+			t.producers[producerID] = previous
+		default:
+			delete(t.producers, producerID)
+		}
+	}, nil
+}
+
+// InitProducerId hands out a producer id. Ids are random, so ones handed out
+// before a restart aren't reused without the broker having to remember them.
+func (s *Server) InitProducerId(ctx context.Context, in *InitProducerIdRequest) (*InitProducerIdReply, error) {
+	buf := make([]byte, 8)
+	for {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		// Zero means no producer id and negative ids are left for later use.
+		if id := int64(binary.LittleEndian.Uint64(buf) >> 1); id != 0 {
+			return &InitProducerIdReply{ProducerId: id}, nil
+		}
+	}
+}
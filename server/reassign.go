@@ -0,0 +1,343 @@
+// Copyright (C) 2015 Daniel Harrison
+
+package server
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// throttle limits the rate bytes are sent at, letting through bursts of up to
+// a second's worth.
+type throttle struct {
+	rate int64
+
+	mu sync.Mutex
+	// allowed is when everything sent so far is within the rate.
+	allowed time.Time
+}
+
+// wait blocks until bytes more can be sent without going over the rate.
+func (t *throttle) wait(ctx context.Context, bytes int64) error {
+	if t.rate <= 0 {
+		return nil
+	}
+	t.mu.Lock()
+	now := time.Now()
+	if burst := now.Add(-time.Second); t.allowed.Before(burst) {
+		t.allowed = burst
+	}
+	t.allowed = t.allowed.Add(time.Duration(bytes * int64(time.Second) / t.rate))
+	delay := t.allowed.Sub(now)
+	t.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// start begins moving each partition to its target replicas, replacing any
+// reassignment already in progress for it. The move happens a step at a time,
+// each in a new leader epoch: the new replicas are added, the leader is moved
+// to one of them once they're all in sync if it isn't one already, and then
+// the old replicas are removed. Every step's state carries the target, so
+// every broker persists it and whichever is the controller next carries on.
+func (c *controller) start(targets map[*Partition][]int32) error {
+	topics := make(map[*Topic]bool)
+	for partition, target := range targets {
+		partition.mu.Lock()
+		log.Print("[", partition.name, "] Reassigning from brokers ", partition.replicas, " to ", target)
+		partition.target = target
+		partition.mu.Unlock()
+		topics[partition.topic] = true
+	}
+	for topic := range topics {
+		if err := c.server.saveReplicas(topic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reassign takes the next step of every reassignment whose last step has
+// reached the partition's leader, and returns the partitions' new states.
+func (c *controller) reassign() []*PartitionState {
+	var changed []*PartitionState
+	for _, topic := range c.server.allTopics() {
+		for _, partition := range topic.partitions {
+			if state := c.reassignStep(partition); state != nil {
+				changed = append(changed, state)
+			}
+		}
+	}
+	return changed
+}
+
+// reassignStep takes the next step of moving partition, if it's being moved
+// and isn't waiting on anything, and returns its new state.
+func (c *controller) reassignStep(partition *Partition) *PartitionState {
+	c.mu.Lock()
+	_, unconfirmed := c.unconfirmed[partition.name]
+	c.mu.Unlock()
+	partition.mu.Lock()
+	current, target := partition.state(), partition.target
+	partition.mu.Unlock()
+	if unconfirmed || target == nil {
+		return nil
+	}
+	state, done := c.nextStep(current, target)
+	if done {
+		// Already there when the reassignment started, so no step told the
+		// brokers it's finished.
+		log.Print("[", partition.name, "] Finished reassigning to brokers ", target)
+		partition.mu.Lock()
+		if fmt.Sprint(partition.target) == fmt.Sprint(target) {
+			partition.target = nil
+		}
+		partition.mu.Unlock()
+		if err := c.server.saveReplicas(partition.topic); err != nil {
+			log.Print("[", partition.name, "] Failed to save the finished reassignment: ", err)
+		}
+		return nil
+	}
+	if state == nil {
+		return nil
+	}
+	if err := c.createOnReplicas(partition.topic, state.Replicas, current.Replicas); err != nil {
+		log.Print("[", partition.name, "] Failed to add replicas: ", err)
+		return nil
+	}
+	if !c.change(partition, state) {
+		return nil
+	}
+	return state
+}
+
+// nextStep returns the state that takes a partition the next step towards
+// target, nil if it has to wait for the new replicas to catch up first, or
+// done if it's there.
+func (c *controller) nextStep(current *PartitionState, target []int32) (*PartitionState, bool) {
+	c.mu.Lock()
+	epoch := c.epoch
+	c.mu.Unlock()
+	next := PartitionState{
+		Topic:           current.Topic,
+		Partition:       current.Partition,
+		Leader:          current.Leader,
+		LeaderEpoch:     current.LeaderEpoch + 1,
+		ControllerEpoch: epoch,
+		Isr:             current.Isr,
+		Replicas:        current.Replicas,
+		TargetReplicas:  target,
+	}
+	missing := func(brokers []int32) bool {
+		for _, id := range target {
+			if !containsBroker(brokers, id) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case missing(current.Replicas):
+		next.Replicas = append([]int32(nil), current.Replicas...)
+		for _, id := range target {
+			if !containsBroker(next.Replicas, id) {
+				next.Replicas = append(next.Replicas, id)
+			}
+		}
+	case missing(current.Isr):
+		return nil, false
+	case !containsBroker(target, current.Leader):
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		next.Leader = -1
+		for _, id := range target {
+			if c.alive[id] {
+				next.Leader = id
+				break
+			}
+		}
+		if next.Leader < 0 {
+			return nil, false
+		}
+	case fmt.Sprint(current.Replicas) != fmt.Sprint(target):
+		next.Replicas, next.Isr = target, nil
+		for _, id := range current.Isr {
+			if containsBroker(target, id) {
+				next.Isr = append(next.Isr, id)
+			}
+		}
+	default:
+		return nil, true
+	}
+	return &next, false
+}
+
+// createOnReplicas creates a topic on the brokers in replicas that it's being
+// reassigned to, which may not have it if they joined the cluster after it was
+// created. current are the partition's replicas before the reassignment.
+func (c *controller) createOnReplicas(topic *Topic, replicas []int32, current []int32) error {
+	topic.configMu.RLock()
+	request := CreateTopicRequest{Topic: topic.name, Config: topic.overrides, Partitions: int32(len(topic.partitions))}
+	topic.configMu.RUnlock()
+	for _, partition := range topic.partitions {
+		partition.mu.Lock()
+		request.Replicas = append(request.Replicas, &PartitionReplicas{Brokers: partition.replicas})
+		partition.mu.Unlock()
+	}
+	for _, id := range replicas {
+		if containsBroker(current, id) || id == c.server.config.BrokerID {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(c.server.ctx, c.server.config.BrokerTimeout)
+		client, err := c.server.client(id)
+		if err == nil {
+			_, err = client.CreateTopic(ctx, &request)
+		}
+		cancel()
+		if err != nil && grpc.Code(err) != codes.AlreadyExists {
+			return err
+		}
+	}
+	return nil
+}
+
+// decommission returns new replicas for every partition stored by any of
+// brokers, replacing each of them with the remaining broker storing the
+// fewest partitions.
+func (c *controller) decommission(brokers []int32) (map[*Partition][]int32, error) {
+	var remaining []int32
+	load := make(map[int32]int)
+	for id := range c.server.config.Brokers {
+		if !containsBroker(brokers, id) {
+			remaining = append(remaining, id)
+			load[id] = 0
+		}
+	}
+	sort.Sort(int32Slice(remaining))
+
+	// Going through topics in order makes the moves repeatable.
+	topics := make(map[string]*Topic)
+	var names []string
+	for _, topic := range c.server.allTopics() {
+		if !internalTopic(topic.name) {
+			topics[topic.name] = topic
+			names = append(names, topic.name)
+		}
+	}
+	sort.Strings(names)
+	replicas := make(map[*Partition][]int32)
+	var partitions []*Partition
+	for _, name := range names {
+		for _, partition := range topics[name].partitions {
+			partition.mu.Lock()
+			replicas[partition] = partition.replicas
+			partition.mu.Unlock()
+			partitions = append(partitions, partition)
+			for _, id := range replicas[partition] {
+				if _, ok := load[id]; ok {
+					load[id]++
+				}
+			}
+		}
+	}
+
+	targets := make(map[*Partition][]int32)
+	for _, partition := range partitions {
+		current := replicas[partition]
+		var target []int32
+		moved := false
+		for _, id := range current {
+			if !containsBroker(brokers, id) {
+				target = append(target, id)
+				continue
+			}
+			replacement := int32(-1)
+			for _, candidate := range remaining {
+				if containsBroker(current, candidate) || containsBroker(target, candidate) {
+					continue
+				}
+				if replacement < 0 || load[candidate] < load[replacement] {
+					replacement = candidate
+				}
+			}
+			if replacement < 0 {
+				return nil, grpc.Errorf(codes.FailedPrecondition, "Not enough brokers left to move %s off broker %d", partition.name, id)
+			}
+			target = append(target, replacement)
+			load[replacement]++
+			moved = true
+		}
+		if moved {
+			targets[partition] = target
+		}
+	}
+	return targets, nil
+}
+
+func (s *Server) ReassignPartitions(ctx context.Context, in *ReassignPartitionsRequest) (*ReassignPartitionsReply, error) {
+	if len(s.config.Brokers) == 0 {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "Broker %d isn't part of a cluster", s.config.BrokerID)
+	}
+	if ok, _ := s.controller.controlling(); !ok {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "Not the controller, broker %d is", s.controller.id())
+	}
+	for _, id := range in.Decommission {
+		if _, ok := s.config.Brokers[id]; !ok {
+			return nil, grpc.Errorf(codes.InvalidArgument, "No broker %d", id)
+		}
+	}
+	if len(in.Decommission) > 0 {
+		targets, err := s.controller.decommission(in.Decommission)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.controller.start(targets); err != nil {
+			return nil, err
+		}
+		return &ReassignPartitionsReply{}, nil
+	}
+
+	if internalTopic(in.Topic) {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Internal topic %s can't be reassigned", in.Topic)
+	}
+	topic, err := s.topic(in.Topic)
+	if err != nil {
+		return nil, err
+	}
+	if len(in.Replicas) > len(topic.partitions) {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Got replicas for %d partitions but topic %s has %d", len(in.Replicas), topic.name, len(topic.partitions))
+	}
+	targets := make(map[*Partition][]int32)
+	for id, replicas := range in.GetReplicas() {
+		if len(replicas.Brokers) == 0 {
+			continue
+		}
+		for i, broker := range replicas.Brokers {
+			if _, ok := s.config.Brokers[broker]; !ok {
+				return nil, grpc.Errorf(codes.InvalidArgument, "No broker %d", broker)
+			}
+			if containsBroker(replicas.Brokers[:i], broker) {
+				return nil, grpc.Errorf(codes.InvalidArgument, "Broker %d is listed twice for partition %d", broker, id)
+			}
+		}
+		targets[topic.partitions[id]] = replicas.Brokers
+	}
+	if err := s.controller.start(targets); err != nil {
+		return nil, err
+	}
+	return &ReassignPartitionsReply{}, nil
+}
@@ -0,0 +1,1032 @@
+// Copyright (C) 2015 Daniel Harrison
+
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// replicasFile is the name of the file in a topic's directory listing the
+	// brokers that store each of its partitions, one line of comma separated
+	// broker ids per partition with the leader first. Topics without one are
+	// stored only by the broker they're on.
+	replicasFile = "replicas"
+	// reassignmentsFile is the name of the file in a topic's directory
+	// listing the brokers each of its partitions is being reassigned to, in
+	// the same format, with an empty line for partitions that aren't moving.
+	reassignmentsFile = "reassignments"
+	// leaderFile is the name of the file in a partition's directory holding
+	// the leader, leader epoch and controller epoch it last heard of, once
+	// the first leader has been replaced.
+	leaderFile = "leader"
+	// highWatermarkFile is the name of the file in a partition's directory
+	// holding its high watermark as of the last checkpoint. After a restart,
+	// only what's before it is known to have been replicated.
+	highWatermarkFile = "high-watermark"
+	// highWatermarkInterval is how often each partition's high watermark is
+	// checkpointed.
+	highWatermarkInterval = 5 * time.Second
+
+	// replicaFetchWait is how long the leader holds a Replicate request open
+	// waiting for something new to send.
+	replicaFetchWait = 500 * time.Millisecond
+	// replicaRetryDelay is how long a follower waits to try again after
+	// failing to replicate.
+	replicaRetryDelay = time.Second
+)
+
+type followerState struct {
+	// logEnd is one past the last offset in the follower's log as of its
+	// last Replicate request. target is where the leader's log ended at that
+	// request, which the follower has caught up with once it reaches it.
+	logEnd   uint64
+	target   uint64
+	caughtUp time.Time
+}
+
+// assignReplicas picks the brokers to store each partition of a new topic,
+// starting each partition at the next broker in turn so leaders are spread
+// evenly. It returns nil if there are no other brokers.
+func assignReplicas(brokers map[int32]string, partitions int32, replicationFactor int32) [][]int32 {
+	if len(brokers) == 0 {
+		return nil
+	}
+	ids := make([]int32, 0, len(brokers))
+	for id := range brokers {
+		ids = append(ids, id)
+	}
+	sort.Sort(int32Slice(ids))
+	if int(replicationFactor) > len(ids) {
+		replicationFactor = int32(len(ids))
+	}
+	replicas := make([][]int32, partitions)
+	for partition := range replicas {
+		for i := 0; i < int(replicationFactor); i++ {
+			replicas[partition] = append(replicas[partition], ids[(partition+i)%len(ids)])
+		}
+	}
+	return replicas
+}
+
+func readReplicas(dir string) ([][]int32, error) {
+	return readBrokerLists(dir, replicasFile)
+}
+
+// writeReplicas durably replaces the brokers storing each partition of the
+// topic in dir.
+func writeReplicas(dir string, replicas [][]int32) error {
+	return writeBrokerLists(dir, replicasFile, replicas)
+}
+
+// readBrokerLists reads a file of broker ids per partition, such as the
+// replicas file.
+func readBrokerLists(dir string, name string) ([][]int32, error) {
+	f, err := os.Open(path.Join(dir, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lists [][]int32
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var brokers []int32
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			lists = append(lists, nil)
+			continue
+		}
+		for _, field := range strings.Split(line, ",") {
+			id, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Malformed line in %s: %s", f.Name(), scanner.Text()))
+			}
+			brokers = append(brokers, int32(id))
+		}
+		lists = append(lists, brokers)
+	}
+	return lists, scanner.Err()
+}
+
+// writeBrokerLists durably replaces a file of broker ids per partition.
+func writeBrokerLists(dir string, name string, lists [][]int32) error {
+	tmpPath := path.Join(dir, name+".tmp")
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, brokers := range lists {
+		fields := make([]string, len(brokers))
+		for i, id := range brokers {
+			fields[i] = strconv.Itoa(int(id))
+		}
+		fmt.Fprintln(w, strings.Join(fields, ","))
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path.Join(dir, name))
+}
+
+// readLeader returns the leader, leader epoch and controller epoch stored in
+// dir, if any. Files from before controller epochs have none, which counts as
+// 0.
+func readLeader(dir string) (int32, int32, int32, bool, error) {
+	buf, err := ioutil.ReadFile(path.Join(dir, leaderFile))
+	if os.IsNotExist(err) {
+		return 0, 0, 0, false, nil
+	} else if err != nil {
+		return 0, 0, 0, false, err
+	}
+	fields := strings.Fields(string(buf))
+	values := make([]int32, 3)
+	if len(fields) < 2 || len(fields) > len(values) {
+		return 0, 0, 0, false, errors.New(fmt.Sprintf("Malformed %s: %q", path.Join(dir, leaderFile), buf))
+	}
+	for i, field := range fields {
+		value, err := strconv.ParseInt(field, 10, 32)
+		if err != nil {
+			return 0, 0, 0, false, errors.New(fmt.Sprintf("Malformed %s: %v", path.Join(dir, leaderFile), err))
+		}
+		values[i] = int32(value)
+	}
+	return values[0], values[1], values[2], true, nil
+}
+
+// writeLeader durably replaces the leader, leader epoch and controller epoch
+// stored in dir.
+func writeLeader(dir string, leader int32, epoch int32, controllerEpoch int32) error {
+	tmpPath := path.Join(dir, leaderFile+".tmp")
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d %d %d\n", leader, epoch, controllerEpoch)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path.Join(dir, leaderFile))
+}
+
+// readHighWatermark returns the high watermark checkpointed in dir, if any.
+func readHighWatermark(dir string) (uint64, bool, error) {
+	buf, err := ioutil.ReadFile(path.Join(dir, highWatermarkFile))
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	highWatermark, err := strconv.ParseUint(strings.TrimSpace(string(buf)), 10, 64)
+	if err != nil {
+		return 0, false, errors.New(fmt.Sprintf("Malformed %s: %v", path.Join(dir, highWatermarkFile), err))
+	}
+	return highWatermark, true, nil
+}
+
+// writeHighWatermark durably replaces the high watermark checkpointed in dir.
+func writeHighWatermark(dir string, highWatermark uint64) error {
+	tmpPath := path.Join(dir, highWatermarkFile+".tmp")
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d\n", highWatermark)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path.Join(dir, highWatermarkFile))
+}
+
+// checkpointHighWatermark writes the high watermark to disk if it has moved
+// since the last checkpoint.
+func (p *Partition) checkpointHighWatermark() error {
+	p.checkpointMu.Lock()
+	defer p.checkpointMu.Unlock()
+	p.mu.Lock()
+	highWatermark, stored := p.replicated, p.stored()
+	p.mu.Unlock()
+	if !stored || highWatermark == p.checkpointed {
+		return nil
+	}
+	if err := writeHighWatermark(p.dir, highWatermark); err != nil {
+		return err
+	}
+	p.checkpointed = highWatermark
+	return nil
+}
+
+// checkpointPeriodically checkpoints the high watermark every
+// highWatermarkInterval until ctx is done.
+func (p *Partition) checkpointPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(highWatermarkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := p.checkpointHighWatermark(); err != nil && ctx.Err() == nil {
+			log.Print("[", p.name, "] Failed to checkpoint the high watermark: ", err)
+		}
+	}
+}
+
+// assign sets the brokers storing each partition of the topic, one of which
+// is self. Partitions without any are stored only by self.
+func (t *Topic) assign(self int32, replicas [][]int32, minInsync int32) error {
+	for id, partition := range t.partitions {
+		brokers := []int32{self}
+		if id < len(replicas) && len(replicas[id]) > 0 {
+			brokers = replicas[id]
+		}
+		if err := partition.assign(self, brokers, minInsync); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assign makes self one of the replicas of the partition, which is led by the
+// first of them until another is elected. Every replica starts out in sync,
+// and followers that don't catch up within the lag time are dropped.
+func (p *Partition) assign(self int32, replicas []int32, minInsync int32) error {
+	leader, epoch, controllerEpoch, ok, err := readLeader(p.dir)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		leader = replicas[0]
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.self, p.leader, p.leaderEpoch, p.controllerEpoch, p.replicas = self, leader, epoch, controllerEpoch, replicas
+	p.setISR(replicas)
+	p.minInsync = int(minInsync)
+	if p.minInsync > len(replicas) {
+		p.minInsync = len(replicas)
+	}
+	p.updateHighWatermark()
+	return nil
+}
+
+// setISR replaces the in-sync replicas. Followers added to them count as
+// caught up as of now, but hold back the high watermark until they replicate.
+// p.mu must be held.
+func (p *Partition) setISR(isr []int32) {
+	p.followers = make(map[int32]*followerState)
+	p.isr = make(map[int32]bool)
+	for _, id := range isr {
+		p.isr[id] = true
+		if id != p.self {
+			p.followers[id] = &followerState{caughtUp: time.Now()}
+		}
+	}
+}
+
+// state returns the partition's leader, replicas and in-sync replicas. p.mu
+// must be held.
+func (p *Partition) state() *PartitionState {
+	state := PartitionState{Topic: p.topic.name, Partition: p.id, Leader: p.leader, LeaderEpoch: p.leaderEpoch, ControllerEpoch: p.controllerEpoch, Replicas: p.replicas, TargetReplicas: p.target, IsrVersion: p.isrVersion}
+	for id := range p.isr {
+		state.Isr = append(state.Isr, id)
+	}
+	sort.Sort(int32Slice(state.Isr))
+	return &state
+}
+
+// following returns whether this broker stores the partition but doesn't
+// lead it. p.mu must be held.
+func (p *Partition) following() bool {
+	return p.leader != p.self && p.hasReplica(p.self)
+}
+
+// hasReplica returns whether a broker is one of the partition's replicas.
+// p.mu must be held.
+func (p *Partition) hasReplica(id int32) bool {
+	for _, replica := range p.replicas {
+		if replica == id {
+			return true
+		}
+	}
+	return false
+}
+
+// notLeader returns the error for a request that has to be made to the leader
+// of a partition. Its code, Aborted, isn't used for anything else, so it can't
+// be mistaken for another failed precondition.
+func notLeader(partition string, leader int32) error {
+	return grpc.Errorf(codes.Aborted, "Not the leader of %s, broker %d is", partition, leader)
+}
+
+// IsNotLeader returns whether err is from a request sent to a broker that
+// doesn't lead the partition. The request wasn't carried out, so it should be
+// retried with the leader.
+func IsNotLeader(err error) bool {
+	return grpc.Code(err) == codes.Aborted
+}
+
+// checkLeader returns an error unless this broker leads the partition.
+func (p *Partition) checkLeader() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.leader != p.self {
+		return notLeader(p.name, p.leader)
+	}
+	return nil
+}
+
+// checkInsync returns an error if too few replicas are in sync for a publish
+// to be replicated.
+func (p *Partition) checkInsync() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.isr) < p.minInsync {
+		return grpc.Errorf(codes.Unavailable, "Only %d replicas of %s are in sync, %d are needed", len(p.isr), p.name, p.minInsync)
+	}
+	return nil
+}
+
+// updateHighWatermark advances the high watermark to the end of what has
+// been replicated. On the leader, that's the end of the log of the in-sync
+// replica furthest behind, provided there are at least minInsync of them. On
+// a follower, it's the leader's high watermark, as far as it has been
+// replicated here. p.mu must be held.
+func (p *Partition) updateHighWatermark() {
+	end := p.logEndOffset()
+	var highWatermark uint64
+	if p.leader != p.self {
+		highWatermark = p.leaderHighWatermark
+	} else if len(p.isr) >= p.minInsync {
+		highWatermark = end
+		for id := range p.isr {
+			if follower, ok := p.followers[id]; ok && follower.logEnd < highWatermark {
+				highWatermark = follower.logEnd
+			}
+		}
+	}
+	if highWatermark > end {
+		highWatermark = end
+	}
+	if highWatermark > p.replicated {
+		p.replicated = highWatermark
+		p.broadcast(int64(highWatermark))
+	}
+}
+
+// updateFollower records that a follower has replicated everything before
+// offset, adding it back to the in-sync replicas once it reaches the high
+// watermark, though not while the controller is being asked to shrink them,
+// so the version it accepts is the latest. p.mu must be held.
+func (p *Partition) updateFollower(id int32, offset uint64, now time.Time) error {
+	replica := false
+	for _, broker := range p.replicas {
+		replica = replica || (broker == id && id != p.self)
+	}
+	if !replica {
+		return grpc.Errorf(codes.InvalidArgument, "Broker %d is not a follower of %s", id, p.name)
+	}
+	end := p.logEndOffset()
+	if offset > end {
+		return grpc.Errorf(codes.OutOfRange, "Broker %d is at offset %d of %s, past the leader at %d", id, offset, p.name, end)
+	}
+
+	follower, ok := p.followers[id]
+	if !ok {
+		follower = &followerState{}
+		p.followers[id] = follower
+	}
+	follower.logEnd = offset
+	if offset >= follower.target {
+		follower.caughtUp = now
+	}
+	follower.target = end
+	if !p.isr[id] && offset >= p.replicated && !p.shrinking {
+		p.isr[id] = true
+		p.isrVersion++
+		follower.caughtUp = now
+		log.Print("[", p.name, "] Broker ", id, " joined the in-sync replicas")
+	}
+	p.updateHighWatermark()
+	return nil
+}
+
+// shrinkISR returns the in-sync replicas to ask the controller for if
+// followers haven't caught up in lagTime, along with the followers to drop,
+// unless the controller is already being asked. The followers stay in sync,
+// holding back the high watermark, until it accepts. p.mu must be held.
+func (p *Partition) shrinkISR(now time.Time, lagTime time.Duration) (*PartitionState, []int32) {
+	if p.leader != p.self || p.shrinking {
+		return nil, nil
+	}
+	proposed := p.state()
+	var isr, dropped []int32
+	for _, id := range proposed.Isr {
+		if follower, ok := p.followers[id]; ok && now.Sub(follower.caughtUp) > lagTime {
+			dropped = append(dropped, id)
+		} else {
+			isr = append(isr, id)
+		}
+	}
+	if len(dropped) == 0 {
+		return nil, nil
+	}
+	proposed.Isr = isr
+	proposed.IsrVersion++
+	p.shrinking = true
+	return proposed, dropped
+}
+
+// dropFromISR drops followers from the in-sync replicas once the controller
+// has accepted a shrink to proposed, carrying on from version, unless the
+// leader epoch has moved on since. p.mu must be held.
+func (p *Partition) dropFromISR(proposed *PartitionState, dropped []int32, version int32) {
+	if p.leader != p.self || p.leaderEpoch != proposed.LeaderEpoch || p.controllerEpoch != proposed.ControllerEpoch {
+		return
+	}
+	p.isrVersion = version
+	for _, id := range dropped {
+		delete(p.isr, id)
+		log.Print("[", p.name, "] Broker ", id, " fell out of the in-sync replicas")
+	}
+	p.updateHighWatermark()
+}
+
+// waitReplicated returns once everything before end has been replicated, or
+// with an error if another broker becomes the leader first.
+func (p *Partition) waitReplicated(ctx context.Context, end uint64) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	notify := p.Listen(ctx)
+	for {
+		p.mu.Lock()
+		replicated, leader, self := p.replicated >= end, p.leader, p.self
+		p.mu.Unlock()
+		if replicated {
+			return nil
+		}
+		if leader != self {
+			// Whatever wasn't replicated may or may not be truncated by the
+			// new leader.
+			return grpc.Errorf(codes.Unavailable, "Broker %d took over leading %s before offset %d was replicated", leader, p.name, end-1)
+		}
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.ctx.Done():
+			return grpc.Errorf(codes.NotFound, "Partition closed: %s", p.name)
+		}
+	}
+}
+
+// appendReplicated appends batches fetched from the leader of epoch, keeping
+// their offsets, and then takes on as much of the leader's high watermark as
+// has been replicated. Nothing is appended once the epoch is over.
+// TODO(dan): Track the producers of replicated batches too, so a follower
+// that takes over keeps deduplicating.
+func (p *Partition) appendReplicated(ctx context.Context, epoch int32, batches []*RecordBatch, highWatermark uint64) error {
+	if len(batches) > 0 {
+		done, err := p.send(ctx, appendRequest{batches: batches, epoch: epoch, done: make(chan appendResult, 1)})
+		if err != nil {
+			return err
+		}
+		if result := <-done; result.err != nil {
+			return result.err
+		}
+		// Remembering the producers' sequences keeps retries of their
+		// publishes from being written twice if this broker takes over.
+		p.topic.producersMu.Lock()
+		for _, batch := range batches {
+			addBatch(p.topic.producers, p.id, batch)
+		}
+		p.topic.producersMu.Unlock()
+		if end := batches[len(batches)-1].LastOffset + 1; p.needsSync(end) {
+			if err := p.syncTo(end); err != nil {
+				return err
+			}
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.leaderEpoch == epoch {
+		p.leaderHighWatermark = highWatermark
+		p.updateHighWatermark()
+	}
+	return nil
+}
+
+// truncateDiverged truncates the log of a follower of epoch that goes past the
+// leader's log end, since the leader doesn't have what's past it.
+func (p *Partition) truncateDiverged(ctx context.Context, epoch int32, logEnd uint64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.leaderEpoch != epoch {
+		return nil
+	}
+	log.Print("[", p.name, "] Diverged from the leader, which ends at ", logEnd)
+	return p.truncate(ctx, logEnd)
+}
+
+// client returns a connection to the broker with the given id.
+func (s *Server) client(id int32) (PubSubClient, error) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	if client, ok := s.clients[id]; ok {
+		return client, nil
+	}
+	address, ok := s.config.Brokers[id]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Unknown broker: %d", id))
+	}
+	conn, err := grpc.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	client := NewPubSubClient(conn)
+	s.clients[id] = client
+	s.conns = append(s.conns, conn)
+	return client, nil
+}
+
+// startTopic starts a topic stored by replicas and follows the leader of each
+// of its partitions that this broker stores but doesn't lead. Partitions are
+// created on every broker, and the ones this broker isn't a replica of are
+// dropped here. Reassignments in progress are picked up from the topic's
+// reassignments file.
+func (s *Server) startTopic(topic *Topic, replicas [][]int32) error {
+	if err := topic.assign(s.config.BrokerID, replicas, s.config.MinInsyncReplicas); err != nil {
+		return err
+	}
+	targets, err := readBrokerLists(topic.dir, reassignmentsFile)
+	if err != nil {
+		return err
+	}
+	topic.Start(s.ctx)
+	for _, partition := range topic.partitions {
+		partition.mu.Lock()
+		if id := int(partition.id); id < len(targets) && len(targets[id]) > 0 && fmt.Sprint(targets[id]) != fmt.Sprint(partition.replicas) {
+			partition.target = targets[id]
+		}
+		var err error
+		if !partition.hasReplica(partition.self) {
+			err = partition.drop()
+		} else if !partition.stored() {
+			// Dropped before a restart interrupted rewriting the replicas
+			// file, so it starts over as a new replica.
+			err = partition.store()
+		}
+		if err == nil && partition.following() {
+			// Whatever is past the checkpointed high watermark may have
+			// come from an earlier leader and never reached this one.
+			err = partition.truncate(s.ctx, partition.replicated)
+			partition.leaderHighWatermark = partition.replicated
+		}
+		if err == nil {
+			s.startFollowing(partition)
+		}
+		partition.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startFollowing starts replicating the partition from its leader if this
+// broker is one of its followers and isn't already. partition.mu must be
+// held.
+func (s *Server) startFollowing(partition *Partition) {
+	if partition.following() && !partition.followerRunning {
+		partition.followerRunning = true
+		go s.follow(partition)
+	}
+}
+
+// changeLeader applies the state of a partition heard from its leader or the
+// controller, ignoring anything from an earlier leader epoch, or from an
+// earlier controller epoch within the same leader epoch. Within both, only
+// the leader changes the in-sync replicas, and only a later version of them
+// replaces the ones already heard of. On becoming a follower, the
+// log is truncated to the high watermark, since whatever is past it may not
+// have reached the new leader.
+func (s *Server) changeLeader(partition *Partition, state *PartitionState) error {
+	reassigned, err := s.applyState(partition, state)
+	if err == nil && reassigned {
+		err = s.saveReplicas(partition.topic)
+	}
+	return err
+}
+
+// applyState does the work of changeLeader, returning whether the partition's
+// replicas or the ones it's being reassigned to changed. A broker added to its
+// replicas starts storing the partition, and one dropped from them deletes its
+// copy.
+func (s *Server) applyState(partition *Partition, state *PartitionState) (bool, error) {
+	partition.mu.Lock()
+	defer partition.mu.Unlock()
+	if state.LeaderEpoch < partition.leaderEpoch || (state.LeaderEpoch == partition.leaderEpoch && state.ControllerEpoch < partition.controllerEpoch) {
+		return false, nil
+	}
+	if state.LeaderEpoch == partition.leaderEpoch && state.ControllerEpoch == partition.controllerEpoch {
+		if state.Leader == partition.leader && partition.leader != partition.self && state.IsrVersion > partition.isrVersion {
+			partition.isr = make(map[int32]bool)
+			for _, id := range state.Isr {
+				partition.isr[id] = true
+			}
+			partition.isrVersion = state.IsrVersion
+		}
+		return false, nil
+	}
+
+	if state.Leader != partition.leader {
+		log.Print("[", partition.name, "] Broker ", state.Leader, " is the leader in epoch ", state.LeaderEpoch)
+	}
+	replicas := partition.replicas
+	if len(state.Replicas) > 0 {
+		replicas = state.Replicas
+	}
+	if containsBroker(replicas, partition.self) {
+		if !partition.stored() {
+			log.Print("[", partition.name, "] Storing a new copy of the partition")
+			if err := partition.store(); err != nil {
+				return false, err
+			}
+		}
+		if err := writeLeader(partition.dir, state.Leader, state.LeaderEpoch, state.ControllerEpoch); err != nil {
+			return false, err
+		}
+	}
+	reassigned := len(state.Replicas) > 0 && fmt.Sprint(state.Replicas) != fmt.Sprint(partition.replicas)
+	if reassigned {
+		log.Print("[", partition.name, "] Reassigned from brokers ", partition.replicas, " to ", state.Replicas)
+		partition.replicas = state.Replicas
+		partition.minInsync = int(s.config.MinInsyncReplicas)
+		if partition.minInsync > len(partition.replicas) {
+			partition.minInsync = len(partition.replicas)
+		}
+	}
+	target := state.TargetReplicas
+	if len(target) > 0 && fmt.Sprint(target) == fmt.Sprint(partition.replicas) {
+		log.Print("[", partition.name, "] Finished reassigning to brokers ", target)
+		target = nil
+	}
+	if fmt.Sprint(target) != fmt.Sprint(partition.target) {
+		partition.target = target
+		reassigned = true
+	}
+	if state.Leader == partition.self && partition.leader == partition.self {
+		// Still the leader, which knows best how far its followers are.
+		for id := range partition.followers {
+			if !partition.hasReplica(id) {
+				delete(partition.followers, id)
+				delete(partition.isr, id)
+			}
+		}
+		if state.IsrVersion > partition.isrVersion {
+			partition.isrVersion = state.IsrVersion
+		}
+		partition.isrVersion++
+	} else {
+		partition.setISR(state.Isr)
+		partition.isrVersion = state.IsrVersion
+	}
+	partition.leader, partition.leaderEpoch, partition.controllerEpoch = state.Leader, state.LeaderEpoch, state.ControllerEpoch
+	if partition.following() {
+		if err := partition.truncate(s.ctx, partition.replicated); err != nil {
+			return reassigned, err
+		}
+		partition.leaderHighWatermark = partition.replicated
+		s.startFollowing(partition)
+	} else if !partition.hasReplica(partition.self) && partition.stored() {
+		log.Print("[", partition.name, "] Dropping the copy of the partition")
+		if err := partition.drop(); err != nil {
+			return reassigned, err
+		}
+	}
+	partition.updateHighWatermark()
+	// Wake any readers so they find out this broker no longer leads.
+	partition.broadcast(int64(partition.replicated))
+	return reassigned, nil
+}
+
+// saveReplicas rewrites the replicas and reassignments files of a topic after
+// one of its partitions is reassigned or starts or stops moving.
+func (s *Server) saveReplicas(topic *Topic) error {
+	topic.replicasMu.Lock()
+	defer topic.replicasMu.Unlock()
+	replicas := make([][]int32, len(topic.partitions))
+	targets := make([][]int32, len(topic.partitions))
+	for id, partition := range topic.partitions {
+		partition.mu.Lock()
+		replicas[id], targets[id] = partition.replicas, partition.target
+		partition.mu.Unlock()
+	}
+	if err := writeReplicas(topic.dir, replicas); err != nil {
+		return err
+	}
+	return writeBrokerLists(topic.dir, reassignmentsFile, targets)
+}
+
+// applyStates applies partition states sent by other brokers.
+// TODO(dan): Create topics that were created while this broker was down.
+func (s *Server) applyStates(states []*PartitionState) {
+	for _, state := range states {
+		topic, err := s.topic(state.Topic)
+		if err != nil {
+			continue
+		}
+		partition, err := topic.Partition(state.Partition)
+		if err != nil {
+			continue
+		}
+		if err := s.changeLeader(partition, state); err != nil {
+			log.Print("[", partition.name, "] Failed to change leader: ", err)
+		}
+	}
+}
+
+// createOnBrokers creates a topic that this broker just assigned replicas to
+// on every other broker, so they all know who leads its partitions. Only
+// failing to create it on one of its replicas is an error.
+// TODO(dan): Keep retrying brokers that are down instead of giving up.
+func (s *Server) createOnBrokers(ctx context.Context, name string, partitions int32, overrides map[string]string, replicas [][]int32) error {
+	request := CreateTopicRequest{Topic: name, Config: overrides, Partitions: partitions}
+	replica := make(map[int32]bool)
+	for _, partitionReplicas := range replicas {
+		request.Replicas = append(request.Replicas, &PartitionReplicas{Brokers: partitionReplicas})
+		for _, id := range partitionReplicas {
+			replica[id] = true
+		}
+	}
+	brokers := make([]int32, 0, len(s.config.Brokers))
+	for id := range s.config.Brokers {
+		brokers = append(brokers, id)
+	}
+	sort.Sort(int32Slice(brokers))
+	for _, id := range brokers {
+		if id == s.config.BrokerID {
+			continue
+		}
+		client, err := s.client(id)
+		if err == nil {
+			_, err = client.CreateTopic(ctx, &request)
+		}
+		if err == nil || grpc.Code(err) == codes.AlreadyExists {
+			continue
+		}
+		if replica[id] {
+			return grpc.Errorf(codes.Unavailable, "Created topic %s but failed to create it on broker %d: %v", name, id, err)
+		}
+		log.Print("[", name, "] Failed to create topic on broker ", id, ": ", err)
+	}
+	return nil
+}
+
+// follow replicates the partition from its leader until the partition is
+// closed or this broker stops following it.
+func (s *Server) follow(partition *Partition) {
+	followed := int32(-1)
+	for {
+		partition.mu.Lock()
+		following, leader := partition.following(), partition.leader
+		request := ReplicateRequest{
+			Topic:         partition.topic.name,
+			Partition:     partition.id,
+			Offset:        partition.logEndOffset(),
+			BrokerId:      s.config.BrokerID,
+			HighWatermark: partition.highWatermark(),
+			MaxWaitMs:     int64(replicaFetchWait / time.Millisecond),
+			LeaderEpoch:   partition.leaderEpoch,
+		}
+		if !following {
+			partition.followerRunning = false
+		}
+		partition.mu.Unlock()
+		if !following {
+			return
+		}
+		if leader != followed {
+			log.Print("[", partition.name, "] Following broker ", leader)
+			followed = leader
+		}
+
+		client, err := s.client(leader)
+		var reply *ReplicateReply
+		if err == nil {
+			reply, err = client.Replicate(partition.ctx, &request)
+		}
+		if err == nil && request.Offset > reply.LogEndOffset {
+			err = partition.truncateDiverged(partition.ctx, request.LeaderEpoch, reply.LogEndOffset)
+		} else if err == nil {
+			err = partition.appendReplicated(partition.ctx, request.LeaderEpoch, reply.GetBatches(), reply.HighWatermark)
+		}
+		if err == nil {
+			continue
+		}
+		if partition.ctx.Err() != nil {
+			return
+		}
+		log.Print("[", partition.name, "] Failed to replicate from broker ", leader, ": ", err)
+		select {
+		case <-partition.ctx.Done():
+			return
+		case <-time.After(replicaRetryDelay):
+		}
+	}
+}
+
+// expireReplicas periodically drops followers that have fallen behind from
+// the in-sync replicas of the partitions this broker leads, until the
+// server's context is done.
+func (s *Server) expireReplicas() {
+	ticker := time.NewTicker(s.config.ReplicaLagTime / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, topic := range s.allTopics() {
+				for _, partition := range topic.partitions {
+					partition.mu.Lock()
+					proposed, dropped := partition.shrinkISR(now, s.config.ReplicaLagTime)
+					partition.mu.Unlock()
+					if proposed != nil {
+						go s.shrinkISR(partition, proposed, dropped)
+					}
+				}
+			}
+		}
+	}
+}
+
+// shrinkISR asks the controller to accept dropping followers from the
+// in-sync replicas of a partition this broker leads, and drops them if it
+// does.
+func (s *Server) shrinkISR(partition *Partition, proposed *PartitionState, dropped []int32) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.config.BrokerTimeout)
+	defer cancel()
+	var version int32
+	var err error
+	if id := s.controller.id(); id == s.config.BrokerID {
+		version, err = s.controller.acceptShrink(proposed)
+	} else if id < 0 {
+		err = grpc.Errorf(codes.Unavailable, "No broker holds the controller lease")
+	} else {
+		var client PubSubClient
+		if client, err = s.client(id); err == nil {
+			var reply *ShrinkIsrReply
+			if reply, err = client.ShrinkIsr(ctx, &ShrinkIsrRequest{Partition: proposed}); err == nil {
+				version = reply.IsrVersion
+			}
+		}
+	}
+
+	partition.mu.Lock()
+	defer partition.mu.Unlock()
+	partition.shrinking = false
+	if err != nil {
+		if s.ctx.Err() == nil {
+			log.Print("[", partition.name, "] Failed to drop brokers ", dropped, " from the in-sync replicas: ", err)
+		}
+		return
+	}
+	partition.dropFromISR(proposed, dropped, version)
+}
+
+func (s *Server) Replicate(ctx context.Context, in *ReplicateRequest) (*ReplicateReply, error) {
+	topic, err := s.topic(in.Topic)
+	if err != nil {
+		return nil, err
+	}
+	partition, err := topic.Partition(in.Partition)
+	if err != nil {
+		return nil, err
+	}
+	partition.mu.Lock()
+	if leader := partition.leader; leader != partition.self {
+		partition.mu.Unlock()
+		return nil, notLeader(partition.name, leader)
+	}
+	if epoch := partition.leaderEpoch; in.LeaderEpoch != epoch {
+		partition.mu.Unlock()
+		return nil, grpc.Errorf(codes.FailedPrecondition, "Broker %d is following epoch %d of %s, not %d", in.BrokerId, in.LeaderEpoch, partition.name, epoch)
+	}
+	if end := partition.logEndOffset(); in.Offset > end {
+		// The follower has messages from an earlier leader that never made
+		// it here, so it has to truncate them first.
+		reply := ReplicateReply{HighWatermark: partition.highWatermark(), LogEndOffset: end}
+		partition.mu.Unlock()
+		return &reply, nil
+	}
+	err = partition.updateFollower(in.BrokerId, in.Offset, time.Now())
+	insync := partition.isr[in.BrokerId]
+	// A new follower of a partition that retention has trimmed starts from
+	// the earliest offset left, leaving a gap in its log like compaction.
+	offset := in.Offset
+	if earliest := partition.earliestOffset(); offset < earliest {
+		offset = earliest
+	}
+	partition.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, time.Duration(in.MaxWaitMs)*time.Millisecond)
+	defer cancel()
+	notify := partition.Listen(waitCtx)
+	reader, err := NewPartitionReader(waitCtx, partition, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	reader.replica = true
+
+	reply := ReplicateReply{}
+	var bytes int64
+	for bytes < defaultFetchMaxBytes {
+		batch, err := reader.TryReadBatch()
+		if err != nil {
+			return nil, err
+		}
+		if batch != nil {
+			bytes += int64(proto.Size(batch))
+			reply.Batches = append(reply.Batches, batch)
+			continue
+		}
+
+		// Caught up, so only wait for something new if the follower already
+		// knows the high watermark.
+		partition.mu.Lock()
+		reply.HighWatermark = partition.highWatermark()
+		partition.mu.Unlock()
+		if len(reply.Batches) > 0 || reply.HighWatermark > in.HighWatermark {
+			break
+		}
+		select {
+		case <-notify:
+			continue
+		case <-waitCtx.Done():
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		break
+	}
+
+	if !insync {
+		// Copying to a replica that is catching up, such as a new one, mustn't
+		// starve publishers and subscribers.
+		if err := s.throttle.wait(ctx, bytes); err != nil {
+			return nil, err
+		}
+	}
+
+	partition.mu.Lock()
+	reply.HighWatermark = partition.highWatermark()
+	reply.LogEndOffset = partition.logEndOffset()
+	partition.mu.Unlock()
+	return &reply, nil
+}
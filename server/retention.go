@@ -0,0 +1,75 @@
+// Copyright (C) 2015 Daniel Harrison
+
+package server
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+const cleanInterval = 5 * time.Minute
+
+// clean periodically enforces retention on or compacts every partition,
+// depending on its topic's cleanup policy, until the server's context is done.
+func (s *Server) clean() {
+	ticker := time.NewTicker(cleanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, topic := range s.allTopics() {
+				for _, partition := range topic.partitions {
+					var err error
+					if topic.Config().CleanupPolicy == CleanupCompact {
+						err = partition.compact(s.ctx, now)
+					} else {
+						err = partition.enforceRetention(now)
+					}
+					if err != nil {
+						log.Print("[", partition.name, "] Failed to clean: ", err)
+					}
+				}
+			}
+		}
+	}
+}
+
+// enforceRetention deletes sealed message sets from the front of the
+// partition that were last written longer than RetentionAge ago or that leave
+// the partition over RetentionBytes. The active message set is never deleted.
+func (p *Partition) enforceRetention(now time.Time) error {
+	config := p.Config()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var size int64
+	for _, messageSet := range p.messageSets {
+		size += messageSet.size
+	}
+
+	for len(p.messageSets) > 1 {
+		oldest := p.messageSets[0]
+		expired := config.RetentionBytes > 0 && size > config.RetentionBytes
+		if !expired && config.RetentionAge > 0 {
+			info, err := os.Stat(oldest.path)
+			if err != nil {
+				return err
+			}
+			expired = now.Sub(info.ModTime()) > config.RetentionAge
+		}
+		if !expired {
+			break
+		}
+
+		if err := oldest.remove(); err != nil {
+			return err
+		}
+		size -= oldest.size
+		p.messageSets = p.messageSets[1:]
+		log.Print("[", p.name, "] Deleted ", oldest.path, ", earliest offset is now ", p.earliestOffset())
+	}
+	return nil
+}
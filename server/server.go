@@ -3,39 +3,109 @@
 package server
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
-	"hash/crc32"
-	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
-	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
 
 	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
 type Server struct {
 	ctx    context.Context
+	cancel context.CancelFunc
 	dir    string
+	config ServerConfig
+
+	mu     sync.Mutex
 	topics map[string]*Topic
+
+	offsets      *offsetStore
+	coordinator  *coordinator
+	transactions *transactionCoordinator
+	controller   *controller
+
+	// clientsMu guards clients, the connections to other brokers.
+	clientsMu sync.Mutex
+	clients   map[int32]PubSubClient
+	conns     []*grpc.ClientConn
+	// throttle limits copying partitions to replicas that are catching up.
+	throttle *throttle
 }
 
-func NewServer(dir string) (*Server, error) {
-	server := Server{context.Background(), dir, make(map[string]*Topic)}
+func NewServer(dir string, config ServerConfig) (*Server, error) {
+	if err := config.Topic.validate(); err != nil {
+		return nil, err
+	}
+	if config.Partitions < 1 {
+		return nil, errors.New(fmt.Sprintf("Invalid number of partitions: %d", config.Partitions))
+	}
+	if config.SubscribeMaxBytes < 1 || config.SubscribeMaxMessages < 1 {
+		return nil, errors.New(fmt.Sprintf("Invalid subscribe limits: %d bytes %d messages", config.SubscribeMaxBytes, config.SubscribeMaxMessages))
+	}
+	if config.ReplicationFactor < 1 || config.MinInsyncReplicas < 1 || config.ReplicaLagTime <= 0 || config.BrokerTimeout <= 0 || config.ReassignmentThrottle < 0 {
+		return nil, errors.New(fmt.Sprintf("Invalid replication settings: factor %d min in sync %d lag time %s broker timeout %s reassignment throttle %d", config.ReplicationFactor, config.MinInsyncReplicas, config.ReplicaLagTime, config.BrokerTimeout, config.ReassignmentThrottle))
+	}
+	if config.TransactionTimeout <= 0 {
+		return nil, errors.New(fmt.Sprintf("Invalid transaction timeout: %s", config.TransactionTimeout))
+	}
+	if _, ok := config.Brokers[config.BrokerID]; len(config.Brokers) > 0 && !ok {
+		return nil, errors.New(fmt.Sprintf("Broker %d is missing from the brokers", config.BrokerID))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	server := Server{ctx: ctx, cancel: cancel, dir: dir, config: config, topics: make(map[string]*Topic), clients: make(map[int32]PubSubClient), throttle: &throttle{rate: config.ReassignmentThrottle}}
 	if err := server.init(); err != nil {
 		return nil, err
 	}
+	if err := server.initOffsets(); err != nil {
+		return nil, err
+	}
+	if err := server.initTransactions(); err != nil {
+		return nil, err
+	}
+	server.coordinator = &coordinator{server: &server, groups: make(map[string]*consumerGroup)}
+	go server.clean()
+	go server.coordinator.expirePeriodically()
+	go server.transactions.expirePeriodically()
+	go server.expireReplicas()
+	controller, err := newController(&server)
+	if err != nil {
+		return nil, err
+	}
+	server.controller = controller
+	go server.controller.run()
 
 	return &server, nil
 }
 
+// Close stops the server's goroutines and closes every topic and connection
+// to other brokers.
+func (s *Server) Close() error {
+	s.cancel()
+	var err error
+	for _, topic := range s.allTopics() {
+		if closeErr := topic.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	for _, conn := range s.conns {
+		if closeErr := conn.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
 func (s *Server) init() error {
 	if info, err := os.Stat(s.dir); err == nil && info.IsDir() {
 		log.Print("Found existing data at ", s.dir)
@@ -51,101 +121,247 @@ func (s *Server) init() error {
 	}
 	for _, fileInfo := range files {
 		if fileInfo.IsDir() {
-			messageSets, err := ioutil.ReadDir(path.Join(s.dir, fileInfo.Name()))
+			topic, err := OpenTopic(s.ctx, path.Join(s.dir, fileInfo.Name()), fileInfo.Name(), s.config.Topic)
 			if err != nil {
 				return err
 			}
-			topic := Topic{name: fileInfo.Name()}
-			for _, messageSetFile := range messageSets {
-				if filepath.Ext(messageSetFile.Name()) != ".pubsub" {
-					continue
-				}
-
-				messageSet, err := NewMessageSet(s.ctx, path.Join(s.dir, fileInfo.Name(), messageSetFile.Name()))
-				if err != nil {
-					return err
-				}
-				topic.messageSets = append(topic.messageSets, *messageSet)
-			}
-			if len(topic.messageSets) < 0 {
-				continue
-			}
-			sort.Sort(MessageSetSort(topic.messageSets))
-			// TODO(dan): Validate pairwise offsetBegin/offsetEnd
-
-			currentMessageSet := topic.messageSets[len(topic.messageSets)-1]
-			topicFile, err := os.OpenFile(currentMessageSet.path, os.O_WRONLY|os.O_APPEND, 0770)
+			replicas, err := readReplicas(topic.dir)
 			if err != nil {
 				return err
 			}
-			topic.writer = bufio.NewWriter(topicFile)
-			s.topics[topic.name] = &topic
+			if err := s.startTopic(topic, replicas); err != nil {
+				return err
+			}
+			s.topics[topic.name] = topic
 		}
 	}
 	return nil
 }
 
+// allTopics returns a snapshot of the server's topics.
+func (s *Server) allTopics() []*Topic {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	topics := make([]*Topic, 0, len(s.topics))
+	for _, topic := range s.topics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// topic returns the named topic or a NotFound error.
+func (s *Server) topic(name string) (*Topic, error) {
+	s.mu.Lock()
+	topic, ok := s.topics[name]
+	s.mu.Unlock()
+	if !ok {
+		return nil, noSuchTopic(name)
+	}
+	return topic, nil
+}
+
+// createTopic creates and starts a new topic with the given settings in place
+// of the server's defaults. The topic is stored by replicas if given, or
+// otherwise by brokers it assigns, which it also returns. Internal topics are
+// stored by every broker, which each create them the same way on startup.
+// s.mu must be held.
+func (s *Server) createTopic(name string, partitions int32, overrides map[string]string, replicas [][]int32) (*Topic, [][]int32, error) {
+	// The name is used as a directory under s.dir.
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return nil, nil, grpc.Errorf(codes.InvalidArgument, "Invalid topic name: %q", name)
+	}
+	dir := path.Join(s.dir, name)
+	if replicas == nil && internalTopic(name) {
+		replicas = assignReplicas(s.config.Brokers, partitions, int32(len(s.config.Brokers)))
+	} else if replicas == nil {
+		replicas = assignReplicas(s.config.Brokers, partitions, s.config.ReplicationFactor)
+	}
+	if replicas != nil {
+		// Written first so the topic is never opened without them.
+		if err := os.MkdirAll(dir, 0770); err != nil {
+			return nil, nil, err
+		}
+		if err := writeReplicas(dir, replicas); err != nil {
+			return nil, nil, err
+		}
+	}
+	topic, err := NewTopic(dir, name, partitions, s.config.Topic, overrides)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.startTopic(topic, replicas); err != nil {
+		return nil, nil, err
+	}
+	s.topics[name] = topic
+	log.Print("[", name, "] Created topic with ", partitions, " partitions")
+	return topic, replicas, nil
+}
+
+func noSuchTopic(name string) error {
+	return grpc.Errorf(codes.NotFound, "No such topic: %s", name)
+}
+
+// messageSize returns the number of bytes of key, value and headers in
+// message.
+func messageSize(message *Message) int64 {
+	size := len(message.Key) + len(message.Value)
+	for _, header := range message.Headers {
+		size += len(header.Key) + len(header.Value)
+	}
+	return int64(size)
+}
+
 func (s *Server) PublishMulti(ctx context.Context, in *PublishMultiRequest) (*PublishMultiReply, error) {
 	log.Print("[", in.Topic, "] Got ", len(in.GetMessages()), " messages")
+	if internalTopic(in.Topic) {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Cannot publish to internal topic: %s", in.Topic)
+	}
+	s.mu.Lock()
 	var topic, ok = s.topics[in.Topic]
-	if !ok {
-		var offset = 0
-		var messageSetPath = path.Join(s.dir, in.Topic, fmt.Sprintf("%012d.pubsub", offset))
-
-		err := os.MkdirAll(path.Dir(messageSetPath), 0770)
-		if err != nil {
+	var replicas [][]int32
+	if !ok && s.config.AutoCreateTopics {
+		var err error
+		if topic, replicas, err = s.createTopic(in.Topic, s.config.Partitions, nil, nil); err != nil {
+			s.mu.Unlock()
 			return nil, err
 		}
-
-		f, err := os.OpenFile(messageSetPath, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0770)
-		if err != nil {
+		ok = true
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, noSuchTopic(in.Topic)
+	}
+	if replicas != nil {
+		if err := s.createOnBrokers(ctx, in.Topic, s.config.Partitions, nil, replicas); err != nil {
 			return nil, err
 		}
-		log.Print("[", in.Topic, "] Created ", messageSetPath)
-
-		messageSet := MessageSet{path: messageSetPath, offsetBegin: uint64(offset)}
-		topic = &Topic{name: in.Topic, writer: bufio.NewWriter(f)}
-		topic.messageSets = append(topic.messageSets, messageSet)
-		s.topics[topic.name] = topic
 	}
 
-	var sizeBuf = make([]byte, 4)
-	var magicBuf = make([]byte, 1)
-	magicBuf[0] = 0
-
-	var crc = crc32.NewIEEE()
-	for _, message := range in.GetMessages() {
-		var encoded, err = proto.Marshal(message)
-		if err != nil {
+	config := topic.Config()
+	if config.MaxMessageBytes > 0 {
+		for _, message := range in.GetMessages() {
+			if size := messageSize(message); size > config.MaxMessageBytes {
+				return nil, grpc.Errorf(codes.InvalidArgument, "Message of %d bytes is larger than the %d allowed by %s", size, config.MaxMessageBytes, in.Topic)
+			}
+		}
+	}
+	routed, err := topic.route(in.GetMessages(), in.Partition)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(routed))
+	for id := range routed {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		if err := topic.partitions[id].checkLeader(); err != nil {
 			return nil, err
 		}
+		if in.Acks == Acks_ALL {
+			if err := topic.partitions[id].checkInsync(); err != nil {
+				return nil, err
+			}
+		}
+	}
 
-		binary.LittleEndian.PutUint32(sizeBuf, uint32(len(encoded)+5))
-		_, err = topic.Write(sizeBuf)
-		if err != nil {
-			return nil, err
+	producer := batchProducer{id: in.ProducerId, sequence: in.Sequence}
+	// finish records the offsets of a publish with a producer id once it has
+	// been appended, or forgets its sequence if it fails before then.
+	finish := func([]*PartitionOffsets) {}
+	if producer.id != 0 {
+		if in.Acks == Acks_NONE {
+			return nil, grpc.Errorf(codes.InvalidArgument, "Publishes with a producer id can't use acks NONE, retries need their offsets")
 		}
-		_, err = topic.Write(magicBuf)
+		duplicate, done, err := topic.beginSequence(producer.id, producer.sequence)
+		if duplicate != nil || err != nil {
+			return duplicate, err
+		}
+		finish = done
+	}
+	if in.Transactional {
+		if producer.id == 0 {
+			return nil, grpc.Errorf(codes.InvalidArgument, "Transactional publishes need a producer id")
+		}
+		release, err := s.joinTransaction(ctx, producer.id, topic, ids)
 		if err != nil {
+			finish(nil)
 			return nil, err
 		}
-		crc.Reset()
-		crc.Sum(encoded)
-		binary.LittleEndian.PutUint32(sizeBuf, uint32(crc.Sum32()))
-		_, err = topic.Write(sizeBuf)
+		defer release()
+		producer.transactional = true
+	}
+
+	compression, _ := config.compression(in.Compression)
+	reply := PublishMultiReply{}
+	if in.Acks == Acks_NONE {
+		// Only wait for the writers to accept the messages.
+		for _, id := range ids {
+			if _, err := topic.partitions[id].enqueue(ctx, producer, routed[int32(id)], compression); err != nil {
+				return nil, err
+			}
+		}
+		return &reply, nil
+	}
+	for _, id := range ids {
+		baseOffset, lastOffset, err := topic.partitions[id].publish(ctx, producer, routed[int32(id)], compression)
 		if err != nil {
+			// TODO(dan): A request that fails after writing to some of its
+			// partitions leaves its sequence unused, so a retry duplicates
+			// those partitions.
+			finish(nil)
+			if IsNotLeader(err) && len(reply.Partitions) > 0 {
+				// Not a plain NotLeader, which says nothing was written.
+				return nil, grpc.Errorf(codes.Unavailable, "Published to %d partitions of %s before: %v", len(reply.Partitions), in.Topic, grpc.ErrorDesc(err))
+			}
 			return nil, err
 		}
-
-		_, err = io.Copy(topic, bytes.NewReader(encoded))
+		reply.Partitions = append(reply.Partitions, &PartitionOffsets{Partition: int32(id), BaseOffset: baseOffset, LastOffset: lastOffset})
 	}
+	finish(reply.Partitions)
 
-	err := topic.Flush()
-	if err != nil {
-		return nil, err
+	// Don't reply until the batches are as durable as the topic, or the
+	// publisher, asks for.
+	for _, offsets := range reply.Partitions {
+		partition, end := topic.partitions[offsets.Partition], offsets.LastOffset+1
+		if len(routed[offsets.Partition]) == 0 {
+			continue
+		}
+		if in.Acks == Acks_ALL || partition.needsSync(end) {
+			if err := partition.syncTo(end); err != nil {
+				return nil, err
+			}
+		}
+		if in.Acks == Acks_ALL {
+			if err := partition.waitReplicated(ctx, end); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(reply.Partitions) == 1 {
+		reply.BaseOffset = reply.Partitions[0].BaseOffset
+		reply.LastOffset = reply.Partitions[0].LastOffset
 	}
+	return &reply, nil
+}
 
-	return &PublishMultiReply{}, nil
+// startOffset returns the offset in partition that position refers to.
+func startOffset(ctx context.Context, partition *Partition, position StartPosition, offset uint64, timestamp int64) (uint64, error) {
+	switch position {
+	case StartPosition_OFFSET:
+		return offset, nil
+	case StartPosition_EARLIEST:
+		partition.mu.Lock()
+		defer partition.mu.Unlock()
+		return partition.earliestOffset(), nil
+	case StartPosition_LATEST:
+		partition.mu.Lock()
+		defer partition.mu.Unlock()
+		return partition.highWatermark(), nil
+	case StartPosition_TIMESTAMP:
+		return partition.offsetForTimestamp(ctx, timestamp)
+	}
+	return 0, grpc.Errorf(codes.InvalidArgument, "Unknown start position: %s", position)
 }
 
 func (s *Server) Subscribe(in *SubscribeRequest, srv PubSub_SubscribeServer) error {
@@ -154,53 +370,243 @@ func (s *Server) Subscribe(in *SubscribeRequest, srv PubSub_SubscribeServer) err
 		log.Print("[", in.Topic, "] Closed subscription")
 	}()
 
-	topic, ok := s.topics[in.Topic]
-	if !ok {
-		return errors.New(fmt.Sprintf("No such topic: ", in.Topic))
+	topic, err := s.topic(in.Topic)
+	if err != nil {
+		return err
 	}
-	if len(topic.messageSets) == 0 {
-		return errors.New(fmt.Sprintf("INTERNAL ERROR: No messagesets for topic: ", topic.name, " offset: ", in.Offset))
+	partition, err := topic.Partition(in.Partition)
+	if err != nil {
+		return err
+	}
+	if err := partition.checkLeader(); err != nil {
+		return err
 	}
-	messageSet := topic.messageSets[0]
-	for i := 0; i < len(topic.messageSets); i++ {
-		if topic.messageSets[i].offsetBegin <= in.Offset {
-			messageSet = topic.messageSets[i]
-		} else {
-			break
+
+	var committed *FetchCommittedOffsetReply
+	if in.Group != "" {
+		if committed, err = s.committedOffset(srv.Context(), offsetKey{in.Group, in.Topic, in.Partition}); err != nil {
+			return err
 		}
 	}
+	var offset uint64
+	if committed != nil && committed.Committed {
+		offset = committed.Offset
+	} else if offset, err = startOffset(srv.Context(), partition, in.Start, in.Offset, in.StartTimestamp); err != nil {
+		return err
+	}
+
+	maxBytes, maxMessages := s.config.SubscribeMaxBytes, s.config.SubscribeMaxMessages
+	if in.MaxBytes > 0 && in.MaxBytes < maxBytes {
+		maxBytes = in.MaxBytes
+	}
+	if in.MaxMessages > 0 && in.MaxMessages < maxMessages {
+		maxMessages = in.MaxMessages
+	}
 
-	f, err := os.Open(messageSet.path)
+	tReader, err := NewPartitionReader(srv.Context(), partition, offset)
 	if err != nil {
 		return err
 	}
-	mReader := NewMessageSetReader(srv.Context(), f, topic.Listen(srv.Context()))
+	defer tReader.Close()
+	tReader.readCommitted = in.ReadCommitted
 
-	// TODO(dan): Check for reasonable offset in request, otherwise we'll be here
-	// for a while.
-	for i := uint64(0); i < in.Offset-messageSet.offsetBegin; i++ {
-		_, err := mReader.ReadMessage()
-		if err != nil {
+	// Everything already published is coalesced into each response, up to
+	// the limits. A batch that doesn't fit is held for the next response.
+	var held *RecordBatch
+	for {
+		response := SubscribeResponse{}
+		var bytes, messages int64
+		for {
+			batch := held
+			held = nil
+			if batch == nil {
+				// Only wait for the first batch of a response.
+				if messages == 0 {
+					batch, err = tReader.ReadBatch()
+				} else {
+					batch, err = tReader.TryReadBatch()
+				}
+				if err != nil {
+					return err
+				} else if batch == nil {
+					break
+				}
+			}
+			size, count := int64(proto.Size(batch)), int64(batch.LastOffset-batch.BaseOffset+1)
+			full := bytes+size > maxBytes || messages+count > maxMessages
+			if messages > 0 && (full || mixesKinds(batch, response.Messages, response.Batches)) {
+				held = batch
+				break
+			}
+			bytes += size
+			messages += count
+
+			// Compressed batches are shipped as is for the subscriber to
+			// decode.
+			if batch.Compression == Compression_NONE {
+				decoded, err := DecodeRecordBatch(batch)
+				if err != nil {
+					return err
+				}
+				response.Messages = append(response.Messages, decoded...)
+			} else {
+				response.Batches = append(response.Batches, batch)
+			}
+			if bytes >= maxBytes || messages >= maxMessages {
+				break
+			}
+		}
+		if err := srv.Send(&response); err != nil {
 			return err
 		}
 	}
+}
 
-	for {
-		messageBytes, err := mReader.ReadMessage()
-		if err != nil {
-			return err
+func (s *Server) CreateTopic(ctx context.Context, in *CreateTopicRequest) (*CreateTopicReply, error) {
+	if internalTopic(in.Topic) {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Topic names starting with __ are reserved: %s", in.Topic)
+	}
+	if _, err := s.config.Topic.override(in.GetConfig()); err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	partitions := in.Partitions
+	if partitions == 0 {
+		partitions = s.config.Partitions
+	}
+	if partitions < 0 {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Invalid number of partitions: %d", partitions)
+	}
+	var replicas [][]int32
+	if len(in.GetReplicas()) > 0 {
+		if len(in.GetReplicas()) != int(partitions) {
+			return nil, grpc.Errorf(codes.InvalidArgument, "Got replicas for %d partitions of %d", len(in.GetReplicas()), partitions)
+		}
+		for id, partitionReplicas := range in.GetReplicas() {
+			if len(partitionReplicas.Brokers) == 0 {
+				return nil, grpc.Errorf(codes.InvalidArgument, "No replicas for partition %d", id)
+			}
+			replicas = append(replicas, partitionReplicas.Brokers)
+		}
+	}
+
+	s.mu.Lock()
+	if _, ok := s.topics[in.Topic]; ok {
+		s.mu.Unlock()
+		return nil, grpc.Errorf(codes.AlreadyExists, "Topic already exists: %s", in.Topic)
+	}
+	_, assigned, err := s.createTopic(in.Topic, partitions, in.GetConfig(), replicas)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	// Only the broker that assigned the replicas creates the topic on the
+	// others.
+	if replicas == nil && assigned != nil {
+		if err := s.createOnBrokers(ctx, in.Topic, partitions, in.GetConfig(), assigned); err != nil {
+			return nil, err
 		}
+	}
+	return &CreateTopicReply{}, nil
+}
 
-		message := new(Message)
-		err = proto.Unmarshal(messageBytes, message)
+func (s *Server) DeleteTopic(ctx context.Context, in *DeleteTopicRequest) (*DeleteTopicReply, error) {
+	if internalTopic(in.Topic) {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Cannot delete internal topic: %s", in.Topic)
+	}
+	// TODO(dan): Drop the offsets committed for the topic.
+	// s.mu is held throughout so the topic can't be recreated until its
+	// directory is gone.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	topic, ok := s.topics[in.Topic]
+	if !ok {
+		return nil, noSuchTopic(in.Topic)
+	}
+	delete(s.topics, in.Topic)
 
-		response := SubscribeResponse{}
-		response.Messages = append(response.Messages, message)
-		err = srv.Send(&response)
-		if err != nil {
-			return err
+	// Closing the topic fails any publishes still queued and ends its
+	// subscriptions.
+	if err := topic.Close(); err != nil {
+		log.Print("[", in.Topic, "] Error closing deleted topic: ", err)
+	}
+	if err := os.RemoveAll(topic.dir); err != nil {
+		return nil, err
+	}
+	log.Print("[", in.Topic, "] Deleted topic")
+	return &DeleteTopicReply{}, nil
+}
+
+func (s *Server) ListTopics(ctx context.Context, in *ListTopicsRequest) (*ListTopicsReply, error) {
+	reply := ListTopicsReply{}
+	for _, topic := range s.allTopics() {
+		if !internalTopic(topic.name) {
+			reply.Topics = append(reply.Topics, topic.name)
 		}
 	}
+	sort.Strings(reply.Topics)
+	return &reply, nil
+}
 
-	return nil
+func (s *Server) DescribeTopic(ctx context.Context, in *DescribeTopicRequest) (*DescribeTopicReply, error) {
+	topic, err := s.topic(in.Topic)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := DescribeTopicReply{Topic: topic.name, Config: topic.Config().Map()}
+	for _, partition := range topic.partitions {
+		partition.mu.Lock()
+		description := PartitionDescription{
+			Partition:      partition.id,
+			EarliestOffset: partition.earliestOffset(),
+			LatestOffset:   partition.nextOffset(),
+			Segments:       uint64(len(partition.messageSets)),
+			Leader:         partition.leader,
+			Replicas:       partition.replicas,
+			Isr:            partition.state().Isr,
+			HighWatermark:  partition.highWatermark(),
+			LeaderEpoch:    partition.leaderEpoch,
+		}
+		for _, messageSet := range partition.messageSets {
+			description.Bytes += uint64(messageSet.size) + uint64(len(messageSet.index.entries)*indexEntrySize)
+		}
+		partition.mu.Unlock()
+		reply.Partitions = append(reply.Partitions, &description)
+	}
+	return &reply, nil
+}
+
+func (s *Server) AlterTopicConfig(ctx context.Context, in *AlterTopicConfigRequest) (*AlterTopicConfigReply, error) {
+	if internalTopic(in.Topic) {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Cannot alter the config of internal topic: %s", in.Topic)
+	}
+	topic, err := s.topic(in.Topic)
+	if err != nil {
+		return nil, err
+	}
+	config, err := topic.Reconfigure(s.config.Topic, in.GetSet(), in.Remove)
+	if err != nil {
+		return nil, err
+	}
+	return &AlterTopicConfigReply{Config: config.Map()}, nil
+}
+
+func (s *Server) ListOffsets(ctx context.Context, in *ListOffsetsRequest) (*ListOffsetsReply, error) {
+	if in.Position == StartPosition_OFFSET {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Position must be EARLIEST, LATEST or TIMESTAMP")
+	}
+	topic, err := s.topic(in.Topic)
+	if err != nil {
+		return nil, err
+	}
+	partition, err := topic.Partition(in.Partition)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := startOffset(ctx, partition, in.Position, 0, in.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	return &ListOffsetsReply{Offset: offset}, nil
 }
@@ -0,0 +1,2347 @@
+// Copyright (C) 2015 Daniel Harrison
+
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// subscribeStream is a PubSub_SubscribeServer that hands responses to the
+// test instead of a client.
+type subscribeStream struct {
+	grpc.ServerStream
+	ctx       context.Context
+	responses chan *SubscribeResponse
+}
+
+func (s *subscribeStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *subscribeStream) Send(response *SubscribeResponse) error {
+	select {
+	case s.responses <- response:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+// TestConcurrentPublishSubscribe is meant to be run with -race.
+func TestConcurrentPublishSubscribe(t *testing.T) {
+	const publishers, subscribers, batches, batchSize = 8, 4, 50, 5
+	config := DefaultServerConfig()
+	config.Topic.SegmentBytes = 4096
+	config.Topic.IndexIntervalBytes = 256
+	config.Topic.SyncMessages = 20
+	s := makeServer(t, config)
+	defer tidyServer(s)
+
+	// The topic has to exist before subscribing.
+	if _, err := s.PublishMulti(s.ctx, &PublishMultiRequest{Topic: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var subscribersDone sync.WaitGroup
+	for i := 0; i < subscribers; i++ {
+		stream := &subscribeStream{ctx: ctx, responses: make(chan *SubscribeResponse)}
+		go s.Subscribe(&SubscribeRequest{Topic: "test"}, stream)
+		subscribersDone.Add(1)
+		go func() {
+			defer subscribersDone.Done()
+			next := make(map[string]int)
+			for offset := uint64(0); offset < publishers*batches*batchSize; {
+				response := <-stream.responses
+				for _, message := range response.GetMessages() {
+					if message.Offset != offset {
+						t.Errorf("got offset %d expected %d", message.Offset, offset)
+						return
+					}
+					// Each publisher's messages must arrive in order.
+					var publisher string
+					var n int
+					fmt.Sscanf(string(message.Value), "%s %d", &publisher, &n)
+					if n != next[publisher] {
+						t.Errorf("got message %d from %s expected %d", n, publisher, next[publisher])
+						return
+					}
+					next[publisher]++
+					offset++
+				}
+			}
+		}()
+	}
+
+	var publishersDone sync.WaitGroup
+	for i := 0; i < publishers; i++ {
+		publishersDone.Add(1)
+		go func(publisher string) {
+			defer publishersDone.Done()
+			n := 0
+			for j := 0; j < batches; j++ {
+				request := PublishMultiRequest{Topic: "test"}
+				for k := 0; k < batchSize; k++ {
+					request.Messages = append(request.Messages, &Message{Value: []byte(fmt.Sprintf("%s %d", publisher, n))})
+					n++
+				}
+				reply, err := s.PublishMulti(s.ctx, &request)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if reply.LastOffset-reply.BaseOffset != batchSize-1 {
+					t.Errorf("got offsets %d-%d for a batch of %d", reply.BaseOffset, reply.LastOffset, batchSize)
+				}
+			}
+		}(fmt.Sprintf("publisher-%d", i))
+	}
+
+	publishersDone.Wait()
+	subscribersDone.Wait()
+}
+
+func TestRetention(t *testing.T) {
+	config := DefaultServerConfig()
+	config.Topic.SegmentBytes = 200
+	config.Topic.RetentionBytes = 400
+	s := makeServer(t, config)
+	defer tidyServer(s)
+
+	for i := 0; i < 50; i++ {
+		request := PublishMultiRequest{Topic: "test", Messages: []*Message{{Value: []byte(fmt.Sprint(i))}}}
+		if _, err := s.PublishMulti(s.ctx, &request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	topic, err := s.topic("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	partition := topic.partitions[0]
+	if err := partition.enforceRetention(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	partition.mu.Lock()
+	earliest := partition.earliestOffset()
+	partition.mu.Unlock()
+	if earliest == 0 {
+		t.Fatal("expected retention to delete the oldest message sets")
+	}
+
+	// Reads of deleted offsets fail rather than skipping ahead.
+	if _, err := s.Fetch(s.ctx, &FetchRequest{Topic: "test", Offset: 0}); grpc.Code(err) != codes.OutOfRange {
+		t.Fatalf("expected OutOfRange got %v", err)
+	}
+	reply, err := s.Fetch(s.ctx, &FetchRequest{Topic: "test", Offset: earliest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messages := reply.GetMessages(); len(messages) == 0 || messages[0].Offset != earliest {
+		t.Fatalf("expected messages from offset %d got %v", earliest, reply)
+	}
+
+	// Age based retention deletes everything but the active message set.
+	alter := AlterTopicConfigRequest{Topic: "test", Set: map[string]string{"retention.bytes": "0"}}
+	if _, err := s.AlterTopicConfig(s.ctx, &alter); err != nil {
+		t.Fatal(err)
+	}
+	if err := partition.enforceRetention(time.Now().Add(config.Topic.RetentionAge + time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	partition.mu.Lock()
+	remaining := len(partition.messageSets)
+	partition.mu.Unlock()
+	if remaining != 1 {
+		t.Fatalf("expected only the active message set left got %d", remaining)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	config := DefaultServerConfig()
+	config.Topic.CleanupPolicy = CleanupCompact
+	s := makeServer(t, config)
+	defer func() { tidyServer(s) }()
+
+	publish := []struct{ key, value string }{
+		{"a", "1"}, {"b", "1"}, {"", "unkeyed"}, {"a", "2"}, {"b", ""}, {"c", "1"}, {"a", "3"},
+		// The active message set is never compacted.
+		{"d", "1"},
+	}
+	var partition *Partition
+	for i, m := range publish {
+		request := PublishMultiRequest{Topic: "test", Messages: []*Message{{Key: []byte(m.key), Value: []byte(m.value)}}}
+		if _, err := s.PublishMulti(s.ctx, &request); err != nil {
+			t.Fatal(err)
+		}
+		if partition == nil {
+			topic, err := s.topic("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			partition = topic.partitions[0]
+		}
+		if i == len(publish)-1 {
+			break
+		}
+		// Every record but the last gets a sealed message set of its own,
+		// whatever size it encodes to.
+		partition.mu.Lock()
+		err := partition.roll()
+		partition.mu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	partition.mu.Lock()
+	var layout []string
+	for _, ms := range partition.messageSets {
+		layout = append(layout, fmt.Sprintf("[%d,%d)", ms.offsetBegin, ms.offsetEnd))
+	}
+	partition.mu.Unlock()
+	if fmt.Sprint(layout) != "[[0,1) [1,2) [2,3) [3,4) [4,5) [5,6) [6,7) [7,8)]" {
+		t.Fatalf("got message sets %v", layout)
+	}
+	read := func() string {
+		reply, err := s.Fetch(s.ctx, &FetchRequest{Topic: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var messages []string
+		for _, message := range reply.GetMessages() {
+			messages = append(messages, fmt.Sprintf("%d:%s=%s", message.Offset, message.Key, message.Value))
+		}
+		return fmt.Sprint(messages)
+	}
+	compact := func(now time.Time) {
+		topic, err := s.topic("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := topic.partitions[0].compact(s.ctx, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The tombstone for b is kept until TombstoneRetention has passed.
+	compact(time.Now())
+	expected := "[2:=unkeyed 4:b= 5:c=1 6:a=3 7:d=1]"
+	if got := read(); got != expected {
+		t.Fatalf("expected %s got %s", expected, got)
+	}
+
+	// The compacted message sets replace the originals on disk.
+	s.Close()
+	restarted, err := NewServer(s.dir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = restarted
+	if got := read(); got != expected {
+		t.Fatalf("expected %s after a restart got %s", expected, got)
+	}
+
+	compact(time.Now().Add(config.Topic.TombstoneRetention + time.Hour))
+	expected = "[2:=unkeyed 5:c=1 6:a=3 7:d=1]"
+	if got := read(); got != expected {
+		t.Fatalf("expected %s got %s", expected, got)
+	}
+}
+
+func TestBaselineMessageSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopubsub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Before batches, every record held a single message with no offset and
+	// the crc of nothing.
+	var buf []byte
+	for i := 0; i < 5; i++ {
+		payload, err := proto.Marshal(&Message{Value: []byte(fmt.Sprint(i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := make([]byte, 9)
+		binary.LittleEndian.PutUint32(header[0:4], uint32(len(payload)+5))
+		binary.LittleEndian.PutUint32(header[5:9], crc32.ChecksumIEEE(nil))
+		buf = append(append(buf, header...), payload...)
+	}
+	if err := os.MkdirAll(path.Join(dir, "test"), 0770); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "test", fmt.Sprintf("%012d.pubsub", 0)), buf, 0660); err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultServerConfig()
+	config.Topic.IndexIntervalBytes = 20
+	s, err := NewServer(dir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { s.Close() }()
+	request := PublishMultiRequest{Topic: "test", Messages: []*Message{{Value: []byte("5")}}}
+	if reply, err := s.PublishMulti(s.ctx, &request); err != nil {
+		t.Fatal(err)
+	} else if reply.BaseOffset != 5 {
+		t.Fatalf("expected the next offset to be 5 got %d", reply.BaseOffset)
+	}
+
+	// The old records are numbered by position, both when reading from the
+	// start and when seeking with the index, and again after a restart.
+	check := func() {
+		for _, offset := range []uint64{0, 3} {
+			reply, err := s.Fetch(s.ctx, &FetchRequest{Topic: "test", Offset: offset})
+			if err != nil {
+				t.Fatal(err)
+			}
+			messages := reply.GetMessages()
+			if len(messages) != int(6-offset) {
+				t.Fatalf("expected messages from %d got %v", offset, messages)
+			}
+			for i, message := range messages {
+				if expected := offset + uint64(i); message.Offset != expected || string(message.Value) != fmt.Sprint(expected) {
+					t.Fatalf("expected message %d got %v", expected, message)
+				}
+			}
+		}
+	}
+	check()
+	s.Close()
+	restarted, err := NewServer(dir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = restarted
+	check()
+}
+
+func TestCompression(t *testing.T) {
+	s := makeServer(t, DefaultServerConfig())
+	defer func() { tidyServer(s) }()
+
+	compressions := []Compression{Compression_NONE, Compression_GZIP, Compression_SNAPPY, Compression_ZSTD}
+	for _, compression := range compressions {
+		request := PublishMultiRequest{Topic: compression.String(), Compression: compression}
+		for i := 0; i < 10; i++ {
+			request.Messages = append(request.Messages, &Message{Key: []byte(fmt.Sprint(i)), Value: []byte(fmt.Sprintf("value %d", i))})
+		}
+		if _, err := s.PublishMulti(s.ctx, &request); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Batches are decoded from disk the same way after a restart.
+	s.Close()
+	restarted, err := NewServer(s.dir, DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = restarted
+	for _, compression := range compressions {
+		reply, err := s.Fetch(s.ctx, &FetchRequest{Topic: compression.String()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages := reply.GetMessages()
+		for _, batch := range reply.GetBatches() {
+			if batch.Compression != compression {
+				t.Errorf("expected a %s batch got %s", compression, batch.Compression)
+			}
+			decoded, err := DecodeRecordBatch(batch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			messages = append(messages, decoded...)
+		}
+		if len(messages) != 10 {
+			t.Fatalf("expected 10 %s messages got %v", compression, messages)
+		}
+		for i, message := range messages {
+			if message.Offset != uint64(i) || string(message.Key) != fmt.Sprint(i) || string(message.Value) != fmt.Sprintf("value %d", i) {
+				t.Errorf("expected %s message %d got %v", compression, i, message)
+			}
+		}
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	s := makeServer(t, DefaultServerConfig())
+	defer func() { tidyServer(s) }()
+
+	for i := 0; i < 5; i++ {
+		request := PublishMultiRequest{Topic: "test", Messages: []*Message{{Value: []byte(fmt.Sprint(i))}}}
+		if _, err := s.PublishMulti(s.ctx, &request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	// A crash partway through writing the last record leaves it torn.
+	messageSet := path.Join(s.dir, "test", "0", fmt.Sprintf("%012d.pubsub", 0))
+	info, err := os.Stat(messageSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(messageSet, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := NewServer(s.dir, DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = restarted
+
+	// The torn record is dropped and its offset is reused.
+	request := PublishMultiRequest{Topic: "test", Messages: []*Message{{Value: []byte("5")}}}
+	if reply, err := s.PublishMulti(s.ctx, &request); err != nil {
+		t.Fatal(err)
+	} else if reply.BaseOffset != 4 {
+		t.Fatalf("expected the torn offset 4 to be reused got %d", reply.BaseOffset)
+	}
+	reply, err := s.Fetch(s.ctx, &FetchRequest{Topic: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	for _, message := range reply.GetMessages() {
+		values = append(values, string(message.Value))
+	}
+	if fmt.Sprint(values) != "[0 1 2 3 5]" {
+		t.Fatalf("expected the torn message to be gone got %v", values)
+	}
+}
+
+func TestOffsetsAcrossRestart(t *testing.T) {
+	s := makeServer(t, DefaultServerConfig())
+	defer func() { tidyServer(s) }()
+
+	var offsets []uint64
+	publish := func(round int) {
+		for i := 0; i < 3; i++ {
+			request := PublishMultiRequest{Topic: "test", Messages: []*Message{
+				{Value: []byte(fmt.Sprint(round, i))}, {Value: []byte(fmt.Sprint(round, i))},
+			}}
+			reply, err := s.PublishMulti(s.ctx, &request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for offset := reply.BaseOffset; offset <= reply.LastOffset; offset++ {
+				offsets = append(offsets, offset)
+			}
+		}
+	}
+
+	publish(0)
+	s.Close()
+	restarted, err := NewServer(s.dir, DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = restarted
+	publish(1)
+
+	// Offsets carry on from where the log ended, without gaps or reuse.
+	for i, offset := range offsets {
+		if offset != uint64(i) {
+			t.Fatalf("expected offsets 0 to %d in order got %v", len(offsets)-1, offsets)
+		}
+	}
+	reply, err := s.Fetch(s.ctx, &FetchRequest{Topic: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetched []uint64
+	for _, message := range reply.GetMessages() {
+		fetched = append(fetched, message.Offset)
+	}
+	if fmt.Sprint(fetched) != fmt.Sprint(offsets) {
+		t.Fatalf("expected to fetch offsets %v got %v", offsets, fetched)
+	}
+}
+
+func TestSegments(t *testing.T) {
+	s := makeServer(t, DefaultServerConfig())
+	defer tidyServer(s)
+
+	publish := func(value string) {
+		request := PublishMultiRequest{Topic: "test", Messages: []*Message{{Value: []byte(value)}}}
+		if _, err := s.PublishMulti(s.ctx, &request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish("a")
+	publish("b")
+	partition := s.topics["test"].partitions[0]
+	partition.mu.Lock()
+	err := partition.roll()
+	partition.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish("c")
+	layout := func() string {
+		partition.mu.Lock()
+		defer partition.mu.Unlock()
+		var layout []string
+		for _, ms := range partition.messageSets {
+			layout = append(layout, fmt.Sprintf("[%d,%d)", ms.offsetBegin, ms.offsetEnd))
+		}
+		return fmt.Sprint(layout)
+	}
+	if got := layout(); got != "[[0,2) [2,3)]" {
+		t.Fatalf("got message sets %v", got)
+	}
+
+	// A reader carries on from a sealed message set into the next.
+	ctx, cancel := context.WithTimeout(s.ctx, 5*time.Second)
+	defer cancel()
+	r, err := NewPartitionReader(ctx, partition, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	read := func() string {
+		message, err := r.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("%d:%s", message.Offset, message.Value)
+	}
+	if got := fmt.Sprint(read(), " ", read()); got != "1:b 2:c" {
+		t.Fatalf("got %s", got)
+	}
+
+	// Once the active message set is older than SegmentAge, the next publish
+	// rolls it, and a reader waiting at the end follows.
+	partition.mu.Lock()
+	partition.active().created = time.Now().Add(-partition.Config().SegmentAge)
+	partition.mu.Unlock()
+	waiting := make(chan string, 1)
+	go func() {
+		message, err := r.ReadMessage()
+		if err != nil {
+			waiting <- err.Error()
+			return
+		}
+		waiting <- fmt.Sprintf("%d:%s", message.Offset, message.Value)
+	}()
+	publish("d")
+	publish("e")
+	if got := layout(); got != "[[0,2) [2,3) [3,5)]" {
+		t.Fatalf("got message sets %v", got)
+	}
+	if got := fmt.Sprint(<-waiting, " ", read()); got != "3:d 4:e" {
+		t.Fatalf("got %s", got)
+	}
+}
+
+func TestTopicAdmin(t *testing.T) {
+	config := DefaultServerConfig()
+	config.AutoCreateTopics = false
+	s := makeServer(t, config)
+	defer tidyServer(s)
+
+	request := PublishMultiRequest{Topic: "test", Messages: []*Message{{Value: []byte("a")}, {Value: []byte("b")}}}
+	if _, err := s.PublishMulti(s.ctx, &request); grpc.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound publishing to a missing topic got %v", err)
+	}
+
+	create := CreateTopicRequest{Topic: "test", Config: map[string]string{"cleanup.policy": CleanupCompact}}
+	if _, err := s.CreateTopic(s.ctx, &create); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateTopic(s.ctx, &create); grpc.Code(err) != codes.AlreadyExists {
+		t.Fatalf("expected AlreadyExists got %v", err)
+	}
+	bad := CreateTopicRequest{Topic: "bad", Config: map[string]string{"segment.bytes": "lots"}}
+	if _, err := s.CreateTopic(s.ctx, &bad); grpc.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument got %v", err)
+	}
+	if _, err := s.PublishMulti(s.ctx, &request); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := s.ListTopics(s.ctx, &ListTopicsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Topics) != 1 || list.Topics[0] != "test" {
+		t.Fatalf("expected [test] got %v", list.Topics)
+	}
+
+	describe, err := s.DescribeTopic(s.ctx, &DescribeTopicRequest{Topic: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(describe.Partitions) != 1 {
+		t.Fatalf("expected 1 partition got %v", describe.Partitions)
+	}
+	if p := describe.Partitions[0]; p.EarliestOffset != 0 || p.LatestOffset != 2 || p.Segments != 1 || p.Bytes == 0 {
+		t.Errorf("unexpected description: %v", describe)
+	}
+	if policy := describe.Config["cleanup.policy"]; policy != CleanupCompact {
+		t.Errorf("expected cleanup.policy %s got %s", CleanupCompact, policy)
+	}
+
+	if _, err := s.DeleteTopic(s.ctx, &DeleteTopicRequest{Topic: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DescribeTopic(s.ctx, &DescribeTopicRequest{Topic: "test"}); grpc.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound describing a deleted topic got %v", err)
+	}
+	if _, err := os.Stat(path.Join(s.dir, "test")); !os.IsNotExist(err) {
+		t.Errorf("expected topic directory to be removed got %v", err)
+	}
+}
+
+func TestAlterTopicConfig(t *testing.T) {
+	s := makeServer(t, DefaultServerConfig())
+	defer func() { tidyServer(s) }()
+
+	create := CreateTopicRequest{Topic: "test", Config: map[string]string{"retention.age": "1h"}}
+	if _, err := s.CreateTopic(s.ctx, &create); err != nil {
+		t.Fatal(err)
+	}
+	alter := AlterTopicConfigRequest{Topic: "test", Set: map[string]string{"max.message.bytes": "4"}}
+	reply, err := s.AlterTopicConfig(s.ctx, &alter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Config["max.message.bytes"] != "4" || reply.Config["retention.age"] != "1h0m0s" {
+		t.Errorf("unexpected config: %v", reply.Config)
+	}
+
+	// The new limit applies to the running topic.
+	request := PublishMultiRequest{Topic: "test", Messages: []*Message{{Value: []byte("too long")}}}
+	if _, err := s.PublishMulti(s.ctx, &request); grpc.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument got %v", err)
+	}
+	invalid := AlterTopicConfigRequest{Topic: "test", Set: map[string]string{"cleanup.policy": "shred"}}
+	if _, err := s.AlterTopicConfig(s.ctx, &invalid); grpc.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument got %v", err)
+	}
+	// Negative values are rejected, as are segments bigger than their index
+	// can address.
+	for key, value := range map[string]string{"segment.bytes": "5000000000", "retention.bytes": "-1", "retention.age": "-1h"} {
+		invalid = AlterTopicConfigRequest{Topic: "test", Set: map[string]string{key: value}}
+		if _, err := s.AlterTopicConfig(s.ctx, &invalid); grpc.Code(err) != codes.InvalidArgument {
+			t.Fatalf("expected InvalidArgument for %s=%s got %v", key, value, err)
+		}
+	}
+	internal := AlterTopicConfigRequest{Topic: OffsetsTopic, Set: map[string]string{"retention.age": "1h"}}
+	if _, err := s.AlterTopicConfig(s.ctx, &internal); grpc.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument got %v", err)
+	}
+
+	// Overrides survive a restart and removed ones go back to the defaults.
+	alter = AlterTopicConfigRequest{Topic: "test", Remove: []string{"retention.age"}}
+	if _, err := s.AlterTopicConfig(s.ctx, &alter); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	restarted, err := NewServer(s.dir, DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = restarted
+	describe, err := s.DescribeTopic(s.ctx, &DescribeTopicRequest{Topic: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if describe.Config["max.message.bytes"] != "4" || describe.Config["retention.age"] != DefaultTopicConfig().RetentionAge.String() {
+		t.Errorf("unexpected config after restart: %v", describe.Config)
+	}
+}
+
+func TestPartitionByKey(t *testing.T) {
+	const partitions, keys, perKey = 4, 20, 5
+	s := makeServer(t, DefaultServerConfig())
+	defer tidyServer(s)
+
+	if _, err := s.CreateTopic(s.ctx, &CreateTopicRequest{Topic: "test", Partitions: partitions}); err != nil {
+		t.Fatal(err)
+	}
+	request := PublishMultiRequest{Topic: "test", Partition: partitions}
+	if _, err := s.PublishMulti(s.ctx, &request); grpc.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument got %v", err)
+	}
+
+	request = PublishMultiRequest{Topic: "test", Partition: PartitionByKey}
+	for i := 0; i < perKey; i++ {
+		for k := 0; k < keys; k++ {
+			request.Messages = append(request.Messages, &Message{Key: []byte(fmt.Sprint(k)), Value: []byte(fmt.Sprint(i))})
+		}
+	}
+	reply, err := s.PublishMulti(s.ctx, &request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Partitions) < 2 {
+		t.Fatalf("expected keys to be spread over partitions got %v", reply.Partitions)
+	}
+
+	// Every key is in exactly one partition with its messages in order.
+	seen := make(map[string]int32)
+	for _, offsets := range reply.Partitions {
+		r, err := NewPartitionReader(s.ctx, s.topics["test"].partitions[offsets.Partition], 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next := make(map[string]int)
+		for offset := uint64(0); offset <= offsets.LastOffset; offset++ {
+			message, err := r.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := string(message.Key)
+			if partition, ok := seen[key]; ok && partition != offsets.Partition {
+				t.Errorf("key %s in partitions %d and %d", key, partition, offsets.Partition)
+			}
+			seen[key] = offsets.Partition
+			if value := string(message.Value); value != fmt.Sprint(next[key]) {
+				t.Errorf("got %s for key %s expected %d", value, key, next[key])
+			}
+			next[key]++
+		}
+		r.Close()
+	}
+	if len(seen) != keys {
+		t.Errorf("expected %d keys got %d", keys, len(seen))
+	}
+}
+
+func TestCommittedOffsets(t *testing.T) {
+	s := makeServer(t, DefaultServerConfig())
+	defer func() { tidyServer(s) }()
+
+	request := PublishMultiRequest{Topic: "test"}
+	for i := 0; i < 10; i++ {
+		request.Messages = append(request.Messages, &Message{Value: []byte(fmt.Sprint(i))})
+	}
+	if _, err := s.PublishMulti(s.ctx, &request); err != nil {
+		t.Fatal(err)
+	}
+
+	fetch := FetchCommittedOffsetRequest{Group: "group", Topic: "test"}
+	if reply, err := s.FetchCommittedOffset(s.ctx, &fetch); err != nil || reply.Committed {
+		t.Fatalf("expected nothing committed got %v %v", reply, err)
+	}
+	commit := CommitOffsetRequest{Group: "group", Topic: "test", Offset: 7, Metadata: "m"}
+	if _, err := s.CommitOffset(s.ctx, &commit); err != nil {
+		t.Fatal(err)
+	}
+	commit = CommitOffsetRequest{Group: "group", Topic: "test", Partition: 1, Offset: 7}
+	if _, err := s.CommitOffset(s.ctx, &commit); grpc.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument got %v", err)
+	}
+
+	// Commits survive a restart.
+	s.Close()
+	restarted, err := NewServer(s.dir, DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = restarted
+	reply, err := s.FetchCommittedOffset(s.ctx, &fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reply.Committed || reply.Offset != 7 || reply.Metadata != "m" {
+		t.Fatalf("unexpected committed offset: %v", reply)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := &subscribeStream{ctx: ctx, responses: make(chan *SubscribeResponse)}
+	go s.Subscribe(&SubscribeRequest{Topic: "test", Group: "group"}, stream)
+	response := <-stream.responses
+	if messages := response.GetMessages(); len(messages) == 0 || messages[0].Offset != 7 {
+		t.Errorf("expected to resume at offset 7 got %v", messages)
+	}
+}
+
+func TestConsumerGroup(t *testing.T) {
+	config := DefaultServerConfig()
+	config.Partitions = 4
+	s := makeServer(t, config)
+	defer tidyServer(s)
+	if _, err := s.CreateTopic(s.ctx, &CreateTopicRequest{Topic: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	join := JoinGroupRequest{Group: "group", Topics: []string{"test"}}
+	first, err := s.JoinGroup(s.ctx, &join)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := first.GetAssignment(); len(a) != 1 || len(a[0].Partitions) != 4 {
+		t.Fatalf("expected all 4 partitions got %v", a)
+	}
+	second, err := s.JoinGroup(s.ctx, &join)
+	if err != nil {
+		t.Fatal(err)
+	}
+	heartbeat, err := s.Heartbeat(s.ctx, &HeartbeatRequest{Group: "group", MemberId: first.MemberId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if heartbeat.Generation != second.Generation {
+		t.Fatalf("expected generation %d got %d", second.Generation, heartbeat.Generation)
+	}
+	if a, b := heartbeat.GetAssignment(), second.GetAssignment(); len(a[0].Partitions) != 2 || len(b[0].Partitions) != 2 {
+		t.Fatalf("expected an even split got %v and %v", a, b)
+	}
+
+	// The first member's old generation is fenced off.
+	commit := CommitOffsetRequest{Group: "group", Topic: "test", Partition: 0, MemberId: first.MemberId, Generation: first.Generation}
+	if _, err := s.CommitOffset(s.ctx, &commit); grpc.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition got %v", err)
+	}
+	commit.Generation = heartbeat.Generation
+	commit.Partition = heartbeat.GetAssignment()[0].Partitions[0]
+	if _, err := s.CommitOffset(s.ctx, &commit); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.LeaveGroup(s.ctx, &LeaveGroupRequest{Group: "group", MemberId: second.MemberId}); err != nil {
+		t.Fatal(err)
+	}
+	heartbeat, err = s.Heartbeat(s.ctx, &HeartbeatRequest{Group: "group", MemberId: first.MemberId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := heartbeat.GetAssignment(); len(a[0].Partitions) != 4 {
+		t.Fatalf("expected all 4 partitions after a leave got %v", a)
+	}
+	if _, err := s.Heartbeat(s.ctx, &HeartbeatRequest{Group: "group", MemberId: second.MemberId}); grpc.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound got %v", err)
+	}
+
+	// Members that stop heartbeating are removed.
+	join.SessionTimeoutMs = 1
+	if _, err := s.JoinGroup(s.ctx, &join); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	heartbeat, err = s.Heartbeat(s.ctx, &HeartbeatRequest{Group: "group", MemberId: first.MemberId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := heartbeat.GetAssignment(); len(a[0].Partitions) != 4 {
+		t.Fatalf("expected all 4 partitions after a timeout got %v", a)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	s := makeServer(t, DefaultServerConfig())
+	defer tidyServer(s)
+
+	request := PublishMultiRequest{Topic: "test"}
+	for i := 0; i < 10; i++ {
+		request.Messages = append(request.Messages, &Message{Value: []byte(fmt.Sprint(i))})
+	}
+	if _, err := s.PublishMulti(s.ctx, &request); err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := s.Fetch(s.ctx, &FetchRequest{Topic: "test", Offset: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messages := reply.GetMessages(); len(messages) != 7 || messages[0].Offset != 3 || reply.HighWatermark != 10 {
+		t.Fatalf("unexpected fetch: %v", reply)
+	}
+
+	// Caught up fetches wait up to max_wait_ms for min_bytes.
+	start := time.Now()
+	reply, err = s.Fetch(s.ctx, &FetchRequest{Topic: "test", Offset: 10, MinBytes: 1, MaxWaitMs: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.GetMessages()) != 0 || time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("expected an empty fetch after waiting got %v", reply)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.PublishMulti(s.ctx, &PublishMultiRequest{Topic: "test", Messages: []*Message{{Value: []byte("10")}}})
+	}()
+	reply, err = s.Fetch(s.ctx, &FetchRequest{Topic: "test", Offset: 10, MinBytes: 1, MaxWaitMs: 10000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messages := reply.GetMessages(); len(messages) != 1 || messages[0].Offset != 10 {
+		t.Fatalf("expected the new message got %v", reply)
+	}
+
+	// Compressed batches and uncompressed messages come back in offset order.
+	for i, compression := range []Compression{Compression_GZIP, Compression_NONE, Compression_GZIP} {
+		request := PublishMultiRequest{Topic: "mixed", Compression: compression}
+		for j := 0; j < 3; j++ {
+			request.Messages = append(request.Messages, &Message{Value: []byte(fmt.Sprint(i*3 + j))})
+		}
+		if _, err := s.PublishMulti(s.ctx, &request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for offset := uint64(0); offset < 9; {
+		reply, err := s.Fetch(s.ctx, &FetchRequest{Topic: "mixed", Offset: offset})
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages := reply.GetMessages()
+		for _, batch := range reply.GetBatches() {
+			decoded, err := DecodeRecordBatch(batch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			messages = append(messages, decoded...)
+		}
+		if len(messages) == 0 {
+			t.Fatalf("expected messages from offset %d got %v", offset, reply)
+		}
+		for _, message := range messages {
+			if message.Offset != offset || string(message.Value) != fmt.Sprint(offset) {
+				t.Fatalf("expected message %d got %v", offset, message)
+			}
+			offset++
+		}
+	}
+}
+
+func TestSubscribeMixedCompression(t *testing.T) {
+	s := makeServer(t, DefaultServerConfig())
+	defer tidyServer(s)
+
+	for i, compression := range []Compression{Compression_NONE, Compression_SNAPPY, Compression_SNAPPY, Compression_NONE} {
+		request := PublishMultiRequest{Topic: "test", Compression: compression}
+		for j := 0; j < 3; j++ {
+			request.Messages = append(request.Messages, &Message{Value: []byte(fmt.Sprint(i*3 + j))})
+		}
+		if _, err := s.PublishMulti(s.ctx, &request); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := &subscribeStream{ctx: ctx, responses: make(chan *SubscribeResponse)}
+	go s.Subscribe(&SubscribeRequest{Topic: "test"}, stream)
+	var responses int
+	for offset := uint64(0); offset < 12; responses++ {
+		response := <-stream.responses
+		if len(response.GetMessages()) > 0 && len(response.GetBatches()) > 0 {
+			t.Fatalf("expected messages or batches got both: %v", response)
+		}
+		messages := response.GetMessages()
+		for _, batch := range response.GetBatches() {
+			decoded, err := DecodeRecordBatch(batch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			messages = append(messages, decoded...)
+		}
+		for _, message := range messages {
+			if message.Offset != offset || string(message.Value) != fmt.Sprint(offset) {
+				t.Fatalf("expected message %d got %v", offset, message)
+			}
+			offset++
+		}
+	}
+	// The compressed batches are still coalesced together.
+	if responses != 3 {
+		t.Errorf("expected 3 responses got %d", responses)
+	}
+}
+
+func TestStartPosition(t *testing.T) {
+	config := DefaultServerConfig()
+	config.Topic.IndexIntervalBytes = 1
+	s := makeServer(t, config)
+	defer func() { tidyServer(s) }()
+
+	for i := int64(1); i <= 5; i++ {
+		message := &Message{Timestamp: i * 1000, Value: []byte(fmt.Sprint(i))}
+		if _, err := s.PublishMulti(s.ctx, &PublishMultiRequest{Topic: "test", Messages: []*Message{message}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []struct {
+		position  StartPosition
+		timestamp int64
+		offset    uint64
+	}{
+		{StartPosition_EARLIEST, 0, 0},
+		{StartPosition_LATEST, 0, 5},
+		{StartPosition_TIMESTAMP, 0, 0},
+		{StartPosition_TIMESTAMP, 2500, 2},
+		{StartPosition_TIMESTAMP, 3000, 2},
+		{StartPosition_TIMESTAMP, 3001, 3},
+		{StartPosition_TIMESTAMP, 6000, 5},
+	}
+	for restart := 0; restart < 2; restart++ {
+		if restart > 0 {
+			// The time index is rebuilt on restart.
+			s.Close()
+			restarted, err := NewServer(s.dir, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s = restarted
+		}
+		for _, e := range expected {
+			reply, err := s.ListOffsets(s.ctx, &ListOffsetsRequest{Topic: "test", Position: e.position, Timestamp: e.timestamp})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.Offset != e.offset {
+				t.Errorf("%s %d: expected offset %d got %d", e.position, e.timestamp, e.offset, reply.Offset)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := &subscribeStream{ctx: ctx, responses: make(chan *SubscribeResponse)}
+	go s.Subscribe(&SubscribeRequest{Topic: "test", Start: StartPosition_LATEST}, stream)
+	time.Sleep(10 * time.Millisecond)
+	if _, err := s.PublishMulti(s.ctx, &PublishMultiRequest{Topic: "test", Messages: []*Message{{Value: []byte("6")}}}); err != nil {
+		t.Fatal(err)
+	}
+	response := <-stream.responses
+	if messages := response.GetMessages(); len(messages) != 1 || messages[0].Offset != 5 || messages[0].Timestamp == 0 {
+		t.Errorf("expected only the new message with a timestamp got %v", messages)
+	}
+}
+
+func TestTimestampsAndHeaders(t *testing.T) {
+	s := makeServer(t, DefaultServerConfig())
+	defer tidyServer(s)
+
+	create := CreateTopicRequest{Topic: "append", Config: map[string]string{"message.timestamp.type": TimestampLogAppendTime}}
+	if _, err := s.CreateTopic(s.ctx, &create); err != nil {
+		t.Fatal(err)
+	}
+	create = CreateTopicRequest{Topic: "bad", Config: map[string]string{"message.timestamp.type": "Whenever"}}
+	if _, err := s.CreateTopic(s.ctx, &create); grpc.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument got %v", err)
+	}
+
+	for _, topic := range []string{"test", "append"} {
+		message := &Message{
+			Timestamp: 1000,
+			Headers:   []*Header{{Key: "trace-id", Value: []byte("abc")}},
+			Value:     []byte("v"),
+		}
+		if _, err := s.PublishMulti(s.ctx, &PublishMultiRequest{Topic: topic, Messages: []*Message{message}}); err != nil {
+			t.Fatal(err)
+		}
+
+		reply, err := s.Fetch(s.ctx, &FetchRequest{Topic: topic})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reply.GetMessages()) != 1 {
+			t.Fatalf("expected 1 message got %v", reply)
+		}
+		fetched := reply.GetMessages()[0]
+		if headers := fetched.GetHeaders(); len(headers) != 1 || headers[0].Key != "trace-id" || string(headers[0].Value) != "abc" {
+			t.Errorf("%s: unexpected headers %v", topic, headers)
+		}
+		if logAppendTime := topic == "append"; (fetched.Timestamp == 1000) == logAppendTime {
+			t.Errorf("%s: unexpected timestamp %d", topic, fetched.Timestamp)
+		}
+	}
+}
+
+func TestAcks(t *testing.T) {
+	s := makeServer(t, DefaultServerConfig())
+	defer tidyServer(s)
+
+	request := PublishMultiRequest{Topic: "test", Acks: Acks_NONE, Messages: []*Message{{Value: []byte("0")}}}
+	reply, err := s.PublishMulti(s.ctx, &request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.GetPartitions()) != 0 {
+		t.Errorf("expected no offsets without acks got %v", reply)
+	}
+	fetched, err := s.Fetch(s.ctx, &FetchRequest{Topic: "test", MinBytes: 1, MaxWaitMs: 10000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fetched.GetMessages()) != 1 {
+		t.Fatalf("expected the unacknowledged message to be written got %v", fetched)
+	}
+
+	request = PublishMultiRequest{Topic: "test", Acks: Acks_ALL, Messages: []*Message{{Value: []byte("1")}}}
+	if reply, err = s.PublishMulti(s.ctx, &request); err != nil {
+		t.Fatal(err)
+	}
+	partition := s.topics["test"].partitions[0]
+	partition.syncMu.Lock()
+	synced := partition.synced
+	partition.syncMu.Unlock()
+	if reply.LastOffset != 1 || synced < 2 {
+		t.Errorf("expected offset 1 to be synced got %v synced to %d", reply, synced)
+	}
+}
+
+func TestSyncPolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages int64
+		interval time.Duration
+	}{
+		{"none", 0, 0},
+		{"messages", 2, 0},
+		{"interval", 0, 10 * time.Millisecond},
+	}
+	for _, test := range tests {
+		config := DefaultServerConfig()
+		config.Topic.SyncMessages = test.messages
+		config.Topic.SyncInterval = test.interval
+		s := makeServer(t, config)
+		var partition *Partition
+		synced := func() uint64 {
+			partition.syncMu.Lock()
+			defer partition.syncMu.Unlock()
+			return partition.synced
+		}
+		publish := func(value string) {
+			request := PublishMultiRequest{Topic: "test", Messages: []*Message{{Value: []byte(value)}}}
+			if _, err := s.PublishMulti(s.ctx, &request); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		publish("a")
+		partition = s.topics["test"].partitions[0]
+		switch test.name {
+		case "none", "messages":
+			if got := synced(); got != 0 {
+				t.Errorf("%s: expected nothing synced after one message got %d", test.name, got)
+			}
+		case "interval":
+			waitFor(t, "the periodic sync", func() bool { return synced() == 1 })
+		}
+		publish("b")
+		switch test.name {
+		case "none":
+			if got := synced(); got != 0 {
+				t.Errorf("%s: expected nothing synced after two messages got %d", test.name, got)
+			}
+		case "messages":
+			if got := synced(); got != 2 {
+				t.Errorf("%s: expected the second message to sync got %d", test.name, got)
+			}
+		case "interval":
+			waitFor(t, "the periodic sync", func() bool { return synced() == 2 })
+		}
+
+		// Rolling always makes the sealed message set durable.
+		partition.mu.Lock()
+		err := partition.roll()
+		partition.mu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := synced(); got != 2 {
+			t.Errorf("%s: expected the roll to sync got %d", test.name, got)
+		}
+		tidyServer(s)
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	s := makeServer(t, DefaultServerConfig())
+	defer tidyServer(s)
+
+	request := PublishMultiRequest{Topic: "test", Messages: []*Message{{Value: []byte("a")}, {Value: []byte("b")}}}
+	if _, err := s.PublishMulti(s.ctx, &request); err != nil {
+		t.Fatal(err)
+	}
+	partition := s.topics["test"].partitions[0]
+
+	// Holding mu stops the first caller before its fsync, so the rest pile up
+	// behind it and are covered by it.
+	const callers = 8
+	errs := make(chan error, callers)
+	partition.mu.Lock()
+	for i := 0; i < callers; i++ {
+		go func() { errs <- partition.syncTo(2) }()
+	}
+	time.Sleep(10 * time.Millisecond)
+	partition.mu.Unlock()
+	for i := 0; i < callers; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	partition.syncMu.Lock()
+	synced, syncs := partition.synced, partition.syncs
+	partition.syncMu.Unlock()
+	if synced != 2 || syncs != 1 {
+		t.Errorf("expected one fsync to offset 2 got %d to offset %d", syncs, synced)
+	}
+
+	// Syncing past the end, as a caller whose append was truncated would,
+	// syncs what there is and returns.
+	done := make(chan error, 1)
+	go func() { done <- partition.syncTo(10) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out syncing past the end of the partition")
+	}
+}
+
+func TestIdempotentProducer(t *testing.T) {
+	s := makeServer(t, DefaultServerConfig())
+	defer func() { tidyServer(s) }()
+
+	producer, err := s.InitProducerId(s.ctx, &InitProducerIdRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish := func(s *Server, sequence int32) (*PublishMultiReply, error) {
+		request := PublishMultiRequest{
+			Topic:      "test",
+			ProducerId: producer.ProducerId,
+			Sequence:   sequence,
+			Messages:   []*Message{{Value: []byte(fmt.Sprint(sequence))}, {Value: []byte(fmt.Sprint(sequence))}},
+		}
+		return s.PublishMulti(s.ctx, &request)
+	}
+
+	first, err := publish(s, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retry, err := publish(s, 0); err != nil || retry.BaseOffset != first.BaseOffset || retry.LastOffset != first.LastOffset {
+		t.Fatalf("expected the retry to get %v got %v %v", first, retry, err)
+	}
+	if _, err := publish(s, 2); grpc.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition got %v", err)
+	}
+	second, err := publish(s, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.BaseOffset != 2 {
+		t.Fatalf("expected the duplicate to be dropped got %v", second)
+	}
+	if _, err := publish(s, 0); grpc.Code(err) != codes.AlreadyExists {
+		t.Fatalf("expected AlreadyExists got %v", err)
+	}
+
+	// Sequences are recovered from the log on restart.
+	s.Close()
+	restarted, err := NewServer(s.dir, DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = restarted
+	if retry, err := publish(s, 1); err != nil || retry.BaseOffset != second.BaseOffset || retry.LastOffset != second.LastOffset {
+		t.Fatalf("expected the retry to get %v got %v %v", second, retry, err)
+	}
+	if third, err := publish(s, 2); err != nil || third.BaseOffset != 4 {
+		t.Fatalf("expected offset 4 got %v %v", third, err)
+	}
+
+	// Retries wait for the original to be appended, and a failed publish
+	// leaves its sequence to be used again.
+	_, finish, err := s.topics["test"].beginSequence(producer.ProducerId, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := publish(s, 3); grpc.Code(err) != codes.Unavailable {
+		t.Fatalf("expected Unavailable got %v", err)
+	}
+	finish(nil)
+	if fourth, err := publish(s, 3); err != nil || fourth.BaseOffset != 6 {
+		t.Fatalf("expected offset 6 got %v %v", fourth, err)
+	}
+
+	// Without offsets to answer retries with, there's no deduplicating.
+	request := PublishMultiRequest{Topic: "test", ProducerId: producer.ProducerId, Sequence: 4, Acks: Acks_NONE}
+	if _, err := s.PublishMulti(s.ctx, &request); grpc.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument got %v", err)
+	}
+}
+
+// readValues returns the values of every message currently readable from a
+// partition.
+func readValues(t *testing.T, partition *Partition, readCommitted bool) []string {
+	reader, err := NewPartitionReader(context.Background(), partition, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	reader.readCommitted = readCommitted
+	var values []string
+	for {
+		batch, err := reader.TryReadBatch()
+		if err != nil {
+			t.Fatal(err)
+		} else if batch == nil {
+			return values
+		}
+		messages, err := DecodeRecordBatch(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, message := range messages {
+			values = append(values, string(message.Value))
+		}
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	s := makeServer(t, DefaultServerConfig())
+	defer func() { tidyServer(s) }()
+
+	producer, err := s.InitProducerId(s.ctx, &InitProducerIdRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := producer.ProducerId
+	sequences := make(map[string]int32)
+	publish := func(s *Server, topic string, value string, transactional bool) {
+		request := PublishMultiRequest{Topic: topic, Messages: []*Message{{Value: []byte(value)}}}
+		if transactional {
+			request.ProducerId, request.Sequence, request.Transactional = id, sequences[topic], true
+			sequences[topic]++
+		}
+		if _, err := s.PublishMulti(s.ctx, &request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(s *Server, topic string, readCommitted bool, expected string) {
+		values := fmt.Sprint(readValues(t, s.topics[topic].partitions[0], readCommitted))
+		if values != expected {
+			t.Errorf("%s read committed %v: expected %s got %s", topic, readCommitted, expected, values)
+		}
+	}
+
+	if _, err := s.BeginTransaction(s.ctx, &BeginTransactionRequest{ProducerId: id}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.BeginTransaction(s.ctx, &BeginTransactionRequest{ProducerId: id}); grpc.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition got %v", err)
+	}
+	publish(s, "orders", "order", true)
+	publish(s, "inventory", "inventory", true)
+	publish(s, "orders", "other", false)
+	expect(s, "orders", false, "[order other]")
+	expect(s, "orders", true, "[]")
+	if _, err := s.CommitTransaction(s.ctx, &CommitTransactionRequest{ProducerId: id}); err != nil {
+		t.Fatal(err)
+	}
+	expect(s, "orders", true, "[order other]")
+	expect(s, "inventory", true, "[inventory]")
+
+	if _, err := s.BeginTransaction(s.ctx, &BeginTransactionRequest{ProducerId: id}); err != nil {
+		t.Fatal(err)
+	}
+	publish(s, "orders", "aborted", true)
+	if _, err := s.AbortTransaction(s.ctx, &AbortTransactionRequest{ProducerId: id}); err != nil {
+		t.Fatal(err)
+	}
+	publish(s, "orders", "after", false)
+	expect(s, "orders", true, "[order other after]")
+	expect(s, "orders", false, "[order other aborted after]")
+
+	// Transactions left open are aborted on restart, unless their commit was
+	// logged before the crash.
+	if _, err := s.BeginTransaction(s.ctx, &BeginTransactionRequest{ProducerId: id}); err != nil {
+		t.Fatal(err)
+	}
+	publish(s, "orders", "interrupted", true)
+	s.Close()
+	restarted, err := NewServer(s.dir, DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = restarted
+	expect(s, "orders", true, "[order other after]")
+
+	if _, err := s.BeginTransaction(s.ctx, &BeginTransactionRequest{ProducerId: id}); err != nil {
+		t.Fatal(err)
+	}
+	publish(s, "inventory", "decided", true)
+	decision := TransactionDecision{Partitions: []*TopicPartitions{{Topic: "inventory", Partitions: []int32{0}}}}
+	if err := s.transactions.log(s.ctx, id, &decision); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if restarted, err = NewServer(s.dir, DefaultServerConfig()); err != nil {
+		t.Fatal(err)
+	}
+	s = restarted
+	expect(s, "inventory", true, "[inventory decided]")
+}
+
+func TestUnfinishedTransactions(t *testing.T) {
+	config := DefaultServerConfig()
+	config.TransactionTimeout = 100 * time.Millisecond
+	s := makeServer(t, config)
+	defer tidyServer(s)
+
+	producer, err := s.InitProducerId(s.ctx, &InitProducerIdRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := producer.ProducerId
+	var sequence int32
+	publish := func(value string) {
+		request := PublishMultiRequest{Topic: "orders", Messages: []*Message{{Value: []byte(value)}}, ProducerId: id, Sequence: sequence, Transactional: true}
+		sequence++
+		if _, err := s.PublishMulti(s.ctx, &request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stable := func(partition *Partition) bool {
+		partition.mu.Lock()
+		defer partition.mu.Unlock()
+		return partition.lastStableOffset() == partition.highWatermark()
+	}
+
+	// A commit whose marker can't be written leaves the transaction open, and
+	// the coordinator finishes it once the marker can be.
+	if _, err := s.BeginTransaction(s.ctx, &BeginTransactionRequest{ProducerId: id}); err != nil {
+		t.Fatal(err)
+	}
+	publish("committed")
+	partition := s.topics["orders"].partitions[0]
+	partition.mu.Lock()
+	partition.leader = partition.self + 1
+	partition.mu.Unlock()
+	if _, err := s.CommitTransaction(s.ctx, &CommitTransactionRequest{ProducerId: id}); err == nil {
+		t.Fatal("expected the commit to fail without the partition's leader")
+	}
+	if _, err := s.BeginTransaction(s.ctx, &BeginTransactionRequest{ProducerId: id}); grpc.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected the transaction to still be open got %v", err)
+	}
+	if _, err := s.AbortTransaction(s.ctx, &AbortTransactionRequest{ProducerId: id}); grpc.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected a commit being finished not to abort got %v", err)
+	}
+	if stable(partition) {
+		t.Fatal("expected the open transaction to hold back the last stable offset")
+	}
+	partition.mu.Lock()
+	partition.leader = partition.self
+	partition.mu.Unlock()
+	// Once it's finished, the producer can begin its next transaction.
+	waitFor(t, "the commit to be finished", func() bool {
+		_, err := s.BeginTransaction(s.ctx, &BeginTransactionRequest{ProducerId: id})
+		return err == nil
+	})
+	if !stable(partition) {
+		t.Error("expected the finished transaction to release the last stable offset")
+	}
+	if values := fmt.Sprint(readValues(t, partition, true)); values != "[committed]" {
+		t.Errorf("got %s", values)
+	}
+
+	// A transaction left open past the timeout is aborted.
+	publish("abandoned")
+	waitFor(t, "the transaction to time out", func() bool { return stable(partition) })
+	if values := fmt.Sprint(readValues(t, partition, true)); values != "[committed]" {
+		t.Errorf("got %s", values)
+	}
+	if _, err := s.CommitTransaction(s.ctx, &CommitTransactionRequest{ProducerId: id}); grpc.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition got %v", err)
+	}
+}
+
+func TestCompactTransactions(t *testing.T) {
+	s := makeServer(t, DefaultServerConfig())
+	defer func() { tidyServer(s) }()
+	create := CreateTopicRequest{Topic: "test", Config: map[string]string{"cleanup.policy": CleanupCompact, "segment.bytes": "1"}}
+	if _, err := s.CreateTopic(s.ctx, &create); err != nil {
+		t.Fatal(err)
+	}
+	producer, err := s.InitProducerId(s.ctx, &InitProducerIdRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish := func(request PublishMultiRequest) {
+		request.Topic = "test"
+		if _, err := s.PublishMulti(s.ctx, &request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish(PublishMultiRequest{Messages: []*Message{{Key: []byte("a"), Value: []byte("committed")}}})
+	if _, err := s.BeginTransaction(s.ctx, &BeginTransactionRequest{ProducerId: producer.ProducerId}); err != nil {
+		t.Fatal(err)
+	}
+	publish(PublishMultiRequest{
+		ProducerId:    producer.ProducerId,
+		Transactional: true,
+		Messages:      []*Message{{Key: []byte("a"), Value: []byte("aborted")}, {Value: []byte("unkeyed aborted")}},
+	})
+	if _, err := s.AbortTransaction(s.ctx, &AbortTransactionRequest{ProducerId: producer.ProducerId}); err != nil {
+		t.Fatal(err)
+	}
+	// The active message set is never compacted.
+	publish(PublishMultiRequest{Messages: []*Message{{Key: []byte("b"), Value: []byte("after")}}})
+
+	// The aborted record doesn't replace the committed one, and what's left of
+	// its batch stays hidden from read committed subscribers.
+	if err := s.topics["test"].partitions[0].compact(s.ctx, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	expected := "[committed after]"
+	if values := fmt.Sprint(readValues(t, s.topics["test"].partitions[0], true)); values != expected {
+		t.Errorf("expected %s got %s", expected, values)
+	}
+	s.Close()
+	restarted, err := NewServer(s.dir, DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = restarted
+	if values := fmt.Sprint(readValues(t, s.topics["test"].partitions[0], true)); values != expected {
+		t.Errorf("expected %s after a restart got %s", expected, values)
+	}
+}
+
+// testBroker is a broker serving the others in its cluster over loopback.
+type testBroker struct {
+	*Server
+	grpc    *grpc.Server
+	stopped bool
+}
+
+// serve answers requests from the rest of the cluster on lis.
+func (b *testBroker) serve(lis net.Listener) {
+	b.grpc = grpc.NewServer()
+	RegisterPubSubServer(b.grpc, b.Server)
+	go b.grpc.Serve(lis)
+	b.stopped = false
+}
+
+// kill stops the broker, keeping its data so it can be restarted.
+func (b *testBroker) kill() {
+	if !b.stopped {
+		b.stopped = true
+		b.grpc.Stop()
+		b.Close()
+	}
+}
+
+func (b *testBroker) stop() {
+	b.kill()
+	os.RemoveAll(b.dir)
+}
+
+// restart starts a killed broker again at the same address.
+func (b *testBroker) restart(t *testing.T) {
+	s, err := NewServer(b.dir, b.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", b.config.Brokers[b.config.BrokerID])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Server = s
+	b.serve(lis)
+}
+
+// startCluster starts n brokers in one process.
+func startCluster(t *testing.T, n int, config ServerConfig) []*testBroker {
+	config.Brokers = make(map[int32]string)
+	listeners := make([]net.Listener, n)
+	for i := range listeners {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = lis
+		config.Brokers[int32(i)] = lis.Addr().String()
+	}
+	brokers := make([]*testBroker, n)
+	for i, lis := range listeners {
+		config.BrokerID = int32(i)
+		brokers[i] = &testBroker{Server: makeServer(t, config)}
+		brokers[i].serve(lis)
+	}
+	return brokers
+}
+
+// waitFor fails the test if cond doesn't become true within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	config := DefaultServerConfig()
+	config.ReplicationFactor = 3
+	config.MinInsyncReplicas = 2
+	config.ReplicaLagTime = time.Second
+	config.BrokerTimeout = 600 * time.Millisecond
+	// Broker 0 needs a majority of the brokers to stay the controller, and
+	// accept dropping both followers from the isr, so there are two more
+	// brokers than replicas.
+	brokers := startCluster(t, 5, config)
+	defer func() {
+		for _, broker := range brokers {
+			broker.stop()
+		}
+	}()
+	leader := brokers[0]
+
+	if _, err := leader.CreateTopic(leader.ctx, &CreateTopicRequest{Topic: "replicated"}); err != nil {
+		t.Fatal(err)
+	}
+	describe := func(broker *testBroker) *PartitionDescription {
+		reply, err := broker.DescribeTopic(broker.ctx, &DescribeTopicRequest{Topic: "replicated"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply.Partitions[0]
+	}
+	if description := describe(brokers[2]); description.Leader != 0 || fmt.Sprint(description.Replicas) != "[0 1 2]" {
+		t.Fatalf("got leader %d replicas %v", description.Leader, description.Replicas)
+	}
+	publish := func(broker *testBroker, acks Acks, values ...string) error {
+		var messages []*Message
+		for _, value := range values {
+			messages = append(messages, &Message{Value: []byte(value)})
+		}
+		_, err := broker.PublishMulti(broker.ctx, &PublishMultiRequest{Topic: "replicated", Messages: messages, Acks: acks})
+		return err
+	}
+	fetch := func() (string, uint64) {
+		reply, err := leader.Fetch(leader.ctx, &FetchRequest{Topic: "replicated"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var values []string
+		for _, message := range reply.GetMessages() {
+			values = append(values, string(message.Value))
+		}
+		return fmt.Sprint(values), reply.HighWatermark
+	}
+
+	if err := publish(leader, Acks_ALL, "a", "b", "c"); err != nil {
+		t.Fatal(err)
+	}
+	for _, broker := range brokers[1:3] {
+		waitFor(t, "followers to replicate", func() bool { return describe(broker).HighWatermark == 3 })
+	}
+	if isr := fmt.Sprint(describe(leader).Isr); isr != "[0 1 2]" {
+		t.Errorf("got isr %s", isr)
+	}
+	if err := publish(brokers[1], Acks_LEADER, "follower"); !IsNotLeader(err) {
+		t.Errorf("expected publishing to a follower to fail, got %v", err)
+	}
+
+	// One follower is enough to keep MinInsyncReplicas in sync.
+	brokers[2].stop()
+	waitFor(t, "broker 2 to leave the isr", func() bool { return fmt.Sprint(describe(leader).Isr) == "[0 1]" })
+	if err := publish(leader, Acks_ALL, "d"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without any, publishes are still written but can't be read.
+	brokers[1].stop()
+	waitFor(t, "broker 1 to leave the isr", func() bool { return fmt.Sprint(describe(leader).Isr) == "[0]" })
+	if err := publish(leader, Acks_ALL, "e"); grpc.Code(err) != codes.Unavailable {
+		t.Errorf("expected Acks_ALL publish to fail, got %v", err)
+	}
+	if err := publish(leader, Acks_LEADER, "f"); err != nil {
+		t.Fatal(err)
+	}
+	if values, highWatermark := fetch(); values != "[a b c d]" || highWatermark != 4 {
+		t.Errorf("got %s up to %d", values, highWatermark)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	config := DefaultServerConfig()
+	config.ReplicationFactor = 3
+	config.MinInsyncReplicas = 2
+	config.ReplicaLagTime = time.Second
+	config.BrokerTimeout = 600 * time.Millisecond
+	brokers := startCluster(t, 3, config)
+	defer func() {
+		for _, broker := range brokers {
+			broker.stop()
+		}
+	}()
+
+	if _, err := brokers[0].CreateTopic(brokers[0].ctx, &CreateTopicRequest{Topic: "failover"}); err != nil {
+		t.Fatal(err)
+	}
+	describe := func(broker *testBroker) *PartitionDescription {
+		reply, err := broker.DescribeTopic(broker.ctx, &DescribeTopicRequest{Topic: "failover"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply.Partitions[0]
+	}
+	publish := func(broker *testBroker, values ...string) error {
+		var messages []*Message
+		for _, value := range values {
+			messages = append(messages, &Message{Value: []byte(value)})
+		}
+		_, err := broker.PublishMulti(broker.ctx, &PublishMultiRequest{Topic: "failover", Messages: messages, Acks: Acks_ALL})
+		return err
+	}
+
+	if err := publish(brokers[0], "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	for _, broker := range brokers[1:] {
+		waitFor(t, "followers to replicate", func() bool { return describe(broker).HighWatermark == 2 })
+	}
+
+	brokers[0].kill()
+	waitFor(t, "a new leader", func() bool {
+		description := describe(brokers[1])
+		return description.Leader == 1 && description.LeaderEpoch == 1
+	})
+	waitFor(t, "broker 2 to follow", func() bool { return describe(brokers[2]).Leader == 1 })
+	metadata, err := brokers[1].GetMetadata(brokers[1].ctx, &GetMetadataRequest{Topics: []string{"failover", "missing"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metadata.Brokers) != 3 || metadata.Brokers[2].Address != brokers[2].config.Brokers[2] || metadata.ControllerId != 1 {
+		t.Errorf("got brokers %v controller %d", metadata.Brokers, metadata.ControllerId)
+	}
+	if len(metadata.Topics) != 1 || metadata.Topics[0].Partitions[0].Leader != 1 {
+		t.Errorf("got topics %v", metadata.Topics)
+	}
+	if err := publish(brokers[1], "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := publish(brokers[2], "d"); !IsNotLeader(err) {
+		t.Errorf("expected publishing to a follower to fail, got %v", err)
+	}
+	reply, err := brokers[1].Fetch(brokers[1].ctx, &FetchRequest{Topic: "failover"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	for _, message := range reply.GetMessages() {
+		values = append(values, string(message.Value))
+	}
+	if fmt.Sprint(values) != "[a b c]" {
+		t.Errorf("got %v", values)
+	}
+
+	// The old leader comes back as a follower of the new one.
+	brokers[0].restart(t)
+	waitFor(t, "broker 0 to follow", func() bool {
+		description := describe(brokers[0])
+		return description.Leader == 1 && description.HighWatermark == 3
+	})
+	waitFor(t, "broker 0 to rejoin the isr", func() bool { return fmt.Sprint(describe(brokers[1]).Isr) == "[0 1 2]" })
+}
+
+func TestDivergedFollower(t *testing.T) {
+	config := DefaultServerConfig()
+	config.ReplicationFactor = 2
+	config.MinInsyncReplicas = 2
+	config.ReplicaLagTime = time.Second
+	brokers := startCluster(t, 2, config)
+	defer func() {
+		for _, broker := range brokers {
+			broker.stop()
+		}
+	}()
+	leader, follower := brokers[0], brokers[1]
+
+	if _, err := leader.CreateTopic(leader.ctx, &CreateTopicRequest{Topic: "diverged"}); err != nil {
+		t.Fatal(err)
+	}
+	describe := func(broker *testBroker) *PartitionDescription {
+		reply, err := broker.DescribeTopic(broker.ctx, &DescribeTopicRequest{Topic: "diverged"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply.Partitions[0]
+	}
+	publish := func(acks Acks, values ...string) {
+		var messages []*Message
+		for _, value := range values {
+			messages = append(messages, &Message{Value: []byte(value)})
+		}
+		request := PublishMultiRequest{Topic: "diverged", Messages: messages, Acks: acks}
+		if _, err := leader.PublishMulti(leader.ctx, &request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// logged returns everything in the follower's log, whether or not it has
+	// been replicated.
+	logged := func() string {
+		partition := follower.topics["diverged"].partitions[0]
+		partition.mu.Lock()
+		defer partition.mu.Unlock()
+		if err := partition.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		var values []string
+		for _, messageSet := range partition.messageSets {
+			_, err := messageSet.scan(follower.ctx, func(_ int64, batch *RecordBatch) error {
+				messages, err := DecodeRecordBatch(batch)
+				for _, message := range messages {
+					values = append(values, string(message.Value))
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return fmt.Sprint(values)
+	}
+	// diverge writes messages to the stopped follower's log that the leader
+	// never had, starting at offset.
+	diverge := func(offset uint64, values ...string) {
+		var messages []*Message
+		for i, value := range values {
+			messages = append(messages, &Message{Offset: offset + uint64(i), Value: []byte(value)})
+		}
+		batch, err := NewRecordBatch(messages, Compression_NONE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := proto.Marshal(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messageSet := path.Join(follower.dir, "diverged", "0", fmt.Sprintf("%012d.pubsub", 0))
+		f, err := os.OpenFile(messageSet, os.O_WRONLY|os.O_APPEND, 0660)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := writeRecord(f, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	publish(Acks_ALL, "a", "b", "c")
+	waitFor(t, "the follower to replicate", func() bool { return describe(follower).HighWatermark == 3 })
+
+	// Only what's before the checkpointed high watermark is kept on restart,
+	// so a message the leader never got is replaced by the leader's.
+	follower.kill()
+	diverge(3, "x")
+	publish(Acks_LEADER, "d")
+	follower.restart(t)
+	waitFor(t, "the follower to replace x", func() bool { return logged() == "[a b c d]" })
+	waitFor(t, "the follower to replicate d", func() bool { return describe(follower).HighWatermark == 4 })
+
+	// A follower whose log goes past the leader's end truncates back to it.
+	follower.kill()
+	diverge(4, "y", "z")
+	if err := writeHighWatermark(path.Join(follower.dir, "diverged", "0"), 6); err != nil {
+		t.Fatal(err)
+	}
+	follower.restart(t)
+	waitFor(t, "the follower to truncate", func() bool { return logged() == "[a b c d]" })
+	publish(Acks_ALL, "e")
+	if values := logged(); values != "[a b c d e]" {
+		t.Errorf("got %s", values)
+	}
+}
+
+func TestOffsetFailover(t *testing.T) {
+	config := DefaultServerConfig()
+	config.ReplicationFactor = 3
+	config.MinInsyncReplicas = 2
+	config.ReplicaLagTime = time.Second
+	config.BrokerTimeout = 600 * time.Millisecond
+	brokers := startCluster(t, 3, config)
+	defer func() {
+		for _, broker := range brokers {
+			broker.stop()
+		}
+	}()
+
+	if _, err := brokers[0].CreateTopic(brokers[0].ctx, &CreateTopicRequest{Topic: "events"}); err != nil {
+		t.Fatal(err)
+	}
+	commit := func(broker *testBroker, offset uint64) error {
+		_, err := broker.CommitOffset(broker.ctx, &CommitOffsetRequest{Group: "g", Topic: "events", Offset: offset})
+		return err
+	}
+	fetch := func(broker *testBroker) (*FetchCommittedOffsetReply, error) {
+		return broker.FetchCommittedOffset(broker.ctx, &FetchCommittedOffsetRequest{Group: "g", Topic: "events"})
+	}
+
+	// Broker 0 leads the offsets topic to start with.
+	if err := commit(brokers[1], 3); !IsNotLeader(err) {
+		t.Errorf("expected committing to a follower of the offsets topic to fail, got %v", err)
+	}
+	if err := commit(brokers[0], 7); err != nil {
+		t.Fatal(err)
+	}
+
+	// The commit was replicated, so it survives the leader failing.
+	brokers[0].kill()
+	offsetsLeader := func(broker *testBroker) int32 {
+		broker.offsets.partition.mu.Lock()
+		defer broker.offsets.partition.mu.Unlock()
+		return broker.offsets.partition.leader
+	}
+	waitFor(t, "a new offsets leader", func() bool {
+		id := offsetsLeader(brokers[1])
+		return id != 0 && offsetsLeader(brokers[2]) == id
+	})
+	leader, follower := brokers[1], brokers[2]
+	if offsetsLeader(brokers[1]) == 2 {
+		leader, follower = brokers[2], brokers[1]
+	}
+	if reply, err := fetch(leader); err != nil || !reply.Committed || reply.Offset != 7 {
+		t.Errorf("got %v %v", reply, err)
+	}
+	if _, err := fetch(follower); !IsNotLeader(err) {
+		t.Errorf("expected fetching from a follower of the offsets topic to fail, got %v", err)
+	}
+	if reply, err := follower.committedOffset(follower.ctx, offsetKey{"g", "events", 0}); err != nil || reply.Offset != 7 {
+		t.Errorf("got %v %v from the leader", reply, err)
+	}
+	if err := commit(leader, 9); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old leader comes back as a follower and doesn't serve its stale
+	// offsets.
+	brokers[0].restart(t)
+	waitFor(t, "broker 0 to follow", func() bool {
+		_, err := fetch(brokers[0])
+		return IsNotLeader(err)
+	})
+	if reply, err := brokers[0].committedOffset(brokers[0].ctx, offsetKey{"g", "events", 0}); err != nil || reply.Offset != 9 {
+		t.Errorf("got %v %v from the leader", reply, err)
+	}
+}
+
+func TestControllerLease(t *testing.T) {
+	config := DefaultServerConfig()
+	config.ReplicationFactor = 3
+	config.BrokerTimeout = 600 * time.Millisecond
+	brokers := startCluster(t, 3, config)
+	defer func() {
+		for _, broker := range brokers {
+			broker.stop()
+		}
+	}()
+
+	waitFor(t, "a controller", func() bool {
+		ok, _ := brokers[0].controller.controlling()
+		return ok
+	})
+	_, epoch := brokers[0].controller.controlling()
+	for _, broker := range brokers {
+		waitFor(t, "the lease to be granted", func() bool { return broker.controller.id() == 0 })
+	}
+
+	// Nobody else gets a lease while broker 0's is running, even for a later
+	// epoch, and changes from earlier controllers are ignored.
+	lease := ControllerLeaseRequest{BrokerId: 1, ControllerEpoch: epoch + 10}
+	if reply, err := brokers[2].ControllerLease(brokers[2].ctx, &lease); err != nil || reply.Granted || reply.ControllerEpoch != epoch {
+		t.Errorf("got %v %v", reply, err)
+	}
+	stale := LeaderAndIsrRequest{ControllerId: 1, ControllerEpoch: epoch - 1}
+	if _, err := brokers[2].LeaderAndIsr(brokers[2].ctx, &stale); grpc.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected a stale controller epoch to be rejected, got %v", err)
+	}
+
+	// Of two states with the same leader epoch, the later controller's wins.
+	if _, err := brokers[0].CreateTopic(brokers[0].ctx, &CreateTopicRequest{Topic: "leased"}); err != nil {
+		t.Fatal(err)
+	}
+	partition := brokers[2].topics["leased"].partitions[0]
+	earlier := PartitionState{Topic: "leased", Leader: 1, LeaderEpoch: 1, ControllerEpoch: epoch - 1, Replicas: []int32{0, 1, 2}}
+	later := PartitionState{Topic: "leased", Leader: 2, LeaderEpoch: 1, ControllerEpoch: epoch, Replicas: []int32{0, 1, 2}}
+	for _, state := range []*PartitionState{&earlier, &later, &earlier} {
+		if err := brokers[2].changeLeader(partition, state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	partition.mu.Lock()
+	leader := partition.leader
+	partition.mu.Unlock()
+	if leader != 2 {
+		t.Errorf("expected the later controller's leader 2 got %d", leader)
+	}
+
+	// The epoch granted survives a restart.
+	brokers[2].kill()
+	brokers[2].restart(t)
+	if granted, restarted, ok, err := readController(brokers[2].dir); err != nil || !ok || granted != 0 || restarted != epoch {
+		t.Errorf("got broker %d epoch %d %v %v", granted, restarted, ok, err)
+	}
+	if reply, err := brokers[2].ControllerLease(brokers[2].ctx, &ControllerLeaseRequest{BrokerId: 1, ControllerEpoch: epoch}); err != nil || reply.Granted {
+		t.Errorf("expected epoch %d not to be granted again, got %v %v", epoch, reply, err)
+	}
+}
+
+func TestReassignment(t *testing.T) {
+	config := DefaultServerConfig()
+	config.ReplicationFactor = 2
+	config.MinInsyncReplicas = 2
+	config.ReplicaLagTime = time.Second
+	config.BrokerTimeout = 600 * time.Millisecond
+	config.ReassignmentThrottle = 1024 * 1024
+	brokers := startCluster(t, 3, config)
+	defer func() {
+		for _, broker := range brokers {
+			broker.stop()
+		}
+	}()
+
+	if _, err := brokers[0].CreateTopic(brokers[0].ctx, &CreateTopicRequest{Topic: "moving"}); err != nil {
+		t.Fatal(err)
+	}
+	describe := func(broker *testBroker) *PartitionDescription {
+		reply, err := broker.DescribeTopic(broker.ctx, &DescribeTopicRequest{Topic: "moving"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply.Partitions[0]
+	}
+	publish := func(broker *testBroker, values ...string) error {
+		var messages []*Message
+		for _, value := range values {
+			messages = append(messages, &Message{Value: []byte(value)})
+		}
+		_, err := broker.PublishMulti(broker.ctx, &PublishMultiRequest{Topic: "moving", Messages: messages, Acks: Acks_ALL})
+		return err
+	}
+	if err := publish(brokers[0], "a", "b", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Broker 0 becomes the controller once the others grant it the lease.
+	waitFor(t, "a controller", func() bool {
+		ok, _ := brokers[0].controller.controlling()
+		return ok
+	})
+	reassign := ReassignPartitionsRequest{Topic: "moving", Replicas: []*PartitionReplicas{{Brokers: []int32{2, 1}}}}
+	if _, err := brokers[1].ReassignPartitions(brokers[1].ctx, &reassign); grpc.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected reassigning on a broker that isn't the controller to fail, got %v", err)
+	}
+	if _, err := brokers[0].ReassignPartitions(brokers[0].ctx, &reassign); err != nil {
+		t.Fatal(err)
+	}
+	for _, broker := range brokers {
+		waitFor(t, "the reassignment", func() bool {
+			description := describe(broker)
+			return description.Leader == 2 && fmt.Sprint(description.Replicas) == "[2 1]"
+		})
+	}
+	// The old replica deletes its copy, which stays deleted after a restart.
+	partitionDir := path.Join(brokers[0].dir, "moving", "0")
+	waitFor(t, "broker 0 to drop its copy", func() bool {
+		_, err := os.Stat(partitionDir)
+		return os.IsNotExist(err)
+	})
+	brokers[0].kill()
+	brokers[0].restart(t)
+	if _, err := os.Stat(partitionDir); !os.IsNotExist(err) {
+		t.Errorf("expected %s to stay deleted got %v", partitionDir, err)
+	}
+	if description := describe(brokers[0]); description.LatestOffset != 0 || description.Segments != 0 {
+		t.Errorf("expected nothing stored got %v", description)
+	}
+	waitFor(t, "broker 0 to be the controller again", func() bool {
+		ok, _ := brokers[0].controller.controlling()
+		return ok
+	})
+	if err := publish(brokers[2], "d"); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := brokers[2].Fetch(brokers[2].ctx, &FetchRequest{Topic: "moving"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	for _, message := range reply.GetMessages() {
+		values = append(values, string(message.Value))
+	}
+	if fmt.Sprint(values) != "[a b c d]" {
+		t.Errorf("got %v", values)
+	}
+
+	// Broker 0 takes the place of the decommissioned broker 1.
+	if _, err := brokers[0].ReassignPartitions(brokers[0].ctx, &ReassignPartitionsRequest{Decommission: []int32{1}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "broker 1 to be decommissioned", func() bool {
+		description := describe(brokers[2])
+		return fmt.Sprint(description.Replicas) == "[2 0]" && fmt.Sprint(description.Isr) == "[0 2]"
+	})
+	waitFor(t, "broker 0 to catch up", func() bool { return describe(brokers[0]).HighWatermark == 4 })
+}
+
+func TestReassignmentFailover(t *testing.T) {
+	config := DefaultServerConfig()
+	config.ReplicationFactor = 2
+	config.MinInsyncReplicas = 1
+	config.ReplicaLagTime = time.Second
+	config.BrokerTimeout = 600 * time.Millisecond
+	config.ReassignmentThrottle = 8192
+	brokers := startCluster(t, 3, config)
+	defer func() {
+		for _, broker := range brokers {
+			broker.stop()
+		}
+	}()
+
+	// Topics created with their replicas given are created on each broker by
+	// the caller.
+	create := CreateTopicRequest{Topic: "moving", Partitions: 1, Replicas: []*PartitionReplicas{{Brokers: []int32{0, 1}}}}
+	for _, broker := range brokers {
+		if _, err := broker.CreateTopic(broker.ctx, &create); err != nil {
+			t.Fatal(err)
+		}
+	}
+	describe := func(broker *testBroker) *PartitionDescription {
+		reply, err := broker.DescribeTopic(broker.ctx, &DescribeTopicRequest{Topic: "moving"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply.Partitions[0]
+	}
+	// Enough to keep the new replica catching up for a moment.
+	var messages []*Message
+	for i := 0; i < 12; i++ {
+		messages = append(messages, &Message{Value: make([]byte, 1024)})
+	}
+	if _, err := brokers[0].PublishMulti(brokers[0].ctx, &PublishMultiRequest{Topic: "moving", Messages: messages, Acks: Acks_ALL}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "a controller", func() bool {
+		ok, _ := brokers[0].controller.controlling()
+		return ok
+	})
+	reassign := ReassignPartitionsRequest{Topic: "moving", Replicas: []*PartitionReplicas{{Brokers: []int32{1, 2}}}}
+	if _, err := brokers[0].ReassignPartitions(brokers[0].ctx, &reassign); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "broker 2 to be added", func() bool { return fmt.Sprint(describe(brokers[2]).Replicas) == "[0 1 2]" })
+	// The files are rewritten after the partition's state changes.
+	waitFor(t, "the reassignment to be persisted", func() bool {
+		targets, err := readBrokerLists(path.Join(brokers[2].dir, "moving"), reassignmentsFile)
+		return err == nil && fmt.Sprint(targets) == "[[1 2]]"
+	})
+
+	// The controller fails while broker 2 is catching up, and the next one
+	// finishes the reassignment.
+	brokers[0].kill()
+	waitFor(t, "a new leader", func() bool { return describe(brokers[2]).Leader == 1 })
+	waitFor(t, "broker 2 to catch up", func() bool { return fmt.Sprint(describe(brokers[1]).Isr) == "[1 2]" })
+	for _, broker := range brokers[1:] {
+		waitFor(t, "the reassignment", func() bool {
+			description := describe(broker)
+			return fmt.Sprint(description.Replicas) == "[1 2]" && description.Leader == 1
+		})
+	}
+	waitFor(t, "broker 2 to have every message", func() bool { return describe(brokers[2]).HighWatermark == 12 })
+	waitFor(t, "the reassignment to be finished", func() bool {
+		targets, err := readBrokerLists(path.Join(brokers[1].dir, "moving"), reassignmentsFile)
+		return err == nil && fmt.Sprint(targets) == "[[]]"
+	})
+}
+
+func TestClusterTransactions(t *testing.T) {
+	config := DefaultServerConfig()
+	config.ReplicaLagTime = time.Second
+	config.BrokerTimeout = 600 * time.Millisecond
+	brokers := startCluster(t, 3, config)
+	defer func() {
+		for _, broker := range brokers {
+			broker.stop()
+		}
+	}()
+
+	// Each partition is led by a broker other than the coordinator.
+	create := CreateTopicRequest{Topic: "orders", Partitions: 2, Replicas: []*PartitionReplicas{{Brokers: []int32{1}}, {Brokers: []int32{2}}}}
+	for _, broker := range brokers {
+		if _, err := broker.CreateTopic(broker.ctx, &create); err != nil {
+			t.Fatal(err)
+		}
+	}
+	coordinator := func() *testBroker {
+		for _, broker := range brokers {
+			if !broker.stopped && broker.transactions.partition.checkLeader() == nil {
+				return broker
+			}
+		}
+		return nil
+	}
+	if c := coordinator(); c == nil || c.config.BrokerID != 0 {
+		t.Fatalf("expected broker 0 to coordinate transactions got %v", c)
+	}
+	producer, err := brokers[0].InitProducerId(brokers[0].ctx, &InitProducerIdRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := producer.ProducerId
+	var sequence int32
+	publish := func(value string) {
+		for partition := int32(0); partition < 2; partition++ {
+			leader := brokers[partition+1]
+			request := PublishMultiRequest{Topic: "orders", Partition: partition, Messages: []*Message{{Value: []byte(value)}}, ProducerId: id, Sequence: sequence, Transactional: true}
+			if _, err := leader.PublishMulti(leader.ctx, &request); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sequence++
+	}
+	expect := func(readCommitted bool, expected string) {
+		for partition := 0; partition < 2; partition++ {
+			values := fmt.Sprint(readValues(t, brokers[partition+1].topics["orders"].partitions[partition], readCommitted))
+			if values != expected {
+				t.Errorf("orders/%d read committed %v: expected %s got %s", partition, readCommitted, expected, values)
+			}
+		}
+	}
+
+	// Partition leaders join the transaction through the coordinator, which
+	// has them write the markers.
+	if _, err := brokers[0].BeginTransaction(brokers[0].ctx, &BeginTransactionRequest{ProducerId: id}); err != nil {
+		t.Fatal(err)
+	}
+	publish("committed")
+	expect(true, "[]")
+	if _, err := brokers[0].CommitTransaction(brokers[0].ctx, &CommitTransactionRequest{ProducerId: id}); err != nil {
+		t.Fatal(err)
+	}
+	expect(true, "[committed]")
+
+	if _, err := brokers[0].BeginTransaction(brokers[0].ctx, &BeginTransactionRequest{ProducerId: id}); err != nil {
+		t.Fatal(err)
+	}
+	publish("aborted")
+	if _, err := brokers[0].AbortTransaction(brokers[0].ctx, &AbortTransactionRequest{ProducerId: id}); err != nil {
+		t.Fatal(err)
+	}
+	expect(true, "[committed]")
+	expect(false, "[committed aborted]")
+
+	// A coordinator taking over aborts the transactions left open.
+	if _, err := brokers[0].BeginTransaction(brokers[0].ctx, &BeginTransactionRequest{ProducerId: id}); err != nil {
+		t.Fatal(err)
+	}
+	publish("interrupted")
+	brokers[0].kill()
+	waitFor(t, "a new coordinator", func() bool { return coordinator() != nil })
+	waitFor(t, "the transaction to be aborted", func() bool {
+		for partition := 0; partition < 2; partition++ {
+			p := brokers[partition+1].topics["orders"].partitions[partition]
+			p.mu.Lock()
+			stable := p.lastStableOffset() == p.highWatermark()
+			p.mu.Unlock()
+			if !stable {
+				return false
+			}
+		}
+		return true
+	})
+	expect(true, "[committed]")
+	expect(false, "[committed aborted interrupted]")
+}
+
+func TestShrinkISR(t *testing.T) {
+	config := DefaultServerConfig()
+	config.MinInsyncReplicas = 2
+	config.ReplicaLagTime = time.Second
+	config.BrokerTimeout = 600 * time.Millisecond
+	brokers := startCluster(t, 3, config)
+	defer func() {
+		for _, broker := range brokers {
+			broker.stop()
+		}
+	}()
+
+	// Broker 1 leads the partition while broker 0 is the controller.
+	create := CreateTopicRequest{Topic: "shrinking", Partitions: 1, Replicas: []*PartitionReplicas{{Brokers: []int32{1, 2, 0}}}}
+	for _, broker := range brokers {
+		if _, err := broker.CreateTopic(broker.ctx, &create); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "broker 0 to become the controller", func() bool {
+		controlling, _ := brokers[0].controller.controlling()
+		return controlling
+	})
+	leader := brokers[1]
+	publish := func(value string) error {
+		ctx, cancel := context.WithTimeout(leader.ctx, 5*time.Second)
+		defer cancel()
+		request := PublishMultiRequest{Topic: "shrinking", Messages: []*Message{{Value: []byte(value)}}, Acks: Acks_ALL}
+		_, err := leader.PublishMulti(ctx, &request)
+		return err
+	}
+	isr := func(broker *testBroker) string {
+		partition := broker.topics["shrinking"].partitions[0]
+		partition.mu.Lock()
+		defer partition.mu.Unlock()
+		return fmt.Sprint(partition.state().Isr)
+	}
+	if err := publish("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The publish only succeeds once the high watermark passes broker 2, by
+	// which time the controller has already dropped it, so it can't elect it.
+	brokers[2].stop()
+	if err := publish("b"); err != nil {
+		t.Fatal(err)
+	}
+	if got := isr(brokers[0]); got != "[0 1]" {
+		t.Errorf("expected the controller to have isr [0 1] got %s", got)
+	}
+	if got := isr(leader); got != "[0 1]" {
+		t.Errorf("expected the leader to have isr [0 1] got %s", got)
+	}
+
+	// Without a controller to accept it, the leader doesn't drop broker 0,
+	// so nothing more is replicated.
+	brokers[0].stop()
+	if err := publish("c"); err != context.DeadlineExceeded {
+		t.Errorf("expected the publish to time out, got %v", err)
+	}
+	if got := isr(leader); got != "[0 1]" {
+		t.Errorf("expected the leader to keep isr [0 1] got %s", got)
+	}
+}
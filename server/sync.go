@@ -0,0 +1,100 @@
+// Copyright (C) 2015 Daniel Harrison
+
+package server
+
+import (
+	"log"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// needsSync returns whether the durability policy calls for an fsync now that
+// everything before end has been appended.
+func (p *Partition) needsSync(end uint64) bool {
+	syncMessages := p.Config().SyncMessages
+	if syncMessages <= 0 {
+		return false
+	}
+	p.syncMu.Lock()
+	defer p.syncMu.Unlock()
+	return end-p.synced >= uint64(syncMessages)
+}
+
+// syncTo returns once everything before offset end, or everything in the
+// partition if it ends before that, has been fsynced. Callers that arrive
+// while an fsync is in progress wait for it and then share the next one, so
+// concurrent publishers are committed as a group.
+func (p *Partition) syncTo(end uint64) error {
+	p.syncMu.Lock()
+	defer p.syncMu.Unlock()
+	for p.synced < end {
+		if p.syncing {
+			p.syncCond.Wait()
+			continue
+		}
+		p.syncing = true
+		p.syncMu.Unlock()
+
+		// Everything flushed before we take the file will be covered by the
+		// fsync. Holding fileMu keeps roll from closing the file under us.
+		p.mu.Lock()
+		syncEnd := p.nextOffset()
+		if end > syncEnd {
+			// Truncated since the caller appended, so there's no more to sync.
+			end = syncEnd
+		}
+		f := p.file
+		p.fileMu.RLock()
+		p.mu.Unlock()
+		err := f.Sync()
+		p.fileMu.RUnlock()
+
+		p.syncMu.Lock()
+		p.syncing = false
+		p.syncs++
+		p.syncCond.Broadcast()
+		if err != nil {
+			return err
+		}
+		if syncEnd > p.synced {
+			p.synced = syncEnd
+		}
+	}
+	return nil
+}
+
+// markSynced records that everything before end has been fsynced.
+func (p *Partition) markSynced(end uint64) {
+	p.syncMu.Lock()
+	defer p.syncMu.Unlock()
+	if end > p.synced {
+		p.synced = end
+	}
+	p.syncCond.Broadcast()
+}
+
+// syncPeriodically fsyncs the partition every SyncInterval until ctx is done. The
+// interval is reread whenever the topic is reconfigured.
+func (p *Partition) syncPeriodically(ctx context.Context) {
+	for {
+		var tick <-chan time.Time
+		if interval := p.Config().SyncInterval; interval > 0 {
+			tick = time.After(interval)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.reconfigured:
+			continue
+		case <-tick:
+		}
+
+		p.mu.Lock()
+		end := p.nextOffset()
+		p.mu.Unlock()
+		if err := p.syncTo(end); err != nil {
+			log.Print("[", p.name, "] Failed to sync: ", err)
+		}
+	}
+}
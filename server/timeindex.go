@@ -0,0 +1,53 @@
+// Copyright (C) 2015 Daniel Harrison
+
+package server
+
+import (
+	"sort"
+	"time"
+)
+
+// TimeIndex is a sparse mapping from message timestamps to the offsets in a
+// message set. Unlike Index it is only kept in memory, since validating a
+// message set reads every record anyway.
+type TimeIndex struct {
+	entries []timeIndexEntry
+	// maxTimestamp is the latest timestamp of any message in the message set.
+	maxTimestamp int64
+}
+
+type timeIndexEntry struct {
+	// timestamp is the latest timestamp of any message before offset.
+	timestamp int64
+	offset    uint32
+}
+
+// timestamp returns t in the milliseconds since the epoch used for message
+// timestamps.
+func timestamp(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// Add accounts for a batch being appended. If indexed is true, an entry is
+// added for the batch's offset, relative to the start of the message set.
+func (idx *TimeIndex) Add(offset uint32, batch *RecordBatch, indexed bool) {
+	if indexed {
+		idx.entries = append(idx.entries, timeIndexEntry{idx.maxTimestamp, offset})
+	}
+	if batch.MaxTimestamp > idx.maxTimestamp {
+		idx.maxTimestamp = batch.MaxTimestamp
+	}
+}
+
+// Lookup returns the latest indexed relative offset before which every
+// message is older than timestamp. Reading may start from it without missing
+// the first message at or after timestamp.
+func (idx *TimeIndex) Lookup(timestamp int64) uint32 {
+	i := sort.Search(len(idx.entries), func(i int) bool {
+		return idx.entries[i].timestamp >= timestamp
+	})
+	if i == 0 {
+		return 0
+	}
+	return idx.entries[i-1].offset
+}
@@ -3,51 +3,274 @@
 package server
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
 
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
+// PartitionByKey can be published to instead of a partition to route each
+// message by a hash of its key, keeping the messages for a key in order.
+const PartitionByKey = -1
+
+// Topic is a named set of partitions sharing a config. Each partition is an
+// independent log, so messages are only ordered within a partition.
 type Topic struct {
-	name        string
-	messageSets []MessageSet
-	writer      *bufio.Writer
-	listeners   []topicListener
+	name       string
+	dir        string
+	partitions []*Partition
+
+	// configMu guards config and the overrides it was built from, which can
+	// be changed while the topic is running.
+	configMu  sync.RWMutex
+	config    TopicConfig
+	overrides map[string]string
+
+	// unkeyed picks the partition for the next publish of messages without a
+	// key.
+	unkeyed uint32
+
+	// producersMu guards producers. A publish with a producer id holds it to
+	// check its sequence and record it as pending, and again to record its
+	// offsets once appended.
+	producersMu sync.Mutex
+	producers   map[int64]*producerState
+
+	// replicasMu is held while rewriting the replicas file as partitions are
+	// reassigned.
+	replicasMu sync.Mutex
 }
 
-func (t *Topic) Write(p []byte) (n int, err error) {
-	n, err = t.writer.Write(p)
-	if err == nil {
-		t.broadcast(int64(n))
+// NewTopic creates the directory for a new topic along with its partitions.
+// The topic uses defaults for any settings not in overrides.
+func NewTopic(dir string, name string, partitions int32, defaults TopicConfig, overrides map[string]string) (*Topic, error) {
+	if partitions < 1 {
+		return nil, errors.New(fmt.Sprintf("Invalid number of partitions: %d", partitions))
+	}
+	config, err := defaults.override(overrides)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return nil, err
+	}
+	if err := writeTopicConfig(dir, overrides); err != nil {
+		return nil, err
 	}
-	return n, err
+	topic := Topic{name: name, dir: dir, config: config, overrides: overrides, producers: make(map[int64]*producerState)}
+	for id := int32(0); id < partitions; id++ {
+		partition, err := NewPartition(&topic, id)
+		if err != nil {
+			return nil, err
+		}
+		topic.partitions = append(topic.partitions, partition)
+	}
+	return &topic, nil
 }
 
-func (t *Topic) Flush() error {
-	return t.writer.Flush()
-}
+// OpenTopic loads the config and partitions of an existing topic.
+func OpenTopic(ctx context.Context, dir string, name string, defaults TopicConfig) (*Topic, error) {
+	overrides, err := readTopicConfig(dir)
+	if err != nil {
+		return nil, err
+	}
+	config, err := defaults.override(overrides)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateTopic(dir); err != nil {
+		return nil, err
+	}
 
-func (t *Topic) Listen(ctx context.Context) chan int64 {
-	ping := make(chan int64, 1)
-	t.listeners = append(t.listeners, topicListener{ctx, ping})
-	return ping
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	// Only the partitions this broker is a replica of have directories, so
+	// the replicas file says how many there are.
+	replicas, err := readReplicas(dir)
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[int]bool)
+	partitions := len(replicas)
+	for _, partitionDir := range files {
+		if !partitionDir.IsDir() {
+			continue
+		}
+		if id, err := strconv.Atoi(partitionDir.Name()); err == nil {
+			stored[id] = true
+			if id >= partitions {
+				partitions = id + 1
+			}
+		}
+	}
+
+	topic := Topic{name: name, dir: dir, config: config, overrides: overrides}
+	for id := 0; id < partitions; id++ {
+		var partition *Partition
+		switch {
+		case stored[id]:
+			if partition, err = OpenPartition(ctx, &topic, int32(id)); err != nil {
+				return nil, err
+			}
+		case id < len(replicas):
+			partition = newPartition(&topic, int32(id))
+		default:
+			return nil, errors.New(fmt.Sprintf("Missing partition %d of topic %s", id, name))
+		}
+		topic.partitions = append(topic.partitions, partition)
+	}
+	if len(topic.partitions) == 0 {
+		// Interrupted while being created.
+		partition, err := NewPartition(&topic, 0)
+		if err != nil {
+			return nil, err
+		}
+		topic.partitions = append(topic.partitions, partition)
+	}
+	topic.recoverProducers()
+	return &topic, nil
 }
 
-func (t *Topic) broadcast(n int64) {
-	// TODO(dan): Think more about the channels here and blocking.
-	for i, listener := range t.listeners {
-		select {
-		case <-listener.ctx.Done():
-			fmt.Print("[", t.name, "] Removing subscriber from notifications")
-			t.listeners = append(t.listeners[:i], t.listeners[i+1:]...)
+// migrateTopic moves the message sets of a topic written before topics had
+// partitions into partition 0.
+func migrateTopic(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	partitionDir := path.Join(dir, "0")
+	for _, file := range files {
+		switch filepath.Ext(file.Name()) {
+		case ".pubsub", ".index", ".cleaned":
 		default:
-			listener.notify <- n
+			continue
+		}
+		if err := os.MkdirAll(partitionDir, 0770); err != nil {
+			return err
+		}
+		log.Print("Moving ", file.Name(), " into partition 0 of ", dir)
+		if err := os.Rename(path.Join(dir, file.Name()), path.Join(partitionDir, file.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start runs the goroutines of every partition until ctx is done or the topic
+// is closed.
+func (t *Topic) Start(ctx context.Context) {
+	for _, partition := range t.partitions {
+		partition.Start(ctx)
+	}
+}
+
+// Close stops and closes every partition.
+func (t *Topic) Close() error {
+	var err error
+	for _, partition := range t.partitions {
+		if closeErr := partition.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Partition returns the partition with the given id.
+func (t *Topic) Partition(id int32) (*Partition, error) {
+	if id < 0 || int(id) >= len(t.partitions) {
+		return nil, grpc.Errorf(codes.InvalidArgument, "No partition %d in topic %s with %d partitions", id, t.name, len(t.partitions))
+	}
+	return t.partitions[id], nil
+}
+
+// route splits messages between partitions. They all go to partition unless it
+// is PartitionByKey, in which case each message with a key goes to the
+// partition picked by its hash and the rest go together to the next partition
+// in turn.
+func (t *Topic) route(messages []*Message, partition int32) (map[int32][]*Message, error) {
+	if partition != PartitionByKey {
+		if _, err := t.Partition(partition); err != nil {
+			return nil, err
 		}
+		return map[int32][]*Message{partition: messages}, nil
 	}
+
+	n := int32(len(t.partitions))
+	unkeyed := int32(atomic.AddUint32(&t.unkeyed, 1) % uint32(n))
+	routed := make(map[int32][]*Message)
+	for _, message := range messages {
+		id := unkeyed
+		if len(message.Key) > 0 {
+			id = PartitionForKey(message.Key, n)
+		}
+		routed[id] = append(routed[id], message)
+	}
+	return routed, nil
 }
 
-type topicListener struct {
-	ctx    context.Context
-	notify chan int64
+// PartitionForKey returns the partition that messages with key are routed to
+// in a topic with n partitions.
+func PartitionForKey(key []byte, n int32) int32 {
+	hash := fnv.New32a()
+	hash.Write(key)
+	return int32(hash.Sum32() % uint32(n))
+}
+
+// Config returns the topic's current settings.
+func (t *Topic) Config() TopicConfig {
+	t.configMu.RLock()
+	defer t.configMu.RUnlock()
+	return t.config
+}
+
+// Reconfigure overrides the settings in set, returns those in remove to
+// defaults, persists the result and applies it to the running topic.
+func (t *Topic) Reconfigure(defaults TopicConfig, set map[string]string, remove []string) (TopicConfig, error) {
+	t.configMu.Lock()
+	defer t.configMu.Unlock()
+
+	overrides := make(map[string]string)
+	for key, value := range t.overrides {
+		overrides[key] = value
+	}
+	for key, value := range set {
+		overrides[key] = value
+	}
+	for _, key := range remove {
+		if _, ok := defaults.Map()[key]; !ok {
+			return t.config, grpc.Errorf(codes.InvalidArgument, "Unknown topic config: %s", key)
+		}
+		delete(overrides, key)
+	}
+	config, err := defaults.override(overrides)
+	if err != nil {
+		return t.config, grpc.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	if err := writeTopicConfig(t.dir, overrides); err != nil {
+		return t.config, err
+	}
+
+	t.config = config
+	t.overrides = overrides
+	for _, partition := range t.partitions {
+		select {
+		case partition.reconfigured <- struct{}{}:
+		default:
+		}
+	}
+	log.Print("[", t.name, "] Reconfigured with ", overrides)
+	return config, nil
 }
@@ -0,0 +1,583 @@
+// Copyright (C) 2015 Daniel Harrison
+
+package server
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// transactionsTopic is the internal topic that each transaction's partitions
+// are logged to before anything is published to them, and the decision to
+// commit it before any commit markers are written. A coordinator taking over
+// after a crash finishes the transactions it finds there, aborting the ones
+// that were still open. The leader of its one partition coordinates every
+// transaction, and the other brokers turn away requests to begin or end one.
+const transactionsTopic = "__transaction_state"
+
+// transactionCheckInterval is how often the coordinator aborts transactions
+// that have timed out and retries finishing ones whose markers failed.
+const transactionCheckInterval = time.Second
+
+var transactionsTopicConfig = map[string]string{
+	"cleanup.policy": CleanupCompact,
+	"segment.bytes":  "104857600",
+}
+
+type abortedTransaction struct {
+	producerID int64
+	// first is the first offset written in the transaction and marker is the
+	// offset of its abort marker.
+	first  uint64
+	marker uint64
+}
+
+// trackTransaction updates the partition's transactions for a batch being
+// appended or loaded. p.mu must be held.
+// TODO(dan): Forget aborted transactions once retention deletes them.
+func (p *Partition) trackTransaction(batch *RecordBatch) {
+	first, open := p.openTransactions[batch.ProducerId]
+	switch {
+	case batch.Transactional && batch.Control == ControlType_DATA && !open:
+		p.openTransactions[batch.ProducerId] = batch.BaseOffset
+	case batch.Control != ControlType_DATA && open:
+		delete(p.openTransactions, batch.ProducerId)
+		if batch.Control == ControlType_ABORT {
+			p.abortedTransactions = append(p.abortedTransactions, abortedTransaction{batch.ProducerId, first, batch.BaseOffset})
+		}
+	}
+}
+
+// lastStableOffset returns the offset before which every transaction has been
+// committed or aborted. p.mu must be held.
+func (p *Partition) lastStableOffset() uint64 {
+	stable := p.highWatermark()
+	for _, first := range p.openTransactions {
+		if first < stable {
+			stable = first
+		}
+	}
+	return stable
+}
+
+// aborted returns whether the transactional batch at offset from a producer
+// was part of an aborted transaction.
+func (p *Partition) aborted(producerID int64, offset uint64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, aborted := range p.abortedTransactions {
+		if aborted.producerID == producerID && aborted.first <= offset && offset < aborted.marker {
+			return true
+		}
+	}
+	return false
+}
+
+// writeMarker ends a producer's transaction in partition and waits for the
+// marker to be synced and replicated, so a new leader has it too.
+func writeMarker(ctx context.Context, partition *Partition, producerID int64, control ControlType) error {
+	_, last, err := partition.publish(ctx, batchProducer{id: producerID, control: control}, []*Message{{}}, Compression_NONE)
+	if err != nil {
+		return err
+	}
+	if err := partition.syncTo(last + 1); err != nil {
+		return err
+	}
+	return partition.waitReplicated(ctx, last+1)
+}
+
+// transaction is a producer's transaction that hasn't been committed or
+// aborted yet.
+type transaction struct {
+	// mu is held for reading while partitions join the transaction and for
+	// writing while it is ended, so none join once it has.
+	mu    sync.RWMutex
+	ended bool
+	// started is when the transaction began, for timing it out.
+	started time.Time
+
+	// logMu is held while the transaction is logged or its markers are
+	// written, and guards the rest. A transaction stays with the coordinator
+	// until every marker is written, so one that fails partway is finished
+	// by a retry.
+	logMu      sync.Mutex
+	partitions map[topicPartition]bool
+	decided    bool
+	commit     bool
+	logged     bool
+	marked     map[topicPartition]bool
+	finished   bool
+}
+
+// decision returns the partitions of the transaction as they're logged.
+// txn.logMu must be held.
+func (txn *transaction) decision() *TransactionDecision {
+	byTopic := make(map[string][]int32)
+	for tp := range txn.partitions {
+		byTopic[tp.topic] = append(byTopic[tp.topic], tp.partition)
+	}
+	decision := TransactionDecision{}
+	for topic, partitions := range byTopic {
+		sort.Sort(int32Slice(partitions))
+		decision.Partitions = append(decision.Partitions, &TopicPartitions{Topic: topic, Partitions: partitions})
+	}
+	return &decision
+}
+
+// transactionCoordinator tracks every open transaction. Like the offset
+// store, it loads them from its topic when this broker becomes the leader.
+type transactionCoordinator struct {
+	server *Server
+	// partition is where transactions are logged.
+	partition *Partition
+
+	// mu guards transactions, which are loaded as of leader epoch.
+	mu           sync.Mutex
+	epoch        int32
+	transactions map[int64]*transaction
+}
+
+// initTransactions opens or creates the transactions topic and, if this
+// broker leads it, finishes the transactions left unfinished before a
+// restart.
+func (s *Server) initTransactions() error {
+	s.mu.Lock()
+	topic, ok := s.topics[transactionsTopic]
+	if !ok {
+		var err error
+		if topic, _, err = s.createTopic(transactionsTopic, 1, transactionsTopicConfig, nil); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	s.mu.Unlock()
+
+	c := transactionCoordinator{server: s, partition: topic.partitions[0], epoch: -1}
+	s.transactions = &c
+	c.mu.Lock()
+	err := c.load(s.ctx)
+	transactions := c.transactions
+	c.mu.Unlock()
+	if IsNotLeader(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// Anything that can't be finished yet, such as markers for brokers that
+	// aren't up, is retried by expirePeriodically.
+	ctx, cancel := context.WithTimeout(s.ctx, s.config.BrokerTimeout)
+	defer cancel()
+	now := time.Now()
+	for producerID, txn := range transactions {
+		c.expire(ctx, producerID, txn, now)
+	}
+	return nil
+}
+
+// load replays the transactions topic if this broker has become its leader
+// since it was last loaded. The transactions it finds unfinished replace the
+// ones from before, ended, to be committed if their commit was logged and
+// aborted otherwise. c.mu must be held.
+func (c *transactionCoordinator) load(ctx context.Context) error {
+	c.partition.mu.Lock()
+	if leader := c.partition.leader; leader != c.partition.self {
+		c.partition.mu.Unlock()
+		return notLeader(c.partition.name, leader)
+	}
+	epoch := c.partition.leaderEpoch
+	if epoch == c.epoch {
+		c.partition.mu.Unlock()
+		return nil
+	}
+	if err := c.partition.Flush(); err != nil {
+		c.partition.mu.Unlock()
+		return err
+	}
+	messageSets := make([]*MessageSet, len(c.partition.messageSets))
+	copy(messageSets, c.partition.messageSets)
+	c.partition.mu.Unlock()
+
+	decisions := make(map[int64]*TransactionDecision)
+	for _, messageSet := range messageSets {
+		_, err := messageSet.scan(ctx, func(position int64, batch *RecordBatch) error {
+			messages, err := DecodeRecordBatch(batch)
+			if err != nil {
+				return err
+			}
+			for _, message := range messages {
+				key := new(TransactionKey)
+				if err := proto.Unmarshal(message.Key, key); err != nil {
+					return err
+				}
+				if len(message.Value) == 0 {
+					delete(decisions, key.ProducerId)
+					continue
+				}
+				decision := new(TransactionDecision)
+				if err := proto.Unmarshal(message.Value, decision); err != nil {
+					return err
+				}
+				decisions[key.ProducerId] = decision
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	c.transactions = make(map[int64]*transaction)
+	now := time.Now()
+	for producerID, decision := range decisions {
+		commit := !decision.Ongoing
+		txn := transaction{ended: true, started: now, partitions: make(map[topicPartition]bool), decided: true, commit: commit, logged: commit, marked: make(map[topicPartition]bool)}
+		for _, tp := range decision.GetPartitions() {
+			for _, partition := range tp.Partitions {
+				txn.partitions[topicPartition{tp.Topic, partition}] = true
+			}
+		}
+		c.transactions[producerID] = &txn
+	}
+	c.epoch = epoch
+	return nil
+}
+
+// log durably records a producer's transaction, or with a nil decision, that
+// it is finished.
+func (c *transactionCoordinator) log(ctx context.Context, producerID int64, decision *TransactionDecision) error {
+	key, err := proto.Marshal(&TransactionKey{ProducerId: producerID})
+	if err != nil {
+		return err
+	}
+	var value []byte
+	if decision != nil {
+		if value, err = proto.Marshal(decision); err != nil {
+			return err
+		}
+	}
+	if err := c.partition.checkInsync(); err != nil {
+		return err
+	}
+	_, last, err := c.partition.Publish(ctx, []*Message{{Key: key, Value: value}}, Compression_NONE)
+	if err != nil {
+		return err
+	}
+	if err := c.partition.syncTo(last + 1); err != nil {
+		return err
+	}
+	// A decision that only this broker has could be lost if it fails.
+	return c.partition.waitReplicated(ctx, last+1)
+}
+
+// open returns a producer's transaction, loading the transactions first if
+// this broker has just become the coordinator.
+func (c *transactionCoordinator) open(ctx context.Context, producerID int64) (*transaction, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(ctx); err != nil {
+		return nil, err
+	}
+	txn, ok := c.transactions[producerID]
+	if !ok {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "Producer %d has no transaction open", producerID)
+	}
+	return txn, nil
+}
+
+// join adds partitions of a topic to a producer's open transaction, logging
+// them first if they're new to it.
+func (c *transactionCoordinator) join(ctx context.Context, producerID int64, topic string, partitions []int32) error {
+	txn, err := c.open(ctx, producerID)
+	if err != nil {
+		return err
+	}
+	txn.mu.RLock()
+	defer txn.mu.RUnlock()
+	if txn.ended {
+		return grpc.Errorf(codes.FailedPrecondition, "Transaction of producer %d has already ended", producerID)
+	}
+	txn.logMu.Lock()
+	defer txn.logMu.Unlock()
+	var added []topicPartition
+	for _, id := range partitions {
+		if tp := (topicPartition{topic, id}); !txn.partitions[tp] {
+			txn.partitions[tp] = true
+			added = append(added, tp)
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	decision := txn.decision()
+	decision.Ongoing = true
+	if err := c.log(ctx, producerID, decision); err != nil {
+		// Nothing is published to them without the log saying so.
+		for _, tp := range added {
+			delete(txn.partitions, tp)
+		}
+		return err
+	}
+	return nil
+}
+
+// end commits or aborts a producer's open transaction. If it fails, the
+// transaction is left open until a retry finishes it.
+func (c *transactionCoordinator) end(ctx context.Context, producerID int64, commit bool) error {
+	txn, err := c.open(ctx, producerID)
+	if err != nil {
+		return err
+	}
+	// Wait for partitions already joining the transaction.
+	txn.mu.Lock()
+	txn.ended = true
+	txn.mu.Unlock()
+	return c.finish(ctx, producerID, txn, commit)
+}
+
+// finish logs the decision to commit an ended transaction, unless an earlier
+// attempt did, and has every marker that hasn't been written yet written by
+// the leader of its partition. The transaction is only removed from the
+// coordinator once they all have been, since until then it keeps the last
+// stable offset of its partitions from moving.
+func (c *transactionCoordinator) finish(ctx context.Context, producerID int64, txn *transaction, commit bool) error {
+	txn.logMu.Lock()
+	defer txn.logMu.Unlock()
+	if txn.decided && txn.commit != commit {
+		ending := "aborted"
+		if txn.commit {
+			ending = "committed"
+		}
+		return grpc.Errorf(codes.FailedPrecondition, "Transaction of producer %d is already being %s", producerID, ending)
+	}
+	if txn.finished {
+		return nil
+	}
+	if !txn.decided {
+		txn.decided, txn.commit, txn.marked = true, commit, make(map[topicPartition]bool)
+	}
+
+	control := ControlType_ABORT
+	if commit {
+		control = ControlType_COMMIT
+		if !txn.logged && len(txn.partitions) > 0 {
+			if err := c.log(ctx, producerID, txn.decision()); err != nil {
+				return err
+			}
+			txn.logged = true
+		}
+	}
+	for tp := range txn.partitions {
+		if txn.marked[tp] {
+			continue
+		}
+		request := WriteTransactionMarkerRequest{ProducerId: producerID, Topic: tp.topic, Partition: tp.partition, Control: control}
+		// A topic deleted since it was written to needs no marker.
+		if err := c.server.sendMarker(ctx, &request); err != nil && grpc.Code(err) != codes.NotFound {
+			return err
+		}
+		txn.marked[tp] = true
+	}
+	if len(txn.partitions) > 0 {
+		if err := c.log(ctx, producerID, nil); err != nil {
+			return err
+		}
+	}
+	txn.finished = true
+	c.mu.Lock()
+	if c.transactions[producerID] == txn {
+		delete(c.transactions, producerID)
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// expirePeriodically aborts transactions left open for longer than the
+// transaction timeout and retries finishing ones that failed to, until the
+// server's context is done.
+func (c *transactionCoordinator) expirePeriodically() {
+	ticker := time.NewTicker(transactionCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.server.ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			err := c.load(c.server.ctx)
+			transactions := make(map[int64]*transaction, len(c.transactions))
+			for producerID, txn := range c.transactions {
+				transactions[producerID] = txn
+			}
+			c.mu.Unlock()
+			if err != nil {
+				if !IsNotLeader(err) {
+					log.Print("[", c.partition.name, "] Failed to load transactions: ", err)
+				}
+				continue
+			}
+			for producerID, txn := range transactions {
+				ctx, cancel := context.WithTimeout(c.server.ctx, c.server.config.BrokerTimeout)
+				c.expire(ctx, producerID, txn, now)
+				cancel()
+			}
+		}
+	}
+}
+
+// expire aborts a transaction if it has timed out, or retries finishing it if
+// it was ended.
+func (c *transactionCoordinator) expire(ctx context.Context, producerID int64, txn *transaction, now time.Time) {
+	txn.mu.Lock()
+	if !txn.ended && now.Sub(txn.started) < c.server.config.TransactionTimeout {
+		txn.mu.Unlock()
+		return
+	}
+	if !txn.ended {
+		log.Print("[", c.partition.name, "] Aborting transaction of producer ", producerID, " after ", c.server.config.TransactionTimeout)
+		txn.ended = true
+	}
+	txn.mu.Unlock()
+
+	txn.logMu.Lock()
+	commit := txn.decided && txn.commit
+	txn.logMu.Unlock()
+	if err := c.finish(ctx, producerID, txn, commit); err != nil {
+		log.Print("[", c.partition.name, "] Failed to finish transaction of producer ", producerID, ": ", err)
+	}
+}
+
+// joinTransaction adds partitions of a topic that this broker leads to a
+// producer's transaction, through the coordinator if it's another broker. No
+// marker is written to the partitions until the returned release is called,
+// once the publish has been appended, so the publish can't land after the
+// marker of the transaction it joined.
+func (s *Server) joinTransaction(ctx context.Context, producerID int64, topic *Topic, ids []int) (func(), error) {
+	partitions := make([]int32, len(ids))
+	for i, id := range ids {
+		topic.partitions[id].markerMu.RLock()
+		partitions[i] = int32(id)
+	}
+	release := func() {
+		for _, id := range ids {
+			topic.partitions[id].markerMu.RUnlock()
+		}
+	}
+	request := AddPartitionsToTransactionRequest{ProducerId: producerID, Topic: topic.name, Partitions: partitions}
+	_, err := s.AddPartitionsToTransaction(ctx, &request)
+	if IsNotLeader(err) {
+		s.transactions.partition.mu.Lock()
+		leader := s.transactions.partition.leader
+		s.transactions.partition.mu.Unlock()
+		var client PubSubClient
+		if client, err = s.client(leader); err == nil {
+			_, err = client.AddPartitionsToTransaction(ctx, &request)
+		}
+	}
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+// sendMarker has a transaction marker written by the leader of its
+// partition.
+func (s *Server) sendMarker(ctx context.Context, request *WriteTransactionMarkerRequest) error {
+	_, err := s.WriteTransactionMarker(ctx, request)
+	if !IsNotLeader(err) {
+		return err
+	}
+	topic, err := s.topic(request.Topic)
+	if err != nil {
+		return err
+	}
+	partition, err := topic.Partition(request.Partition)
+	if err != nil {
+		return err
+	}
+	partition.mu.Lock()
+	leader := partition.leader
+	partition.mu.Unlock()
+	client, err := s.client(leader)
+	if err != nil {
+		return err
+	}
+	_, err = client.WriteTransactionMarker(ctx, request)
+	return err
+}
+
+type int32Slice []int32
+
+func (s int32Slice) Len() int           { return len(s) }
+func (s int32Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int32Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (s *Server) BeginTransaction(ctx context.Context, in *BeginTransactionRequest) (*BeginTransactionReply, error) {
+	if in.ProducerId == 0 {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Producer id is required")
+	}
+	c := s.transactions
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(ctx); err != nil {
+		return nil, err
+	}
+	if _, ok := c.transactions[in.ProducerId]; ok {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "Producer %d already has a transaction open", in.ProducerId)
+	}
+	c.transactions[in.ProducerId] = &transaction{partitions: make(map[topicPartition]bool), started: time.Now()}
+	return &BeginTransactionReply{}, nil
+}
+
+func (s *Server) CommitTransaction(ctx context.Context, in *CommitTransactionRequest) (*CommitTransactionReply, error) {
+	if err := s.transactions.end(ctx, in.ProducerId, true); err != nil {
+		return nil, err
+	}
+	return &CommitTransactionReply{}, nil
+}
+
+func (s *Server) AbortTransaction(ctx context.Context, in *AbortTransactionRequest) (*AbortTransactionReply, error) {
+	if err := s.transactions.end(ctx, in.ProducerId, false); err != nil {
+		return nil, err
+	}
+	return &AbortTransactionReply{}, nil
+}
+
+func (s *Server) AddPartitionsToTransaction(ctx context.Context, in *AddPartitionsToTransactionRequest) (*AddPartitionsToTransactionReply, error) {
+	if err := s.transactions.join(ctx, in.ProducerId, in.Topic, in.Partitions); err != nil {
+		return nil, err
+	}
+	return &AddPartitionsToTransactionReply{}, nil
+}
+
+func (s *Server) WriteTransactionMarker(ctx context.Context, in *WriteTransactionMarkerRequest) (*WriteTransactionMarkerReply, error) {
+	if in.Control == ControlType_DATA {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Transaction markers commit or abort")
+	}
+	topic, err := s.topic(in.Topic)
+	if err != nil {
+		return nil, err
+	}
+	partition, err := topic.Partition(in.Partition)
+	if err != nil {
+		return nil, err
+	}
+	// Wait for publishes that joined the transaction before it ended.
+	partition.markerMu.Lock()
+	defer partition.markerMu.Unlock()
+	if err := partition.checkLeader(); err != nil {
+		return nil, err
+	}
+	log.Print("[", partition.name, "] Ending transaction of producer ", in.ProducerId, " with ", in.Control)
+	if err := writeMarker(ctx, partition, in.ProducerId, in.Control); err != nil {
+		return nil, err
+	}
+	return &WriteTransactionMarkerReply{}, nil
+}
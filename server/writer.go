@@ -0,0 +1,131 @@
+// Copyright (C) 2015 Daniel Harrison
+
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// maxAppendsPerFlush bounds how many queued publishes the writer appends
+// before flushing them together.
+const maxAppendsPerFlush = 64
+
+type appendRequest struct {
+	producer    batchProducer
+	messages    []*Message
+	compression Compression
+	// batches are appended as is, instead of messages, by followers of the
+	// leader of epoch.
+	batches []*RecordBatch
+	epoch   int32
+	done    chan appendResult
+}
+
+type appendResult struct {
+	baseOffset uint64
+	lastOffset uint64
+	err        error
+}
+
+// Publish appends messages to the partition as one batch and returns the
+// offsets they were assigned. All appends go through the partition's writer
+// goroutine, so concurrent publishers are serialized and never interleave
+// their records.
+func (p *Partition) Publish(ctx context.Context, messages []*Message, compression Compression) (uint64, uint64, error) {
+	return p.publish(ctx, batchProducer{}, messages, compression)
+}
+
+// publish is Publish for a batch from an idempotent producer.
+func (p *Partition) publish(ctx context.Context, producer batchProducer, messages []*Message, compression Compression) (uint64, uint64, error) {
+	done, err := p.enqueue(ctx, producer, messages, compression)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Once queued, the append happens regardless of ctx, so wait for it to
+	// be able to report the offsets.
+	result := <-done
+	return result.baseOffset, result.lastOffset, result.err
+}
+
+// enqueue hands messages to the writer goroutine and returns the channel the
+// result of appending them is sent on.
+func (p *Partition) enqueue(ctx context.Context, producer batchProducer, messages []*Message, compression Compression) (chan appendResult, error) {
+	return p.send(ctx, appendRequest{producer: producer, messages: messages, compression: compression, done: make(chan appendResult, 1)})
+}
+
+// send hands request to the writer goroutine and returns request.done.
+func (p *Partition) send(ctx context.Context, request appendRequest) (chan appendResult, error) {
+	select {
+	case p.appends <- request:
+		return request.done, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.ctx.Done():
+		return nil, p.ctx.Err()
+	}
+}
+
+// write is the partition's writer goroutine. It appends everything queued since
+// the last flush, flushes once and then replies to each publisher.
+func (p *Partition) write() {
+	for {
+		var requests []appendRequest
+		select {
+		case <-p.ctx.Done():
+			return
+		case request := <-p.appends:
+			requests = append(requests, request)
+		}
+	drain:
+		for len(requests) < maxAppendsPerFlush {
+			select {
+			case request := <-p.appends:
+				requests = append(requests, request)
+			default:
+				break drain
+			}
+		}
+
+		results := make([]appendResult, len(requests))
+		p.mu.Lock()
+		for i, request := range requests {
+			results[i].baseOffset = p.nextOffset()
+			if request.batches != nil {
+				if request.epoch != p.leaderEpoch || !p.following() {
+					results[i].err = errors.New(fmt.Sprintf("Leader of %s changed from epoch %d", p.name, request.epoch))
+					continue
+				}
+				for _, batch := range request.batches {
+					if results[i].err = p.appendBatch(batch); results[i].err != nil {
+						break
+					}
+				}
+				continue
+			}
+			if p.leader != p.self {
+				// Lost leadership since the publish checked.
+				results[i].err = notLeader(p.name, p.leader)
+				continue
+			}
+			if results[i].err = p.Append(request.producer, request.messages, request.compression); results[i].err != nil {
+				continue
+			}
+			if len(request.messages) > 0 {
+				results[i].lastOffset = request.messages[len(request.messages)-1].Offset
+			}
+		}
+		err := p.Flush()
+		p.mu.Unlock()
+
+		for i, request := range requests {
+			if results[i].err == nil {
+				results[i].err = err
+			}
+			request.done <- results[i]
+		}
+	}
+}
@@ -6,28 +6,30 @@ import (
 	"flag"
 	"io"
 	"log"
+	"strings"
 	"time"
 
+	"github.com/paperstreet/gopubsub/client"
 	pb "github.com/paperstreet/gopubsub/server"
 	"golang.org/x/net/context"
-	"google.golang.org/grpc"
 )
 
 func main() {
-	var address = flag.String("address", "localhost:8054", "")
+	var address = flag.String("address", "localhost:8054", "Comma separated addresses of brokers to find the rest of the cluster from")
 	var topic = flag.String("topic", "0", "")
 	var offset = flag.Int("offset", 0, "")
+	var partition = flag.Int("partition", 0, "")
+	var group = flag.String("group", "", "Consumer group to resume from and commit offsets to")
 
 	flag.Parse()
 
-	conn, err := grpc.Dial(*address)
+	c, err := client.NewClient(context.Background(), strings.Split(*address, ","))
 	if err != nil {
 		log.Fatalf("Did not connect: %v", err)
 	}
-	defer conn.Close()
-	c := pb.NewPubSubClient(conn)
+	defer c.Close()
 
-	stream, err := c.Subscribe(context.Background(), &pb.SubscribeRequest{*topic, uint64(*offset)})
+	stream, err := c.Subscribe(context.Background(), &pb.SubscribeRequest{Topic: *topic, Partition: int32(*partition), Offset: uint64(*offset), Group: *group})
 	if err != nil {
 		log.Fatalf("Could not subscribe: %v", err)
 	}
@@ -40,11 +42,23 @@ func main() {
 		if err != nil {
 			log.Fatalf("%v.Subscribe(_) = _, %v", c, err)
 		}
-		for _, message := range response.GetMessages() {
-			var messageTime time.Time
-			if err := messageTime.UnmarshalText(message.Key); err == nil {
-				diff := time.Now().Sub(messageTime)
-				log.Print("[", *topic, "] ", diff.String(), "|", string(message.Value))
+		messages := response.GetMessages()
+		for _, batch := range response.GetBatches() {
+			batchMessages, err := pb.DecodeRecordBatch(batch)
+			if err != nil {
+				log.Fatalf("Could not decode batch: %v", err)
+			}
+			messages = append(messages, batchMessages...)
+		}
+		for _, message := range messages {
+			messageTime := time.Unix(0, message.Timestamp*int64(time.Millisecond))
+			diff := time.Now().Sub(messageTime)
+			log.Print("[", *topic, "/", *partition, "] ", diff.String(), "|", message.GetHeaders(), "|", string(message.Value))
+		}
+		if *group != "" && len(messages) > 0 {
+			commit := pb.CommitOffsetRequest{Group: *group, Topic: *topic, Partition: int32(*partition), Offset: messages[len(messages)-1].Offset + 1}
+			if err := c.CommitOffset(context.Background(), &commit); err != nil {
+				log.Fatalf("Could not commit offset: %v", err)
 			}
 		}
 	}